@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
 	"strconv"
 	"strings"
 	"time"
@@ -336,23 +337,8 @@ func (ph *PacketHandler) handlePacket(packet gopacket.Packet) {
 		}
 
 		// Parse payload based on message type
-		if len(payload) > 12 {
-			switch hdr.MessageType {
-			case protocol.MessageTypeLiveCmd:
-				if cmd, err := protocol.ParseLiveCmd(payload[12:]); err == nil {
-					packetData.Payload = cmd
-				}
-			case protocol.MessageTypeDeviceData:
-				if hdr.Status == protocol.StatusResponseClient {
-					if data, err := protocol.ParseDeviceDataResponse(payload[12:]); err == nil {
-						packetData.Payload = data
-					}
-				}
-			case protocol.MessageTypePresetRecall:
-				if recall, err := protocol.ParsePresetRecall(payload[12:]); err == nil {
-					packetData.Payload = recall
-				}
-			}
+		if decoded, err := protocol.DecodePayload(hdr, payload[protocol.HeaderSize:]); err == nil {
+			packetData.Payload = decoded
 		}
 
 		ph.outputPacket(packetData)
@@ -442,9 +428,27 @@ func (ph *PacketHandler) outputTextFormat(data PacketData) {
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("LiveCmd.Path:"),
 				valueStyle.Render(fmt.Sprintf("%x", p.Path)))
+			path, pathErr := p.ParsedPath()
+			if pathErr == nil {
+				fmt.Printf("%s %s\n",
+					fieldStyle.Render("LiveCmd.ParsedPath:"),
+					valueStyle.Render(path.String()))
+			}
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("LiveCmd.Value:"),
 				valueStyle.Render(fmt.Sprintf("%x", p.Value)))
+			if pathErr == nil && !p.HasString() {
+				if v, ok := formatLiveCmdValue(path.Leaf(), p.Value); ok {
+					fmt.Printf("%s %s\n",
+						fieldStyle.Render("LiveCmd.ParsedValue:"),
+						valueStyle.Render(v))
+				}
+			}
+			if p.HasString() {
+				fmt.Printf("%s '%s'\n",
+					fieldStyle.Render("LiveCmd.ValueString:"),
+					valueStyle.Render(p.ValueString))
+			}
 		case *protocol.DeviceDataResponse:
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.CrtFlags:"),
@@ -460,28 +464,28 @@ func (ph *PacketHandler) outputTextFormat(data PacketData) {
 				valueStyle.Render(fmt.Sprintf("%x", p.SubnetPrefixLength)))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.DiagnosticState:"),
-				valueStyle.Render(fmt.Sprintf("%x", p.DiagnosticState)))
+				valueStyle.Render(p.Diagnostic().String()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.FirmwareVersion:"),
-				valueStyle.Render(fmt.Sprintf("%x", p.FirmwareVersion)))
+				valueStyle.Render(p.Firmware().String()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.SerialNumber:"),
 				valueStyle.Render(fmt.Sprintf("%x", p.SerialNumber)))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.GatewayIP:"),
-				valueStyle.Render(formatIpv4Address(p.GatewayIP)))
+				valueStyle.Render(p.Gateway().String()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.StaticIP:"),
-				valueStyle.Render(formatIpv4Address(p.StaticIP)))
+				valueStyle.Render(p.IP().String()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.HardwareFeatures:"),
-				valueStyle.Render(fmt.Sprintf("%x", p.HardwareFeatures)))
+				valueStyle.Render(p.Features().String()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("DeviceData.StartPresetId:"),
 				valueStyle.Render(fmt.Sprintf("%x", p.StartPresetId)))
 			fmt.Printf("%s '%s'\n",
 				fieldStyle.Render("DeviceData.DeviceName:"),
-				valueStyle.Render(string(p.DeviceName[:])))
+				valueStyle.Render(p.Name()))
 			fmt.Printf("%s %s\n",
 				fieldStyle.Render("Device.VendorID:"),
 				valueStyle.Render(fmt.Sprintf("%x", p.VendorID)))
@@ -499,6 +503,24 @@ func (ph *PacketHandler) outputTextFormat(data PacketData) {
 	}
 }
 
-func formatIpv4Address(ip [4]byte) string {
-	return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
+// formatLiveCmdValue converts the raw value of a LiveCmd to the unit of its parameter
+func formatLiveCmdValue(levelType protocol.LevelType, value uint32) (string, bool) {
+	switch levelType {
+	case protocol.LevelTypeGain:
+		return fmt.Sprintf("%.1f dB", units.GainFromValue(value)), true
+	case protocol.LevelTypeDelay:
+		return fmt.Sprintf("%.2f ms (%.2f m)", units.DelayMsFromValue(value), units.DelayMetersFromValue(value)), true
+	case protocol.LevelTypeQuality:
+		return fmt.Sprintf("Q %.2f", units.QualityFromValue(value)), true
+	case protocol.LevelTypeEqType:
+		eqType, err := units.EqTypeFromValue(value)
+		if err != nil {
+			return "", false
+		}
+		return eqType.String(), true
+	case protocol.LevelTypeMute, protocol.LevelTypeActive, protocol.LevelTypePhaseInversion:
+		return strconv.FormatBool(value != 0), true
+	default:
+		return "", false
+	}
 }
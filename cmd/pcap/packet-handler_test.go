@@ -152,7 +152,7 @@ func TestPacketHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ph := NewPacketHandler(tt.input, false, 0)
+			ph := NewPacketHandler(tt.input, "", false, 0, "text")
 
 			// Test accepted types
 			for _, msgType := range tt.acceptedTypes {
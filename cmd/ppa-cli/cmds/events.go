@@ -0,0 +1,64 @@
+package cmds
+
+import (
+	"errors"
+	"ppa-control/lib/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// loggedEvents are the client events the commands log
+var loggedEvents = client.FilterTypes(
+	client.EventDeviceOnline,
+	client.EventDeviceOffline,
+	client.EventDeviceMoved,
+	client.EventDeviceInfoReceived,
+	client.EventMessageReceived,
+	client.EventCommandFailed,
+	client.EventUnknownPacket,
+)
+
+// logEvent logs a client event
+func logEvent(e client.Event) {
+	switch ev := e.(type) {
+	case client.DeviceOnline:
+		log.Info().Str("addr", ev.Addr).Str("iface", ev.Interface).Msg("device online")
+	case client.DeviceOffline:
+		log.Info().Err(ev.Err).Str("addr", ev.Addr).Str("iface", ev.Interface).Msg("device offline")
+	case client.DeviceMoved:
+		log.Info().Str("addr", ev.Addr).Str("from", ev.From).Msg("device moved")
+	case client.DeviceInfoReceived:
+		log.Info().Str("addr", ev.Addr).
+			Str("device", ev.Info.Name).
+			Uint16("type", ev.Info.DeviceTypeId).
+			Uint16("serial", ev.Info.SerialNumber).
+			Stringer("firmware", ev.Info.FirmwareVersion).
+			Stringer("diagnostic", ev.Info.DiagnosticState).
+			Msg("device info")
+	case client.MessageReceived:
+		log.Info().Str("from", ev.Message.RemoteAddress.String()).
+			Str("addr", ev.Addr).
+			Str("type", ev.Message.Header.MessageType.String()).
+			Str("status", ev.Message.Header.Status.String()).
+			Interface("body", ev.Message.Body).
+			Msg("received message")
+	case client.CommandFailed:
+		log.Warn().Err(ev.Err).Str("addr", ev.Addr).Msg("command failed")
+	case client.UnknownPacket:
+		log.Debug().Str("from", ev.RemoteAddress.String()).
+			Str("addr", ev.Addr).
+			Msg("received unknown message")
+	}
+}
+
+// logSendError logs the error of a CommanderV2 command, with one entry per failed device
+func logSendError(err error, what string) {
+	var devicesErr *client.ErrDevicesFailed
+	if errors.As(err, &devicesErr) {
+		for addr, deviceErr := range devicesErr.Errors {
+			log.Error().Err(deviceErr).Str("addr", addr).Msgf("failed to send %s", what)
+		}
+		return
+	}
+	log.Error().Err(err).Msgf("failed to send %s", what)
+}
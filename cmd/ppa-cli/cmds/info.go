@@ -0,0 +1,173 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"ppa-control/lib"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the device info of one or multiple PPA servers",
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.PersistentFlags().GetDuration("timeout")
+
+		// Setup command context
+		cmdCtx := lib.SetupCommand(cmd)
+		defer cmdCtx.Cancel()
+
+		// Setup multiclient, which queries the device info of every client it adds
+		if err := cmdCtx.SetupMultiClient("info"); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup multiclient")
+			return
+		}
+		mc := cmdCtx.GetMultiClient()
+
+		// Subscribe before discovery starts, so that no device is missed
+		events := mc.Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{client.FilterTypes(
+				client.EventDeviceInfoReceived,
+				client.EventDeviceOnline,
+				client.EventCommandFailed,
+			)},
+		})
+		defer events.Unsubscribe()
+
+		// Setup discovery if enabled
+		cmdCtx.SetupDiscoveryClients()
+
+		// Start multiclient
+		cmdCtx.StartMultiClient()
+
+		// Main command loop
+		cmdCtx.RunInGroup(func() error {
+			// Without discovery, we are done once all devices sent their info
+			runOnce := !cmdCtx.Config.Discovery
+			// broadcast addresses reach many devices, which only report their info to a
+			// client of their own, see --discover
+			expected := 0
+			for addr, c := range mc.Clients() {
+				if client.IsBroadcast(c) {
+					log.Warn().Str("addr", addr).Msg("Skipping broadcast address, use --discover to query the devices it reaches")
+					continue
+				}
+				expected++
+			}
+			if runOnce && expected == 0 {
+				return fmt.Errorf("no devices to query, pass --addresses or --discover")
+			}
+
+			var timeoutCh <-chan time.Time
+			if runOnce {
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				timeoutCh = timer.C
+			}
+
+			printed := make(map[string]bool)
+			show := func(addr string, info client.DeviceInfo) {
+				if printed[addr] {
+					return
+				}
+				printed[addr] = true
+				printDeviceInfo(addr, info)
+			}
+
+			// devices might have answered before we subscribed
+			for _, s := range mc.DeviceStates() {
+				if s.HasDeviceData {
+					show(s.Addr, s.DeviceInfo)
+				}
+			}
+
+			for {
+				if runOnce && len(printed) >= expected {
+					cmdCtx.Cancel()
+					return nil
+				}
+
+				select {
+				case <-cmdCtx.Context().Done():
+					return cmdCtx.Context().Err()
+
+				case <-timeoutCh:
+					return fmt.Errorf("%d device(s) did not send their info", expected-len(printed))
+
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					switch ev := e.(type) {
+					case client.DeviceInfoReceived:
+						show(ev.Addr, ev.Info)
+					default:
+						logEvent(e)
+					}
+				}
+			}
+		})
+
+		// Wait for completion
+		if err := cmdCtx.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			os.Exit(1)
+		}
+	},
+}
+
+func printDeviceInfo(addr string, info client.DeviceInfo) {
+	fmt.Printf("%s\t%s\n", addr, info.Name)
+	fmt.Printf("  type:         %d (vendor %d)\n", info.DeviceTypeId, info.VendorID)
+	if m, ok := info.Model(); ok {
+		fmt.Printf("  model:        %s (%d inputs, %d outputs, %d presets)\n",
+			m.Name, m.Inputs, m.Outputs, m.PresetSlots)
+		for _, q := range m.QuirksFor(info.FirmwareVersion) {
+			fmt.Printf("  quirk:        %s\n", q.Description)
+		}
+	} else {
+		fmt.Printf("  model:        unknown\n")
+	}
+	fmt.Printf("  serial:       %d\n", info.SerialNumber)
+	fmt.Printf("  catalog key:  %s\n", presets.DeviceKey(info))
+	fmt.Printf("  firmware:     %s\n", info.FirmwareVersion)
+	fmt.Printf("  diagnostic:   %s\n", info.DiagnosticState)
+	fmt.Printf("  features:     %s\n", info.HardwareFeatures)
+	fmt.Printf("  ip:           %s\n", info.StaticIP)
+	fmt.Printf("  gateway:      %s\n", info.GatewayIP)
+	fmt.Printf("  start preset: %d\n", info.StartPreset)
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+	infoCmd.PersistentFlags().StringP(
+		"addresses", "a", "",
+		"Addresses to query, comma separated",
+	)
+	infoCmd.PersistentFlags().BoolP(
+		"discover", "d", false,
+		"Send broadcast discovery messages",
+	)
+	infoCmd.PersistentFlags().StringArray(
+		"interfaces", []string{},
+		"Interfaces to use for discovery",
+	)
+	infoCmd.PersistentFlags().UintP(
+		"componentId", "c", 0xFF,
+		"Component ID to use for devices",
+	)
+	infoCmd.PersistentFlags().UintP(
+		"port", "p", 5001,
+		"Port to use",
+	)
+	infoCmd.PersistentFlags().Duration(
+		"timeout", 10*time.Second,
+		"Time to wait for the devices to answer",
+	)
+}
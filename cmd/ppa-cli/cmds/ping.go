@@ -2,6 +2,7 @@ package cmds
 
 import (
 	"ppa-control/lib"
+	"ppa-control/lib/client"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -22,8 +23,14 @@ var pingCmd = &cobra.Command{
 			return
 		}
 
+		// Subscribe before discovery starts, so that no device is missed
+		events := cmdCtx.GetMultiClient().Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{loggedEvents},
+		})
+		defer events.Unsubscribe()
+
 		// Setup discovery if enabled
-		cmdCtx.SetupDiscovery()
+		cmdCtx.SetupDiscoveryClients()
 
 		// Start multiclient
 		cmdCtx.StartMultiClient()
@@ -31,41 +38,33 @@ var pingCmd = &cobra.Command{
 		// Main command loop
 		cmdCtx.RunInGroup(func() error {
 			// Send initial ping
-			cmdCtx.GetMultiClient().SendPing()
+			if err := cmdCtx.GetMultiClient().Ping(cmdCtx.Context()); err != nil {
+				logSendError(err, "ping")
+			}
 
-			for {
-				t := time.NewTimer(5 * time.Second)
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
 
+			for {
 				select {
 				case <-cmdCtx.Context().Done():
-					t.Stop()
 					return cmdCtx.Context().Err()
 
-				case <-t.C:
-					cmdCtx.GetMultiClient().SendPing()
-
-				case msg := <-cmdCtx.Channels.ReceivedCh:
-					t.Stop()
-					if msg.Header != nil {
-						log.Info().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Str("type", msg.Header.MessageType.String()).
-							Str("status", msg.Header.Status.String()).
-							Msg("received message")
-					} else {
-						log.Debug().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Msg("received unknown message")
+				case <-ticker.C:
+					if err := cmdCtx.GetMultiClient().Ping(cmdCtx.Context()); err != nil {
+						logSendError(err, "ping")
 					}
 
-				case msg := <-cmdCtx.Channels.DiscoveryCh:
-					t.Stop()
-					log.Debug().Str("addr", msg.GetAddress()).Msg("discovery message")
-					if newClient, err := cmdCtx.HandleDiscoveryMessage(msg); err != nil {
-						return err
-					} else if newClient != nil {
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					logEvent(e)
+					if online, ok := e.(client.DeviceOnline); ok {
 						// Send ping immediately to newly discovered client
-						newClient.SendPing()
+						if err := online.Client.Ping(cmdCtx.Context()); err != nil {
+							logSendError(err, "ping")
+						}
 					}
 				}
 			}
@@ -0,0 +1,149 @@
+package cmds
+
+import (
+	"fmt"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var presetsCmd = &cobra.Command{
+	Use:   "presets",
+	Short: "List or edit the local preset catalog",
+	Long: `List the preset names of each device in the local preset catalog.
+
+Devices are identified by the catalog key shown by "ppa-cli info". With
+--device and --preset, the name or position of a preset is set instead.
+Names are also recorded by "ppa-cli save", and used by "ppa-cli recall --name".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		device, _ := cmd.PersistentFlags().GetString("device")
+		preset, _ := cmd.PersistentFlags().GetInt("preset")
+
+		catalog := loadCatalog(cmd)
+
+		if device == "" {
+			printCatalog(catalog)
+			return
+		}
+		if preset < 0 {
+			log.Fatal().Msg("--preset is required to edit a preset")
+		}
+
+		if cmd.PersistentFlags().Changed("name") {
+			name, _ := cmd.PersistentFlags().GetString("name")
+			catalog.SetName(device, preset, name)
+		}
+		if cmd.PersistentFlags().Changed("position") {
+			position, _ := cmd.PersistentFlags().GetInt("position")
+			catalog.SetPosition(device, preset, position)
+		}
+		if err := catalog.Save(); err != nil {
+			log.Fatal().Err(err).Str("catalog", catalog.Path()).Msg("Failed to save preset catalog")
+		}
+
+		p, _ := catalog.Preset(device, preset)
+		fmt.Println(device)
+		printPreset(p)
+	},
+}
+
+func printCatalog(catalog *presets.Catalog) {
+	for _, device := range catalog.Devices() {
+		fmt.Println(device)
+		for _, p := range catalog.Presets(device) {
+			printPreset(p)
+		}
+	}
+}
+
+func printPreset(p presets.Preset) {
+	position := "-"
+	if p.Position >= 0 {
+		position = fmt.Sprint(p.Position)
+	}
+	recalled := "never"
+	if !p.LastRecalled.IsZero() {
+		recalled = p.LastRecalled.Format(time.DateTime)
+	}
+	fmt.Printf("  %3d  position %-3s  %-32s  last recalled %s\n", p.Index, position, p.Name, recalled)
+}
+
+// loadCatalog loads the preset catalog given by the --catalog flag,
+// defaulting to presets.DefaultPath.
+func loadCatalog(cmd *cobra.Command) *presets.Catalog {
+	path, _ := cmd.Flags().GetString("catalog")
+	if path == "" {
+		var err error
+		path, err = presets.DefaultPath()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to find preset catalog")
+		}
+	}
+	catalog, err := presets.Load(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load preset catalog")
+	}
+	return catalog
+}
+
+// catalogKey returns the catalog key of the device at addr, if its info was received
+func catalogKey(mc *client.MultiClient, addr string) (string, bool) {
+	s, ok := mc.DeviceState(addr)
+	if !ok || !s.HasDeviceData {
+		return "", false
+	}
+	return presets.DeviceKey(s.DeviceInfo), true
+}
+
+// catalogUpdates holds the catalog updates of acknowledged commands, by device address,
+// until the info of the device, and with it its catalog key, is received
+type catalogUpdates map[string]func(key string)
+
+// apply runs update with the catalog key of the device at addr, or keeps it until its info is received
+func (u catalogUpdates) apply(mc *client.MultiClient, addr string, update func(key string)) {
+	if key, ok := catalogKey(mc, addr); ok {
+		update(key)
+		return
+	}
+	u[addr] = update
+}
+
+// received runs the update kept for the device that sent info
+func (u catalogUpdates) received(addr string, info client.DeviceInfo) {
+	if update, ok := u[addr]; ok {
+		delete(u, addr)
+		update(presets.DeviceKey(info))
+	}
+}
+
+// drop discards the updates of devices whose info was never received
+func (u catalogUpdates) drop() {
+	for addr := range u {
+		log.Warn().Str("addr", addr).Msg("device did not send its info, preset catalog not updated")
+		delete(u, addr)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(presetsCmd)
+
+	presetsCmd.PersistentFlags().String(
+		"device", "",
+		"Catalog key of the device to edit",
+	)
+	presetsCmd.PersistentFlags().Int(
+		"preset", -1,
+		"Index of the preset to edit",
+	)
+	presetsCmd.PersistentFlags().String(
+		"name", "",
+		"Name of the preset",
+	)
+	presetsCmd.PersistentFlags().Int(
+		"position", -1,
+		"Position of the preset on the device, -1 if unknown",
+	)
+}
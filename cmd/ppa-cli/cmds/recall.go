@@ -1,7 +1,13 @@
 package cmds
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"ppa-control/lib"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -10,82 +16,317 @@ import (
 
 var recallCmd = &cobra.Command{
 	Use:   "recall",
-	Short: "Recall a preset by index",
+	Short: "Recall a preset by index, position or name",
+	Long: `Recall a preset by index (--preset), by its position on the device
+(--position) or by its name in the local preset catalog (--name).
+
+Recalls by index or position are sent right away. Recalls by name are sent
+once the device reported its info, which is needed to look the name up in
+the catalog of the device, and fail if it doesn't within --info-timeout.
+Acknowledged recalls are recorded in the catalog.
+
+Recalls to a broadcast address like 255.255.255.255 are sent once, without
+waiting for acknowledgements, as any number of devices may answer. They
+can't be recalled by name and are not recorded in the catalog.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Get command-specific flags
 		preset, _ := cmd.PersistentFlags().GetInt("preset")
+		position, _ := cmd.PersistentFlags().GetInt("position")
+		name, _ := cmd.PersistentFlags().GetString("name")
 		loop, _ := cmd.PersistentFlags().GetBool("loop")
+		retries, _ := cmd.PersistentFlags().GetInt("retries")
+		timeout, _ := cmd.PersistentFlags().GetDuration("timeout")
+		infoTimeout, _ := cmd.PersistentFlags().GetDuration("info-timeout")
+
+		policy := client.DefaultRetryPolicy
+		policy.MaxAttempts = retries + 1
+		policy.AttemptTimeout = timeout
+
+		catalog := loadCatalog(cmd)
+		byName := name != ""
+
+		req, err := presetRecallRequest(preset, position)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid preset")
+			return
+		}
+		what := fmt.Sprintf("preset %d", preset)
+		if position >= 0 {
+			what = fmt.Sprintf("position %d", position)
+		}
+		if byName {
+			what = fmt.Sprintf("preset %q", name)
+		}
+
+		// catalogIndex returns the catalog index of the recalled preset of the device with key
+		catalogIndex := func(key string) (int, bool) {
+			switch {
+			case byName:
+				p, ok := catalog.FindByName(key, name)
+				return p.Index, ok
+			case position >= 0:
+				p, ok := catalog.FindByPosition(key, position)
+				return p.Index, ok
+			default:
+				return preset, true
+			}
+		}
 
 		// Setup command context
 		cmdCtx := lib.SetupCommand(cmd)
 		defer cmdCtx.Cancel()
 
-		// Setup multiclient
+		// Setup multiclient, which queries the device info of every client it adds
 		if err := cmdCtx.SetupMultiClient("recall"); err != nil {
 			log.Fatal().Err(err).Msg("Failed to setup multiclient")
 			return
 		}
+		mc := cmdCtx.GetMultiClient()
+
+		// Subscribe before discovery starts, so that no device is missed
+		events := mc.Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{loggedEvents},
+		})
+		defer events.Unsubscribe()
 
 		// Setup discovery if enabled
-		cmdCtx.SetupDiscovery()
+		cmdCtx.SetupDiscoveryClients()
 
 		// Start multiclient
 		cmdCtx.StartMultiClient()
 
+		// Recalls run in the background so that events keep being handled
+		resultCh := make(chan client.Result)
+		report := func(result client.Result) {
+			select {
+			case resultCh <- result:
+			case <-cmdCtx.Context().Done():
+			}
+		}
+		recallOne := func(addr string, req client.Request) {
+			go func() {
+				report(mc.SendWithRetryTo(cmdCtx.Context(), addr, req, policy))
+			}()
+		}
+		isBroadcast := func(addr string) bool {
+			c, ok := mc.Client(addr)
+			return ok && client.IsBroadcast(c)
+		}
+
+		// recallTo recalls the preset on the device, looking up named presets in the
+		// catalog of the device and recalling them by position if the catalog knows it.
+		recallTo := func(addr string, info client.DeviceInfo) {
+			if !byName {
+				recallOne(addr, req)
+				return
+			}
+			if isBroadcast(addr) {
+				go report(client.Result{
+					Addr:      addr,
+					Err:       fmt.Errorf("%s is a broadcast address, recalls by name need the info of a single device", addr),
+					Broadcast: true,
+				})
+				return
+			}
+
+			key := presets.DeviceKey(info)
+			p, ok := catalog.FindByName(key, name)
+			var err error
+			if !ok {
+				err = fmt.Errorf("no preset named %q in the catalog of %s", name, key)
+			}
+			var req client.Request
+			if err == nil {
+				req, err = presetRecallRequest(p.Index, p.Position)
+			}
+			if err != nil {
+				go report(client.Result{Addr: addr, Err: err})
+				return
+			}
+			recallOne(addr, req)
+		}
+
+		// waiting holds the devices whose info is needed to look up the preset name
+		waiting := make(map[string]bool)
+		infoTimeoutCh := make(chan string)
+		// start recalls the preset on the device right away, unless its name has to be looked
+		// up in the catalog of the device and the device info was not received yet
+		start := func(addr string) {
+			if !byName || isBroadcast(addr) {
+				recallTo(addr, client.DeviceInfo{})
+				return
+			}
+			if s, ok := mc.DeviceState(addr); ok && s.HasDeviceData {
+				recallTo(addr, s.DeviceInfo)
+				return
+			}
+			if waiting[addr] {
+				return
+			}
+			waiting[addr] = true
+			go func() {
+				select {
+				case <-time.After(infoTimeout):
+					select {
+					case infoTimeoutCh <- addr:
+					case <-cmdCtx.Context().Done():
+					}
+				case <-cmdCtx.Context().Done():
+				}
+			}()
+		}
+		recallAll := func() {
+			for addr := range mc.Clients() {
+				start(addr)
+			}
+		}
+
+		// markRecalled records an acknowledged recall in the catalog of the device with key
+		markRecalled := func(key string) {
+			index, ok := catalogIndex(key)
+			if !ok {
+				return
+			}
+			catalog.MarkRecalled(key, index, time.Now())
+			if err := catalog.Save(); err != nil {
+				log.Warn().Err(err).Str("catalog", catalog.Path()).Msg("Failed to save preset catalog")
+			}
+		}
+
 		// Main command loop
 		cmdCtx.RunInGroup(func() error {
-			// Send initial recall
-			cmdCtx.GetMultiClient().SendPresetRecallByPresetIndex(preset)
+			// Without discovery or loop, we are done once all devices acknowledged the recall
+			runOnce := !loop && !cmdCtx.Config.Discovery
+			clients := mc.Clients()
+			expected := len(clients)
+			if runOnce && expected == 0 {
+				return fmt.Errorf("no devices to recall on, pass --addresses or --discover")
+			}
+			done, failed := 0, 0
+			// acknowledged recalls of devices whose info is needed to record them in the catalog
+			updates := make(catalogUpdates)
+			var updatesTimeout <-chan time.Time
+
+			recalled := make(map[string]bool)
+			for addr := range clients {
+				recalled[addr] = true
+				start(addr)
+			}
 
-			// If not looping, just wait for context cancellation
-			if !loop {
-				<-cmdCtx.Context().Done()
-				return cmdCtx.Context().Err()
+			var loopCh <-chan time.Time
+			if loop {
+				ticker := time.NewTicker(5 * time.Second)
+				defer ticker.Stop()
+				loopCh = ticker.C
 			}
 
 			for {
-				t := time.NewTimer(5 * time.Second)
+				if runOnce && done >= expected {
+					if len(updates) == 0 {
+						if failed > 0 {
+							return fmt.Errorf("%d device(s) did not acknowledge preset recall", failed)
+						}
+						cmdCtx.Cancel()
+						return nil
+					}
+					if updatesTimeout == nil {
+						updatesTimeout = time.After(infoTimeout)
+					}
+				}
 
 				select {
 				case <-cmdCtx.Context().Done():
-					t.Stop()
 					return cmdCtx.Context().Err()
 
-				case <-t.C:
-					cmdCtx.GetMultiClient().SendPresetRecallByPresetIndex(preset)
-
-				case msg := <-cmdCtx.Channels.ReceivedCh:
-					t.Stop()
-					if msg.Header != nil {
-						log.Info().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Str("type", msg.Header.MessageType.String()).
-							Str("status", msg.Header.Status.String()).
-							Msg("received message")
-					} else {
-						log.Debug().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Msg("received unknown message")
+				case <-loopCh:
+					recallAll()
+
+				case <-updatesTimeout:
+					updates.drop()
+
+				case addr := <-infoTimeoutCh:
+					if waiting[addr] {
+						delete(waiting, addr)
+						go report(client.Result{
+							Addr: addr,
+							Err:  fmt.Errorf("no device info within %s, needed to look up the preset name", infoTimeout),
+						})
+					}
+
+				case result := <-resultCh:
+					done++
+					if logRecallResults(what, []client.Result{result}) > 0 {
+						failed++
+						continue
+					}
+					if !result.Broadcast {
+						updates.apply(mc, result.Addr, markRecalled)
 					}
 
-				case msg := <-cmdCtx.Channels.DiscoveryCh:
-					t.Stop()
-					log.Debug().Str("addr", msg.GetAddress()).Msg("discovery message")
-					if newClient, err := cmdCtx.HandleDiscoveryMessage(msg); err != nil {
-						return err
-					} else if newClient != nil {
-						// Send recall immediately to newly discovered client
-						newClient.SendPresetRecallByPresetIndex(preset)
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					logEvent(e)
+					switch ev := e.(type) {
+					case client.DeviceOnline:
+						// Send recall to devices added by discovery
+						if !recalled[ev.Addr] {
+							recalled[ev.Addr] = true
+							start(ev.Addr)
+						}
+					case client.DeviceInfoReceived:
+						if waiting[ev.Addr] {
+							delete(waiting, ev.Addr)
+							recallTo(ev.Addr, ev.Info)
+						}
+						updates.received(ev.Addr, ev.Info)
 					}
 				}
 			}
 		})
 
 		// Wait for completion
-		cmdCtx.Wait()
+		if err := cmdCtx.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			os.Exit(1)
+		}
 	},
 }
 
+// presetRecallRequest recalls the preset at position if it is not negative, or else by index
+func presetRecallRequest(index int, position int) (client.Request, error) {
+	if position >= 0 {
+		return client.NewPresetRecallByPresetPositionRequest(position)
+	}
+	return client.NewPresetRecallByPresetIndexRequest(index)
+}
+
+// logRecallResults logs the outcome of a recall for each device and returns the number of failures.
+func logRecallResults(what string, results []client.Result) int {
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			log.Error().Err(result.Err).
+				Str("addr", result.Addr).
+				Str("preset", what).
+				Msg("preset recall failed")
+		case result.Broadcast:
+			log.Info().
+				Str("addr", result.Addr).
+				Str("preset", what).
+				Msg("preset recall sent to broadcast address")
+		default:
+			log.Info().
+				Str("addr", result.Addr).
+				Str("preset", what).
+				Msg("preset recall acknowledged")
+		}
+	}
+	return failed
+}
+
 func init() {
 	rootCmd.AddCommand(recallCmd)
 
@@ -111,10 +352,30 @@ func init() {
 	)
 	recallCmd.PersistentFlags().IntP(
 		"preset", "", 0,
-		"Preset to recall",
+		"Index of the preset to recall",
+	)
+	recallCmd.PersistentFlags().Int(
+		"position", -1,
+		"Position of the preset to recall, instead of its index",
+	)
+	recallCmd.PersistentFlags().String(
+		"name", "",
+		"Name of the preset to recall, looked up in the preset catalog",
 	)
 	recallCmd.PersistentFlags().UintP(
 		"port", "p", 5001,
 		"Port to use",
 	)
+	recallCmd.PersistentFlags().Int(
+		"retries", client.DefaultRetryPolicy.MaxAttempts-1,
+		"Number of times to resend an unacknowledged recall",
+	)
+	recallCmd.PersistentFlags().Duration(
+		"timeout", client.DefaultRetryPolicy.AttemptTimeout,
+		"Time to wait for an acknowledgement before resending",
+	)
+	recallCmd.PersistentFlags().Duration(
+		"info-timeout", client.Timeout,
+		"Time to wait for the device info, needed to look up --name and to record recalls in the catalog",
+	)
 }
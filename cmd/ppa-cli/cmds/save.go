@@ -0,0 +1,238 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"ppa-control/lib"
+	"ppa-control/lib/client"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var saveCmd = &cobra.Command{
+	Use:   "save",
+	Short: "Save the current settings into a preset slot",
+	Long: `Save the current settings into a preset slot, named --name.
+
+The save is sent right away. Once the device reported its info, saves into
+slots its model doesn't have are rejected. Acknowledged saves record the name
+in the local preset catalog, for "ppa-cli recall --name", once the device
+reported its info, waiting at most --info-timeout for it.
+
+Saves to a broadcast address like 255.255.255.255 are sent once, without
+waiting for acknowledgements, and are not recorded in the catalog.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Get command-specific flags
+		preset, _ := cmd.PersistentFlags().GetInt("preset")
+		name, _ := cmd.PersistentFlags().GetString("name")
+		retries, _ := cmd.PersistentFlags().GetInt("retries")
+		timeout, _ := cmd.PersistentFlags().GetDuration("timeout")
+		infoTimeout, _ := cmd.PersistentFlags().GetDuration("info-timeout")
+
+		policy := client.DefaultRetryPolicy
+		policy.MaxAttempts = retries + 1
+		policy.AttemptTimeout = timeout
+
+		req, err := client.NewPresetSaveRequest(preset, name)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid preset save")
+		}
+
+		catalog := loadCatalog(cmd)
+
+		// Setup command context
+		cmdCtx := lib.SetupCommand(cmd)
+		defer cmdCtx.Cancel()
+
+		// Setup multiclient, which queries the device info of every client it adds
+		if err := cmdCtx.SetupMultiClient("save"); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup multiclient")
+			return
+		}
+		mc := cmdCtx.GetMultiClient()
+
+		// Subscribe before discovery starts, so that no device is missed
+		events := mc.Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{loggedEvents},
+		})
+		defer events.Unsubscribe()
+
+		// Setup discovery if enabled
+		cmdCtx.SetupDiscoveryClients()
+
+		// Start multiclient
+		cmdCtx.StartMultiClient()
+
+		// Saves run in the background so that events keep being handled
+		resultCh := make(chan client.Result)
+		sent := make(map[string]bool)
+		saveTo := func(addr string) {
+			if sent[addr] {
+				return
+			}
+			sent[addr] = true
+
+			go func() {
+				result := mc.SendWithRetryTo(cmdCtx.Context(), addr, req, policy)
+				select {
+				case resultCh <- result:
+				case <-cmdCtx.Context().Done():
+				}
+			}()
+		}
+
+		// Main command loop
+		cmdCtx.RunInGroup(func() error {
+			// Without discovery, we are done once all devices acknowledged the save
+			runOnce := !cmdCtx.Config.Discovery
+			clients := mc.Clients()
+			expected := len(clients)
+			if runOnce && expected == 0 {
+				return fmt.Errorf("no devices to save on, pass --addresses or --discover")
+			}
+			done, failed := 0, 0
+			// acknowledged saves of devices whose info is needed to record them in the catalog
+			updates := make(catalogUpdates)
+			var updatesTimeout <-chan time.Time
+
+			for addr := range clients {
+				saveTo(addr)
+			}
+
+			for {
+				if runOnce && done >= expected {
+					if len(updates) == 0 {
+						if failed > 0 {
+							return fmt.Errorf("%d device(s) did not acknowledge preset save", failed)
+						}
+						cmdCtx.Cancel()
+						return nil
+					}
+					if updatesTimeout == nil {
+						updatesTimeout = time.After(infoTimeout)
+					}
+				}
+
+				select {
+				case <-cmdCtx.Context().Done():
+					return cmdCtx.Context().Err()
+
+				case <-updatesTimeout:
+					updates.drop()
+
+				case result := <-resultCh:
+					done++
+					if logSaveResults(preset, name, []client.Result{result}) > 0 {
+						failed++
+						continue
+					}
+					if result.Broadcast {
+						continue
+					}
+					updates.apply(mc, result.Addr, func(key string) {
+						catalog.SetName(key, preset, name)
+						if err := catalog.Save(); err != nil {
+							log.Warn().Err(err).Str("catalog", catalog.Path()).Msg("Failed to save preset catalog")
+						}
+					})
+
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					logEvent(e)
+					switch ev := e.(type) {
+					case client.DeviceOnline:
+						// Send to devices added by discovery
+						saveTo(ev.Addr)
+					case client.DeviceInfoReceived:
+						updates.received(ev.Addr, ev.Info)
+					}
+				}
+			}
+		})
+
+		// Wait for completion
+		if err := cmdCtx.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			os.Exit(1)
+		}
+	},
+}
+
+// logSaveResults logs the outcome of a preset save for each device and returns the number of failures.
+func logSaveResults(preset int, name string, results []client.Result) int {
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			log.Error().Err(result.Err).
+				Str("addr", result.Addr).
+				Int("preset", preset).
+				Str("name", name).
+				Msg("preset save failed")
+		case result.Broadcast:
+			log.Info().
+				Str("addr", result.Addr).
+				Int("preset", preset).
+				Str("name", name).
+				Msg("preset save sent to broadcast address")
+		default:
+			log.Info().
+				Str("addr", result.Addr).
+				Int("preset", preset).
+				Str("name", name).
+				Msg("preset save acknowledged")
+		}
+	}
+	return failed
+}
+
+func init() {
+	rootCmd.AddCommand(saveCmd)
+
+	saveCmd.PersistentFlags().StringP(
+		"addresses", "a", "",
+		"Addresses to save on, comma separated",
+	)
+	saveCmd.PersistentFlags().BoolP(
+		"discover", "d", true,
+		"Send broadcast discovery messages",
+	)
+	saveCmd.PersistentFlags().StringArray(
+		"interfaces", []string{},
+		"Interfaces to use for discovery",
+	)
+	saveCmd.PersistentFlags().UintP(
+		"componentId", "c", 0xFF,
+		"Component ID to use for devices",
+	)
+	saveCmd.PersistentFlags().IntP(
+		"preset", "", 0,
+		"Preset slot to save into",
+	)
+	saveCmd.PersistentFlags().String(
+		"name", "",
+		"Name of the preset",
+	)
+	saveCmd.PersistentFlags().UintP(
+		"port", "p", 5001,
+		"Port to use",
+	)
+	saveCmd.PersistentFlags().Int(
+		"retries", client.DefaultRetryPolicy.MaxAttempts-1,
+		"Number of times to resend an unacknowledged save",
+	)
+	saveCmd.PersistentFlags().Duration(
+		"timeout", client.DefaultRetryPolicy.AttemptTimeout,
+		"Time to wait for an acknowledgement before resending",
+	)
+	saveCmd.PersistentFlags().Duration(
+		"info-timeout", client.Timeout,
+		"Time to wait for the device info, needed to record the name in the catalog",
+	)
+}
@@ -0,0 +1,259 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"ppa-control/lib"
+	"ppa-control/lib/client"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var setCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Set a parameter like output[1]/mute on one or multiple PPA servers",
+	Long: `Set a parameter addressed by a path like "input[0]/eq[2]/gain" or "output[1]/mute".
+
+The value is parsed according to the parameter: gain in dB, delay in ms,
+quality as a Q factor, eqType as a name like "bell", and mute, active and
+phaseInversion as booleans.
+
+The command is sent right away. Once a device reported its info, and if
+its model is registered with --models, commands for channels or EQ bands
+the model doesn't have are rejected. Commands to a broadcast address like
+255.255.255.255 are sent once, without waiting for acknowledgements.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathFlag, _ := cmd.PersistentFlags().GetString("path")
+		value, _ := cmd.PersistentFlags().GetString("value")
+		retries, _ := cmd.PersistentFlags().GetInt("retries")
+		timeout, _ := cmd.PersistentFlags().GetDuration("timeout")
+
+		path, err := protocol.ParsePath(pathFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid path")
+		}
+		req, err := newParameterRequest(path, value)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path.String()).Msg("Invalid value")
+		}
+
+		policy := client.DefaultRetryPolicy
+		policy.MaxAttempts = retries + 1
+		policy.AttemptTimeout = timeout
+
+		// Setup command context
+		cmdCtx := lib.SetupCommand(cmd)
+		defer cmdCtx.Cancel()
+
+		// Setup multiclient
+		if err := cmdCtx.SetupMultiClient("set"); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup multiclient")
+			return
+		}
+		mc := cmdCtx.GetMultiClient()
+
+		// Subscribe before discovery starts, so that no device is missed
+		events := mc.Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{loggedEvents},
+		})
+		defer events.Unsubscribe()
+
+		// Setup discovery if enabled
+		cmdCtx.SetupDiscoveryClients()
+
+		// Start multiclient
+		cmdCtx.StartMultiClient()
+
+		// Commands run in the background so that events keep being handled
+		resultCh := make(chan client.Result)
+		sent := make(map[string]bool)
+		sendTo := func(addr string) {
+			if sent[addr] {
+				return
+			}
+			sent[addr] = true
+
+			go func() {
+				result := mc.SendWithRetryTo(cmdCtx.Context(), addr, req, policy)
+				select {
+				case resultCh <- result:
+				case <-cmdCtx.Context().Done():
+				}
+			}()
+		}
+
+		// Main command loop
+		cmdCtx.RunInGroup(func() error {
+			// Without discovery, we are done once all devices acknowledged the command
+			runOnce := !cmdCtx.Config.Discovery
+			clients := mc.Clients()
+			expected := len(clients)
+			if runOnce && expected == 0 {
+				return fmt.Errorf("no devices to control, pass --addresses or --discover")
+			}
+			done, failed := 0, 0
+
+			for addr := range clients {
+				sendTo(addr)
+			}
+
+			for {
+				if runOnce && done >= expected {
+					if failed > 0 {
+						return fmt.Errorf("%d device(s) did not accept %s", failed, path)
+					}
+					cmdCtx.Cancel()
+					return nil
+				}
+
+				select {
+				case <-cmdCtx.Context().Done():
+					return cmdCtx.Context().Err()
+
+				case result := <-resultCh:
+					done++
+					switch {
+					case result.Err != nil:
+						failed++
+						log.Error().Err(result.Err).
+							Str("addr", result.Addr).
+							Str("path", path.String()).
+							Msg("set failed")
+					case result.Broadcast:
+						log.Info().
+							Str("addr", result.Addr).
+							Str("path", path.String()).
+							Str("value", value).
+							Msg("set sent to broadcast address")
+					default:
+						log.Info().
+							Str("addr", result.Addr).
+							Str("path", path.String()).
+							Str("value", value).
+							Msg("set acknowledged")
+					}
+
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					logEvent(e)
+					// Send to devices added by discovery
+					if ev, ok := e.(client.DeviceOnline); ok {
+						sendTo(ev.Addr)
+					}
+				}
+			}
+		})
+
+		// Wait for completion
+		if err := cmdCtx.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			os.Exit(1)
+		}
+	},
+}
+
+// newParameterRequest builds the live command setting the parameter addressed by path,
+// parsing value according to the LevelType of the parameter.
+func newParameterRequest(path protocol.Path, value string) (client.Request, error) {
+	parseFloat := func() (float32, error) {
+		v, err := strconv.ParseFloat(value, 32)
+		return float32(v), err
+	}
+
+	switch path.Leaf() {
+	case protocol.LevelTypeGain:
+		db, err := parseFloat()
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewGainRequest(path[:len(path)-1], db)
+	case protocol.LevelTypeDelay:
+		ms, err := parseFloat()
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewDelayRequest(path[:len(path)-1], ms)
+	case protocol.LevelTypeQuality:
+		q, err := parseFloat()
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewEqQualityRequest(path[:len(path)-1], q)
+	case protocol.LevelTypeEqType:
+		eqType, err := units.ParseEqType(value)
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewEqTypeRequest(path[:len(path)-1], eqType)
+	case protocol.LevelTypeMute:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewMuteRequest(path[:len(path)-1], b)
+	case protocol.LevelTypePhaseInversion:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewPhaseInversionRequest(path[:len(path)-1], b)
+	case protocol.LevelTypeActive:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return client.Request{}, err
+		}
+		return client.NewEqActiveRequest(path[:len(path)-1], b)
+	default:
+		return client.Request{}, fmt.Errorf("%s is not a parameter", path)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(setCmd)
+
+	setCmd.PersistentFlags().StringP(
+		"addresses", "a", "",
+		"Addresses to control, comma separated",
+	)
+	setCmd.PersistentFlags().BoolP(
+		"discover", "d", true,
+		"Send broadcast discovery messages",
+	)
+	setCmd.PersistentFlags().StringArray(
+		"interfaces", []string{},
+		"Interfaces to use for discovery",
+	)
+	setCmd.PersistentFlags().UintP(
+		"componentId", "c", 0xFF,
+		"Component ID to use for devices",
+	)
+	setCmd.PersistentFlags().UintP(
+		"port", "p", 5001,
+		"Port to use",
+	)
+	setCmd.PersistentFlags().String(
+		"path", "",
+		"Path of the parameter, like output[1]/mute or input[0]/eq[2]/gain",
+	)
+	setCmd.PersistentFlags().String(
+		"value", "",
+		"Value of the parameter",
+	)
+	setCmd.PersistentFlags().Int(
+		"retries", client.DefaultRetryPolicy.MaxAttempts-1,
+		"Number of times to resend an unacknowledged command",
+	)
+	setCmd.PersistentFlags().Duration(
+		"timeout", client.DefaultRetryPolicy.AttemptTimeout,
+		"Time to wait for an acknowledgement before resending",
+	)
+	_ = setCmd.MarkPersistentFlagRequired("path")
+	_ = setCmd.MarkPersistentFlagRequired("value")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
+	"ppa-control/lib/protocol"
 	"ppa-control/lib/simulation"
 )
 
@@ -15,6 +16,7 @@ var simulateCmd = &cobra.Command{
 		address, _ := cmd.PersistentFlags().GetString("address")
 		port, _ := cmd.PersistentFlags().GetUint("port")
 		interface_, _ := cmd.PersistentFlags().GetString("interface")
+		recallDelay, _ := cmd.PersistentFlags().GetDuration("recall-delay")
 		ctx := context.Background()
 		serverString := fmt.Sprintf("%s:%d", address, port)
 		fmt.Printf("Starting simulated PPA device on %s\n", serverString)
@@ -22,12 +24,17 @@ var simulateCmd = &cobra.Command{
 		grp, ctx := errgroup.WithContext(ctx)
 
 		settings := simulation.SimulatedDeviceSettings{
-			UniqueId:    [4]byte{0, 1, 2, 3},
-			ComponentId: 0xff,
-			Name:        "simulated",
-			Address:     address,
-			Port:        uint16(port),
-			Interface:   interface_,
+			UniqueId:        [4]byte{0, 1, 2, 3},
+			ComponentId:     0xff,
+			Name:            "simulated",
+			Address:         address,
+			Port:            uint16(port),
+			Interface:       interface_,
+			DeviceTypeId:    protocol.SimulatedDeviceTypeId,
+			FirmwareVersion: 0x01000000,
+			SerialNumber:    1,
+
+			PresetRecallDelay: recallDelay,
 		}
 		client := simulation.NewSimulatedDevice(settings)
 		grp.Go(func() error {
@@ -46,4 +53,5 @@ func init() {
 	simulateCmd.PersistentFlags().StringP("interface", "i", "", "Bind listener to interface")
 	simulateCmd.PersistentFlags().StringP("address", "a", "localhost", "AddrPort to listen on")
 	simulateCmd.PersistentFlags().UintP("port", "p", 5001, "Port to listen on")
+	simulateCmd.PersistentFlags().Duration("recall-delay", 0, "Answer preset recalls with a wait status and acknowledge them after this delay")
 }
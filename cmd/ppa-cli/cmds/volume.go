@@ -1,7 +1,11 @@
 package cmds
 
 import (
+	"context"
+	"errors"
+	"os"
 	"ppa-control/lib"
+	"ppa-control/lib/client"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -31,8 +35,14 @@ var volumeCmd = &cobra.Command{
 			return
 		}
 
+		// Subscribe before discovery starts, so that no device is missed
+		events := cmdCtx.GetMultiClient().Subscribe(client.SubscribeOptions{
+			Filters: []client.EventFilter{loggedEvents},
+		})
+		defer events.Unsubscribe()
+
 		// Setup discovery if enabled
-		cmdCtx.SetupDiscovery()
+		cmdCtx.SetupDiscoveryClients()
 
 		// Start multiclient
 		cmdCtx.StartMultiClient()
@@ -40,54 +50,50 @@ var volumeCmd = &cobra.Command{
 		// Main command loop
 		cmdCtx.RunInGroup(func() error {
 			// Send initial volume
-			cmdCtx.GetMultiClient().SendMasterVolume(volume)
+			if err := cmdCtx.GetMultiClient().SetMasterVolume(cmdCtx.Context(), volume); err != nil {
+				logSendError(err, "master volume")
+				if !loop {
+					return err
+				}
+			}
 
-			// If not looping, just wait for context cancellation
-			if !loop {
-				<-cmdCtx.Context().Done()
-				return cmdCtx.Context().Err()
+			// If not looping, only newly discovered clients get the volume
+			var loopCh <-chan time.Time
+			if loop {
+				ticker := time.NewTicker(5 * time.Second)
+				defer ticker.Stop()
+				loopCh = ticker.C
 			}
 
 			for {
-				t := time.NewTimer(5 * time.Second)
-
 				select {
 				case <-cmdCtx.Context().Done():
-					t.Stop()
 					return cmdCtx.Context().Err()
 
-				case <-t.C:
-					cmdCtx.GetMultiClient().SendMasterVolume(volume)
-
-				case msg := <-cmdCtx.Channels.ReceivedCh:
-					t.Stop()
-					if msg.Header != nil {
-						log.Info().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Str("type", msg.Header.MessageType.String()).
-							Str("status", msg.Header.Status.String()).
-							Msg("received message")
-					} else {
-						log.Debug().Str("from", msg.RemoteAddress.String()).
-							Str("pkg", msg.Client.Name()).
-							Msg("received unknown message")
+				case <-loopCh:
+					if err := cmdCtx.GetMultiClient().SetMasterVolume(cmdCtx.Context(), volume); err != nil {
+						logSendError(err, "master volume")
 					}
 
-				case msg := <-cmdCtx.Channels.DiscoveryCh:
-					t.Stop()
-					log.Debug().Str("addr", msg.GetAddress()).Msg("discovery message")
-					if newClient, err := cmdCtx.HandleDiscoveryMessage(msg); err != nil {
-						return err
-					} else if newClient != nil {
+				case e, ok := <-events.C:
+					if !ok {
+						return cmdCtx.Context().Err()
+					}
+					logEvent(e)
+					if online, ok := e.(client.DeviceOnline); ok {
 						// Send volume immediately to newly discovered client
-						newClient.SendMasterVolume(volume)
+						if err := online.Client.SetMasterVolume(cmdCtx.Context(), volume); err != nil {
+							logSendError(err, "master volume")
+						}
 					}
 				}
 			}
 		})
 
 		// Wait for completion
-		cmdCtx.Wait()
+		if err := cmdCtx.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			os.Exit(1)
+		}
 	},
 }
 
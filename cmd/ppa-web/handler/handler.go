@@ -2,10 +2,15 @@ package handler
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"ppa-control/cmd/ppa-web/templates"
 	"ppa-control/cmd/ppa-web/types"
+	"ppa-control/lib/client"
+	"ppa-control/lib/protocol"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -75,11 +80,48 @@ func (h *Handler) HandleRecall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	presetNum := r.FormValue("preset")
-	h.srv.LogPacket("Recalling preset %s", presetNum)
-	// TODO: Implement preset recall using the client
+	preset, err := strconv.Atoi(r.FormValue("preset"))
+	if err != nil {
+		http.Error(w, "Invalid preset", http.StatusBadRequest)
+		return
+	}
+
+	h.srv.LogPacket("Recalling preset %d", preset)
+	if err := h.srv.RecallPreset(r.Context(), preset); err != nil {
+		h.reportError("Failed to recall preset", err)
+	}
+
+	err = templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleSave handles preset save requests
+func (h *Handler) HandleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.srv.IsConnected() {
+		http.Error(w, "Not connected to device", http.StatusBadRequest)
+		return
+	}
+
+	preset, err := strconv.Atoi(r.FormValue("preset"))
+	if err != nil {
+		http.Error(w, "Invalid preset", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
 
-	err := templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
+	h.srv.LogPacket("Saving preset %d as %q", preset+1, name)
+	if err := h.srv.SavePreset(r.Context(), preset, name); err != nil {
+		h.reportError("Failed to save preset", err)
+	}
+
+	err = templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -97,16 +139,74 @@ func (h *Handler) HandleVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	volume := r.FormValue("volume")
-	h.srv.LogPacket("Setting volume to %s", volume)
-	// TODO: Implement volume control using the client
+	// The volume slider goes from 0 to 100
+	volume, err := strconv.ParseFloat(r.FormValue("volume"), 32)
+	if err != nil {
+		http.Error(w, "Invalid volume", http.StatusBadRequest)
+		return
+	}
+
+	h.srv.LogPacket("Setting volume to %.0f", volume)
+	if err := h.srv.SetMasterVolume(r.Context(), float32(volume/100)); err != nil {
+		h.reportError("Failed to set volume", err)
+	}
+
+	err = templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleMute handles mute toggles of the channel strips
+func (h *Handler) HandleMute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.srv.IsConnected() {
+		http.Error(w, "Not connected to device", http.StatusBadRequest)
+		return
+	}
+
+	addr := r.FormValue("addr")
+	channel, err := protocol.ParsePath(r.FormValue("channel"))
+	if err != nil {
+		http.Error(w, "Invalid channel", http.StatusBadRequest)
+		return
+	}
+	muted, err := strconv.ParseBool(r.FormValue("muted"))
+	if err != nil {
+		http.Error(w, "Invalid muted value", http.StatusBadRequest)
+		return
+	}
+
+	h.srv.LogPacket("Setting %s mute to %t on %s", channel, muted, addr)
+	if err := h.srv.SetMute(r.Context(), addr, channel, muted); err != nil {
+		h.reportError("Failed to set mute", err)
+	}
 
-	err := templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
+	err = templates.LogWindow(h.srv.GetState()).Render(r.Context(), w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// reportError shows a failed command in the log window and the status bar
+func (h *Handler) reportError(what string, err error) {
+	var devicesErr *client.ErrDevicesFailed
+	if errors.As(err, &devicesErr) {
+		for addr, deviceErr := range devicesErr.Errors {
+			h.srv.LogPacket("%s on %s: %v", what, addr, deviceErr)
+		}
+	} else {
+		h.srv.LogPacket("%s: %v", what, err)
+	}
+	h.srv.SetState(func(state *types.AppState) {
+		state.Status = "Error: " + err.Error()
+	})
+}
+
 // HandleStartDiscovery handles starting the discovery process
 func (h *Handler) HandleStartDiscovery(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -114,6 +214,15 @@ func (h *Handler) HandleStartDiscovery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the form of the stopped discovery section sets the ranges to sweep
+	scan := r.FormValue("scan")
+	if r.Form.Has("scan") {
+		if err := h.srv.SetScanRanges(strings.Split(scan, ",")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	if err := h.srv.StartDiscovery(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
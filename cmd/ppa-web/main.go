@@ -8,6 +8,7 @@ import (
 	"ppa-control/cmd/ppa-web/handler"
 	"ppa-control/cmd/ppa-web/router"
 	"ppa-control/cmd/ppa-web/server"
+	"ppa-control/lib/client/discovery"
 	"runtime/debug"
 	"time"
 
@@ -31,6 +32,14 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("discover", "d", false, "Enable device discovery")
 	rootCmd.PersistentFlags().StringArray("interfaces", []string{}, "Interfaces to use for discovery")
 	rootCmd.PersistentFlags().UintP("port", "p", 5001, "Port to use for device communication")
+	rootCmd.PersistentFlags().Duration("ping-interval", discovery.DefaultOptions.PingInterval, "Time between discovery pings")
+	rootCmd.PersistentFlags().Duration("peer-timeout", discovery.DefaultOptions.PeerTimeout, "Time after which a device that didn't answer discovery pings is lost")
+	rootCmd.PersistentFlags().Duration("rescan-interval", discovery.DefaultOptions.InterfaceRescanInterval, "Time between scans for added or removed network interfaces, where they are not monitored")
+	rootCmd.PersistentFlags().Int("burst-pings", discovery.DefaultOptions.InitialBurstPings, "Number of discovery pings sent on a newly added interface")
+	rootCmd.PersistentFlags().StringSlice("scan", nil, "CIDR ranges swept with unicast discovery pings for devices in routed networks, like 10.20.0.0/24, implies discovery")
+	rootCmd.PersistentFlags().String("broadcast", discovery.DefaultOptions.Broadcast.String(), "Discovery broadcast addresses: directed (per IPv4 network of the interface), limited (255.255.255.255) or both")
+	rootCmd.PersistentFlags().String("catalog", "", "Preset catalog file (default is presets.json in the user config directory)")
+	rootCmd.PersistentFlags().String("models", "", "Device model file, a JSON list of models commands are checked against")
 }
 
 type statusResponseWriter struct {
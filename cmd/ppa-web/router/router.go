@@ -19,7 +19,9 @@ func NewRouter(h *handler.Handler) *mux.Router {
 	r.HandleFunc("/status", h.HandleStatus).Methods(http.MethodGet)
 	r.HandleFunc("/set-ip", h.HandleSetIP).Methods(http.MethodPost)
 	r.HandleFunc("/recall", h.HandleRecall).Methods(http.MethodPost)
+	r.HandleFunc("/save", h.HandleSave).Methods(http.MethodPost)
 	r.HandleFunc("/volume", h.HandleVolume).Methods(http.MethodPost)
+	r.HandleFunc("/mute", h.HandleMute).Methods(http.MethodPost)
 
 	// Discovery routes
 	r.HandleFunc("/discovery/start", h.HandleStartDiscovery).Methods(http.MethodPost)
@@ -5,13 +5,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"ppa-control/cmd/ppa-web/types"
 	"ppa-control/lib"
 	"ppa-control/lib/client"
 	"ppa-control/lib/client/discovery"
+	"ppa-control/lib/presets"
+	"ppa-control/lib/protocol"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -20,21 +26,21 @@ type Server struct {
 	state           types.AppState
 	mu              sync.RWMutex
 	cmdCtx          *lib.CommandContext
-	receiveCh       chan client.ReceivedMessage
 	discoveryCtx    context.Context
 	discoveryCancel context.CancelFunc
 	updateListeners []chan struct{}
+	catalog         *presets.Catalog
 }
 
 // NewServer creates a new server instance for direct use
 func NewServer() *Server {
 	cmdCtx := &lib.CommandContext{
 		Config: &lib.CommandConfig{
-			ComponentID: 0xFF,
-			Port:        5001,
+			ComponentID:      0xFF,
+			Port:             5001,
+			DiscoveryOptions: discovery.DefaultOptions,
 		},
 		Channels: &lib.CommandChannels{
-			ReceivedCh:  make(chan client.ReceivedMessage),
 			DiscoveryCh: make(chan discovery.PeerInformation),
 		},
 	}
@@ -46,38 +52,65 @@ func NewServer() *Server {
 
 	return &Server{
 		state: types.AppState{
-			DestIP:            "",
-			Log:               make([]string, 0),
-			Status:            "Disconnected",
-			DiscoveryEnabled:  false,
-			DiscoveredDevices: make(map[string]types.DeviceInfo),
-			ActiveInterfaces:  make(map[string]bool),
+			DestIP:             "",
+			Log:                make([]string, 0),
+			Status:             "Disconnected",
+			DiscoveryEnabled:   false,
+			DiscoveredDevices:  make(map[string]types.DeviceInfo),
+			ActiveInterfaces:   make(map[string]bool),
+			Devices:            make(map[string]client.DeviceState),
+			Presets:            make(map[int]presets.Preset),
+			LastRecalledPreset: -1,
 		},
 		cmdCtx:          cmdCtx,
-		receiveCh:       cmdCtx.Channels.ReceivedCh,
 		updateListeners: make([]chan struct{}, 0),
+		catalog:         loadCatalog(""),
 	}
 }
 
 // FromCobraCommand creates a new server instance from a cobra command
 func FromCobraCommand(cmd *cobra.Command) *Server {
 	cmdCtx := lib.SetupCommand(cmd)
+	catalogPath, _ := cmd.Flags().GetString("catalog")
 
 	return &Server{
 		state: types.AppState{
-			DestIP:            "",
-			Log:               make([]string, 0),
-			Status:            "Disconnected",
-			DiscoveryEnabled:  false,
-			DiscoveredDevices: make(map[string]types.DeviceInfo),
-			ActiveInterfaces:  make(map[string]bool),
+			DestIP:             "",
+			Log:                make([]string, 0),
+			Status:             "Disconnected",
+			DiscoveryEnabled:   false,
+			DiscoveredDevices:  make(map[string]types.DeviceInfo),
+			ActiveInterfaces:   make(map[string]bool),
+			Devices:            make(map[string]client.DeviceState),
+			Presets:            make(map[int]presets.Preset),
+			LastRecalledPreset: -1,
+			ScanRanges:         formatScanRanges(cmdCtx.Config.DiscoveryOptions.ScanRanges),
 		},
 		cmdCtx:          cmdCtx,
-		receiveCh:       cmdCtx.Channels.ReceivedCh,
 		updateListeners: make([]chan struct{}, 0),
+		catalog:         loadCatalog(catalogPath),
 	}
 }
 
+// loadCatalog loads the preset catalog at path, defaulting to presets.DefaultPath.
+// If it can't be loaded, an empty catalog is used, so that the web interface keeps working.
+func loadCatalog(path string) *presets.Catalog {
+	if path == "" {
+		var err error
+		path, err = presets.DefaultPath()
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to find preset catalog, using the working directory")
+			path = "presets.json"
+		}
+	}
+	catalog, err := presets.Load(path)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load preset catalog, starting with an empty one")
+		return presets.NewCatalog(path)
+	}
+	return catalog
+}
+
 // AddUpdateListener adds a channel to notify about state updates
 func (s *Server) AddUpdateListener(ch chan struct{}) {
 	s.mu.Lock()
@@ -154,6 +187,32 @@ func (s *Server) StopDiscovery() error {
 	return nil
 }
 
+// SetScanRanges sets the CIDR ranges swept by the discovery started next,
+// see discovery.ParseScanRanges
+func (s *Server) SetScanRanges(ranges []string) error {
+	if s.discoveryCtx != nil {
+		return fmt.Errorf("discovery already running")
+	}
+	prefixes, err := discovery.ParseScanRanges(ranges)
+	if err != nil {
+		return err
+	}
+
+	s.cmdCtx.Config.DiscoveryOptions.ScanRanges = prefixes
+	s.SetState(func(state *types.AppState) {
+		state.ScanRanges = formatScanRanges(prefixes)
+	})
+	return nil
+}
+
+func formatScanRanges(prefixes []netip.Prefix) string {
+	ranges := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		ranges[i] = p.String()
+	}
+	return strings.Join(ranges, ", ")
+}
+
 // runDiscoveryLoop runs the discovery message processing loop
 func (s *Server) runDiscoveryLoop() error {
 	for {
@@ -169,34 +228,39 @@ func (s *Server) runDiscoveryLoop() error {
 // handleDiscoveryMessage processes discovery messages
 func (s *Server) handleDiscoveryMessage(msg discovery.PeerInformation) {
 	var logMsg string
-	var addr string
-	var iface string
 
 	// First handle the message and prepare logging info
+	p := msg.GetPeer()
+	addr := p.Addr
 	switch m := msg.(type) {
 	case discovery.PeerDiscovered:
-		addr = m.GetAddress()
-		iface = m.GetInterface()
-		logMsg = fmt.Sprintf("Device discovered: %s on %s", addr, iface)
+		logMsg = fmt.Sprintf("Device discovered: %s on %s", peerLabel(p), p.Interface)
 	case discovery.PeerLost:
-		addr = m.GetAddress()
-		iface = m.GetInterface()
-		logMsg = fmt.Sprintf("Device lost: %s on %s", addr, iface)
+		logMsg = fmt.Sprintf("Device lost: %s on %s", peerLabel(p), p.Interface)
+	case discovery.PeerUpdated:
+		logMsg = fmt.Sprintf("Device updated: %s on %s", peerLabel(p), p.Interface)
+	case discovery.PeerMoved:
+		logMsg = fmt.Sprintf("Device moved: %s from %s on %s", peerLabel(p), m.GetPreviousAddress(), p.Interface)
+
+		// keep the connection to the device if it is the connected one
+		if mc := s.cmdCtx.GetMultiClient(); mc != nil && mc.DoesClientExist(m.GetPreviousAddress()) {
+			if err := mc.MoveClient(m.GetPreviousAddress(), addr); err != nil {
+				logMsg = fmt.Sprintf("%s, failed to move connection: %v", logMsg, err)
+			}
+		}
 	}
 
 	// Now update state with a single lock
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	switch msg.(type) {
-	case discovery.PeerDiscovered:
-		s.state.DiscoveredDevices[addr] = types.DeviceInfo{
-			Address:   addr,
-			Interface: iface,
-			LastSeen:  time.Now(),
-		}
+	switch m := msg.(type) {
+	case discovery.PeerDiscovered, discovery.PeerUpdated:
+		s.state.DiscoveredDevices[addr] = discoveredDevice(p)
 	case discovery.PeerLost:
 		delete(s.state.DiscoveredDevices, addr)
+	case discovery.PeerMoved:
+		delete(s.state.DiscoveredDevices, m.GetPreviousAddress())
+		s.state.DiscoveredDevices[addr] = discoveredDevice(p)
 	}
 
 	// Add log message while we still have the lock
@@ -222,6 +286,33 @@ func (s *Server) handleDiscoveryMessage(msg discovery.PeerInformation) {
 	}
 }
 
+// peerLabel returns the name and address of a peer, or only its address while its name is unknown
+func peerLabel(p discovery.Peer) string {
+	if p.Name() == p.Addr {
+		return p.Addr
+	}
+	return fmt.Sprintf("%s (%s)", p.Name(), p.Addr)
+}
+
+// discoveredDevice converts a discovered peer to the DeviceInfo shown in the discovery table
+func discoveredDevice(p discovery.Peer) types.DeviceInfo {
+	info := types.DeviceInfo{
+		Address:     p.Addr,
+		Interface:   p.Interface,
+		Name:        p.Name(),
+		ComponentID: p.ComponentID,
+		FirstSeen:   p.FirstSeen,
+		LastSeen:    p.LastSeen,
+	}
+	if !p.DeviceID.IsZero() {
+		info.DeviceID = p.DeviceID.String()
+	}
+	if p.LocalIP.IsValid() {
+		info.LocalIP = p.LocalIP.String()
+	}
+	return info
+}
+
 // LogPacket logs a formatted message to the state log
 func (s *Server) LogPacket(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
@@ -293,15 +384,32 @@ func (s *Server) ConnectToDevice(addr string) error {
 	// Start the client run loop
 	s.cmdCtx.StartMultiClient()
 
+	events := s.cmdCtx.GetMultiClient().Subscribe(client.SubscribeOptions{
+		Filters: []client.EventFilter{
+			client.FilterTypes(client.EventMessageReceived, client.EventStateChanged, client.EventDeviceMoved),
+		},
+	})
+	s.SetState(func(state *types.AppState) {
+		state.Devices = make(map[string]client.DeviceState)
+		state.Presets = make(map[int]presets.Preset)
+		state.LastRecalledPreset = -1
+	})
+
 	// Start the ping loop
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
+		defer events.Unsubscribe()
 
 		for {
 			select {
 			case <-s.cmdCtx.Context().Done():
 				return
+			case e, ok := <-events.C:
+				if !ok {
+					return
+				}
+				s.handleEvent(e)
 			case <-ticker.C:
 				c.SendPing()
 				// Create packet info outside any locks
@@ -316,30 +424,6 @@ func (s *Server) ConnectToDevice(addr string) error {
 					},
 				}
 				s.LogPacketDetails(pingPacket)
-			case msg := <-s.receiveCh:
-				if msg.Header != nil {
-					// Create packet info before any state changes
-					packet := types.PacketInfo{
-						Timestamp:   time.Now().Format(time.RFC3339Nano),
-						Direction:   "Device → Client",
-						Source:      msg.RemoteAddress.String(),
-						Destination: "Web Client",
-						Header:      msg.Header.ToMap(),
-					}
-
-					if msg.Data != nil {
-						packet.Payload = msg.Data
-						packet.HexDump = hex.Dump(msg.Data)
-					}
-
-					// Update state first
-					s.SetState(func(state *types.AppState) {
-						state.Status = "Connected"
-					})
-
-					// Then log packet details
-					s.LogPacketDetails(packet)
-				}
 			}
 		}
 	}()
@@ -347,7 +431,160 @@ func (s *Server) ConnectToDevice(addr string) error {
 	return nil
 }
 
+// handleEvent updates the state from an event of the connected devices
+func (s *Server) handleEvent(e client.Event) {
+	switch ev := e.(type) {
+	case client.MessageReceived:
+		msg := ev.Message
+		// Create packet info before any state changes
+		packet := types.PacketInfo{
+			Timestamp:   time.Now().Format(time.RFC3339Nano),
+			Direction:   "Device → Client",
+			Source:      msg.RemoteAddress.String(),
+			Destination: "Web Client",
+			Header:      msg.Header.ToMap(),
+		}
+
+		if msg.Data != nil {
+			packet.Payload = msg.Data
+			packet.HexDump = hex.Dump(msg.Data)
+		}
+		if msg.Body != nil {
+			packet.Body = msg.Body
+		}
+
+		// Update state first
+		s.SetState(func(state *types.AppState) {
+			state.Status = "Connected"
+		})
+
+		// Then log packet details
+		s.LogPacketDetails(packet)
+
+	case client.StateChanged:
+		s.SetState(func(state *types.AppState) {
+			// copy the map, as snapshots returned by GetState share it
+			devices := make(map[string]client.DeviceState, len(state.Devices)+1)
+			for addr, d := range state.Devices {
+				devices[addr] = d
+			}
+			devices[ev.State.Addr] = ev.State
+			state.Devices = devices
+			s.applyCatalog(state)
+		})
+
+	case client.DeviceMoved:
+		s.SetState(func(state *types.AppState) {
+			devices := make(map[string]client.DeviceState, len(state.Devices))
+			for addr, d := range state.Devices {
+				if addr != ev.From {
+					devices[addr] = d
+				}
+			}
+			state.Devices = devices
+		})
+	}
+}
+
+// applyCatalog fills in the preset catalog entries of the connected devices.
+// For presets named differently on several devices, the device with the lowest address wins.
+func (s *Server) applyCatalog(state *types.AppState) {
+	addrs := make([]string, 0, len(state.Devices))
+	for addr := range state.Devices {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	entries := make(map[int]presets.Preset)
+	state.LastRecalledPreset = -1
+	var lastRecalled time.Time
+	for _, addr := range addrs {
+		device := state.Devices[addr]
+		if !device.HasDeviceData {
+			continue
+		}
+		key := presets.DeviceKey(device.DeviceInfo)
+		for _, p := range s.catalog.Presets(key) {
+			if _, ok := entries[p.Index]; !ok {
+				entries[p.Index] = p
+			}
+		}
+		if p, ok := s.catalog.LastRecalled(key); ok && p.LastRecalled.After(lastRecalled) {
+			lastRecalled = p.LastRecalled
+			state.LastRecalledPreset = p.Index
+		}
+	}
+	state.Presets = entries
+}
+
+// updateCatalog applies f to the catalog key of each connected device whose info is known,
+// saves the catalog and refreshes the state.
+func (s *Server) updateCatalog(f func(key string)) {
+	for _, device := range s.GetState().Devices {
+		if device.HasDeviceData {
+			f(presets.DeviceKey(device.DeviceInfo))
+		}
+	}
+	if err := s.catalog.Save(); err != nil {
+		s.LogPacket("Failed to save preset catalog: %v", err)
+	}
+	s.SetState(s.applyCatalog)
+}
+
 // IsConnected returns true if the server is connected to a device
 func (s *Server) IsConnected() bool {
 	return s.cmdCtx.GetMultiClient() != nil
 }
+
+// RecallPreset recalls the preset on the connected devices
+func (s *Server) RecallPreset(ctx context.Context, preset int) error {
+	mc := s.cmdCtx.GetMultiClient()
+	if mc == nil {
+		return fmt.Errorf("not connected to device")
+	}
+	if err := mc.RecallPreset(ctx, preset); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.updateCatalog(func(key string) {
+		s.catalog.MarkRecalled(key, preset, now)
+	})
+	return nil
+}
+
+// SavePreset saves the current settings of the connected devices as preset, named name
+func (s *Server) SavePreset(ctx context.Context, preset int, name string) error {
+	mc := s.cmdCtx.GetMultiClient()
+	if mc == nil {
+		return fmt.Errorf("not connected to device")
+	}
+	if err := mc.SavePreset(ctx, preset, name); err != nil {
+		return err
+	}
+	s.updateCatalog(func(key string) {
+		s.catalog.SetName(key, preset, name)
+	})
+	return nil
+}
+
+// SetMasterVolume sets the master volume of the connected devices, from 0 to 1
+func (s *Server) SetMasterVolume(ctx context.Context, volume float32) error {
+	mc := s.cmdCtx.GetMultiClient()
+	if mc == nil {
+		return fmt.Errorf("not connected to device")
+	}
+	return mc.SetMasterVolume(ctx, volume)
+}
+
+// SetMute mutes or unmutes an input or output of the connected device at addr
+func (s *Server) SetMute(ctx context.Context, addr string, channel protocol.Path, muted bool) error {
+	mc := s.cmdCtx.GetMultiClient()
+	if mc == nil {
+		return fmt.Errorf("not connected to device")
+	}
+	c, ok := mc.Client(addr)
+	if !ok {
+		return fmt.Errorf("unknown device %s", addr)
+	}
+	return c.SetMute(ctx, channel, muted)
+}
@@ -1,6 +1,12 @@
 package types
 
-import "time"
+import (
+	"context"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
+	"ppa-control/lib/protocol"
+	"time"
+)
 
 // AppState represents the application state
 type AppState struct {
@@ -10,11 +16,27 @@ type AppState struct {
 	DiscoveryEnabled  bool
 	DiscoveredDevices map[string]DeviceInfo
 	ActiveInterfaces  map[string]bool
+	// Devices holds the last known state of each connected device, by address
+	Devices map[string]client.DeviceState
+	// Presets holds the preset catalog entries of the connected devices, by preset index
+	Presets map[int]presets.Preset
+	// LastRecalledPreset is the index of the preset recalled last on the connected devices, -1 if unknown
+	LastRecalledPreset int
+	// ScanRanges are the comma separated CIDR ranges swept by the discovery
+	ScanRanges string
 }
 
+// DeviceInfo is a device found by the discovery
 type DeviceInfo struct {
 	Address   string
 	Interface string
+	// Name is the device name, or the address until the device reported its DeviceData
+	Name        string
+	DeviceID    string
+	ComponentID uint8
+	// LocalIP is the address of the interface the device answered on, empty if unknown
+	LocalIP   string
+	FirstSeen time.Time
 	LastSeen  time.Time
 }
 
@@ -24,8 +46,13 @@ type ServerInterface interface {
 	SetState(func(*AppState))
 	StartDiscovery() error
 	StopDiscovery() error
+	SetScanRanges(ranges []string) error
 	ConnectToDevice(addr string) error
 	IsConnected() bool
+	RecallPreset(ctx context.Context, preset int) error
+	SavePreset(ctx context.Context, preset int, name string) error
+	SetMasterVolume(ctx context.Context, volume float32) error
+	SetMute(ctx context.Context, addr string, channel protocol.Path, muted bool) error
 	LogPacket(format string, args ...interface{})
 	LogPacketDetails(packet PacketInfo)
 	AddUpdateListener(ch chan struct{})
@@ -40,4 +67,6 @@ type PacketInfo struct {
 	Header      map[string]interface{}
 	Payload     []byte
 	HexDump     string
+	// Body is the decoded payload of received messages, if any
+	Body interface{}
 }
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -17,6 +18,7 @@ import (
 	"ppa-control/lib/client"
 	"ppa-control/lib/client/discovery"
 	logger "ppa-control/lib/log"
+	"ppa-control/lib/presets"
 	"syscall"
 	"time"
 )
@@ -25,6 +27,7 @@ type App struct {
 	Config      *AppConfig
 	LogsDir     string
 	MultiClient *client.MultiClient
+	Catalog     *presets.Catalog
 	ui          *UI
 }
 
@@ -146,7 +149,6 @@ func (a *App) Run() {
 
 	grp, ctx2 := errgroup.WithContext(ctx)
 
-	receivedCh := make(chan client.ReceivedMessage)
 	discoveryCh := make(chan discovery.PeerInformation)
 
 	if a.Config.SaveConfig {
@@ -160,6 +162,8 @@ func (a *App) Run() {
 		}
 	}
 
+	a.loadCatalog()
+
 	a.MultiClient = client.NewMultiClient("ui")
 	for _, addr := range a.Config.Addresses {
 		if addr == "" {
@@ -173,8 +177,12 @@ func (a *App) Run() {
 	}
 
 	if a.Config.Discover {
+		// every peer gets a client, the MultiClient queries its DeviceData and shares its sockets
+		opts := a.Config.DiscoveryOptions()
+		opts.SkipDeviceData = true
+		opts.Transports = a.MultiClient.Transports()
 		grp.Go(func() error {
-			return discovery.Discover(ctx, discoveryCh, a.Config.Addresses, uint16(a.Config.Port))
+			return discovery.DiscoverWithOptions(ctx2, discoveryCh, a.Config.Addresses, uint16(a.Config.Port), opts)
 		})
 	}
 
@@ -184,55 +192,104 @@ func (a *App) Run() {
 	ui_.Log("ppa-control started, waiting for devices...")
 
 	grp.Go(func() error {
-		return a.MultiClient.Run(ctx2, &receivedCh)
+		return a.MultiClient.Run(ctx2, nil)
 	})
 
 	grp.Go(func() error {
 		return bucheron.CancelOnSignal(ctx, syscall.SIGINT, cancel)
 	})
 
-	// This is the peer handling
+	events := a.MultiClient.Subscribe(client.SubscribeOptions{
+		Buffer: 64,
+		Filters: []client.EventFilter{
+			client.FilterTypes(
+				client.EventDeviceOnline,
+				client.EventDeviceInfoReceived,
+				client.EventMessageReceived,
+				client.EventStateChanged,
+				client.EventUnknownPacket,
+			),
+		},
+	})
 	grp.Go(func() error {
+		defer events.Unsubscribe()
 		for {
 			select {
 			case <-ctx2.Done():
 				return ctx2.Err()
-			case msg := <-receivedCh:
-				if msg.Header != nil {
-					log.Info().Str("from", msg.RemoteAddress.String()).
-						Str("type", msg.Header.MessageType.String()).
-						Str("pkg", msg.Client.Name()).
-						Str("status", msg.Header.Status.String()).
+			case e, ok := <-events.C:
+				if !ok {
+					return ctx2.Err()
+				}
+				switch ev := e.(type) {
+				case client.DeviceOnline:
+					// send immediate ping
+					ev.Client.SendPing()
+				case client.DeviceInfoReceived:
+					ui_.Log(fmt.Sprintf("Peer %s is %s", ev.Addr, ev.Info.Name))
+				case client.MessageReceived:
+					log.Info().Str("from", ev.Message.RemoteAddress.String()).
+						Str("type", ev.Message.Header.MessageType.String()).
+						Str("pkg", ev.Message.Client.Name()).
+						Str("status", ev.Message.Header.Status.String()).
 						Msg("received message")
-				} else {
+				case client.UnknownPacket:
 					log.Debug().
-						Str("from", msg.RemoteAddress.String()).
-						Str("pkg", msg.Client.Name()).
+						Str("from", ev.RemoteAddress.String()).
+						Str("pkg", ev.Addr).
 						Msg("received unknown message")
+				case client.StateChanged:
+					ui_.SetDeviceStates(a.MultiClient.DeviceStates())
+					a.refreshPresets()
 				}
+			}
+		}
+	})
+
+	// This is the peer handling
+	grp.Go(func() error {
+		for {
+			select {
+			case <-ctx2.Done():
+				return ctx2.Err()
 			case msg := <-discoveryCh:
 				log.Debug().Str("addr", msg.GetAddress()).Msg("discovery message")
-				switch msg.(type) {
+				switch m := msg.(type) {
 				case discovery.PeerDiscovered:
 					log.Info().
 						Str("addr", msg.GetAddress()).
 						Str("iface", msg.GetInterface()).
 						Msg("peer discovered")
-					ui_.Log("Peer discovered: " + msg.GetAddress())
-					c, err := a.MultiClient.AddClient(ctx, msg.GetAddress(), msg.GetInterface(), a.Config.ComponentId)
+					ui_.Log(fmt.Sprintf("Peer discovered: %s on %s", m.Name(), msg.GetInterface()))
+					_, err := a.MultiClient.AddClient(ctx, msg.GetAddress(), msg.GetInterface(), a.Config.ComponentId)
 					if err != nil {
 						log.Error().Err(err).Msg("failed to add pkg")
 						cancel()
 						return err
 					}
-					// send immediate ping
-					c.SendPing()
+				case discovery.PeerMoved:
+					log.Info().
+						Str("addr", msg.GetAddress()).
+						Str("previousAddr", m.GetPreviousAddress()).
+						Str("iface", msg.GetInterface()).
+						Msg("peer moved")
+					ui_.Log(fmt.Sprintf("Peer moved: %s %s -> %s", m.Name(), m.GetPreviousAddress(), msg.GetAddress()))
+					err := a.MultiClient.MoveClient(m.GetPreviousAddress(), msg.GetAddress())
+					var notFound *client.ErrClientNotFound
+					if errors.As(err, &notFound) {
+						_, err = a.MultiClient.AddClient(ctx, msg.GetAddress(), msg.GetInterface(), a.Config.ComponentId)
+					}
+					if err != nil {
+						log.Error().Err(err).Msg("failed to move pkg")
+						cancel()
+						return err
+					}
 				case discovery.PeerLost:
 					log.Info().
 						Str("addr", msg.GetAddress()).
 						Str("iface", msg.GetInterface()).
 						Msg("peer lost")
-					ui_.Log("Peer lost: " + msg.GetAddress())
+					ui_.Log(fmt.Sprintf("Peer lost: %s", m.Name()))
 					err := a.MultiClient.CancelClient(msg.GetAddress())
 					if err != nil {
 						log.Error().Err(err).Msg("failed to remove pkg")
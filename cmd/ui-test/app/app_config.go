@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"path"
+	"ppa-control/lib/client/discovery"
+	"time"
 )
 
 const DEFAULT_COMPONENT_ID = 0xFF
@@ -40,6 +42,12 @@ type AppConfig struct {
 	Discover    bool     `json:"discover"`
 	Port        uint     `json:"port"`
 	Interfaces  []string `json:"interfaces"`
+	// PingInterval and PeerTimeout are durations like "10s", empty for the discovery defaults.
+	// Tablets running on battery can ping less often.
+	PingInterval string `json:"pingInterval,omitempty"`
+	PeerTimeout  string `json:"peerTimeout,omitempty"`
+	// Broadcast is "directed", "limited" or "both", empty for the discovery default
+	Broadcast string `json:"broadcast,omitempty"`
 
 	SaveConfig bool `json:"-"`
 
@@ -114,6 +122,9 @@ func AddAppConfigFlags(cmd *cobra.Command) {
 		"Component ID to use for devices")
 
 	cmd.PersistentFlags().UintP("port", "p", defaultConfig.Port, "Port to ping on")
+	cmd.PersistentFlags().String("ping-interval", defaultConfig.PingInterval, "Time between discovery pings, like 10s")
+	cmd.PersistentFlags().String("peer-timeout", defaultConfig.PeerTimeout, "Time after which a device that didn't answer discovery pings is lost, like 1m")
+	cmd.PersistentFlags().String("broadcast", defaultConfig.Broadcast, "Discovery broadcast addresses: directed, limited or both")
 
 	cmd.PersistentFlags().String(
 		"api",
@@ -166,6 +177,9 @@ func NewAppConfigFromCommand(cmd *cobra.Command) *AppConfig {
 	discover, _ := cmd.Flags().GetBool("discover")
 	port, _ := cmd.Flags().GetUint("port")
 	interfaces, _ := cmd.Flags().GetStringArray("interfaces")
+	pingInterval, _ := cmd.Flags().GetString("ping-interval")
+	peerTimeout, _ := cmd.Flags().GetString("peer-timeout")
+	broadcast, _ := cmd.Flags().GetString("broadcast")
 
 	saveConfig, _ := cmd.Flags().GetBool("save-config")
 
@@ -177,7 +191,38 @@ func NewAppConfigFromCommand(cmd *cobra.Command) *AppConfig {
 	config.Discover = discover
 	config.Port = port
 	config.Interfaces = interfaces
+	config.PingInterval = pingInterval
+	config.PeerTimeout = peerTimeout
+	config.Broadcast = broadcast
 	config.SaveConfig = saveConfig
 
 	return config
 }
+
+// DiscoveryOptions returns the discovery options of the config, using the defaults
+// for empty or invalid values.
+func (ac *AppConfig) DiscoveryOptions() discovery.Options {
+	opts := discovery.DefaultOptions
+	parse := func(name string, value string, d *time.Duration) {
+		if value == "" {
+			return
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			log.Error().Err(err).Str(name, value).Msg("Invalid duration, using the default")
+			return
+		}
+		*d = v
+	}
+	parse("pingInterval", ac.PingInterval, &opts.PingInterval)
+	parse("peerTimeout", ac.PeerTimeout, &opts.PeerTimeout)
+	if ac.Broadcast != "" {
+		mode, err := discovery.ParseBroadcastMode(ac.Broadcast)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid broadcast mode, using the default")
+		} else {
+			opts.Broadcast = mode
+		}
+	}
+	return opts
+}
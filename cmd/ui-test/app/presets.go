@@ -0,0 +1,74 @@
+package app
+
+import (
+	"github.com/rs/zerolog/log"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
+	"sort"
+	"time"
+)
+
+// loadCatalog loads the preset catalog shared with ppa-cli and ppa-web.
+// If it can't be loaded, an empty catalog is used.
+func (a *App) loadCatalog() {
+	path, err := presets.DefaultPath()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find preset catalog")
+		path = "presets.json"
+	}
+	a.Catalog, err = presets.Load(path)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to load preset catalog")
+		a.Catalog = presets.NewCatalog(path)
+	}
+}
+
+// markRecalled records the recall of preset in the catalog of each device whose info is known
+func (a *App) markRecalled(preset int) {
+	now := time.Now()
+	for _, s := range a.MultiClient.DeviceStates() {
+		if s.HasDeviceData {
+			a.Catalog.MarkRecalled(presets.DeviceKey(s.DeviceInfo), preset, now)
+		}
+	}
+	if err := a.Catalog.Save(); err != nil {
+		log.Error().Err(err).Str("path", a.Catalog.Path()).Msg("Failed to save preset catalog")
+	}
+}
+
+// catalogPresets returns the catalog entries of the devices by preset index, and the index
+// of the preset recalled last, or -1. For presets named differently on several devices,
+// the device with the lowest address wins.
+func (a *App) catalogPresets(states []client.DeviceState) (map[int]presets.Preset, int) {
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Addr < states[j].Addr
+	})
+
+	entries := make(map[int]presets.Preset)
+	last := -1
+	var lastRecalled time.Time
+	for _, s := range states {
+		if !s.HasDeviceData {
+			continue
+		}
+		key := presets.DeviceKey(s.DeviceInfo)
+		for _, p := range a.Catalog.Presets(key) {
+			if _, ok := entries[p.Index]; !ok {
+				entries[p.Index] = p
+			}
+		}
+		if p, ok := a.Catalog.LastRecalled(key); ok && p.LastRecalled.After(lastRecalled) {
+			lastRecalled = p.LastRecalled
+			last = p.Index
+		}
+	}
+	return entries, last
+}
+
+// refreshPresets shows the catalog names of the presets of the connected devices
+func (a *App) refreshPresets() {
+	if a.ui == nil {
+		return
+	}
+	a.ui.SetPresets(a.catalogPresets(a.MultiClient.DeviceStates()))
+}
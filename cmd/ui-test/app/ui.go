@@ -12,14 +12,19 @@ import (
 	"fyne.io/fyne/v2/widget"
 	"github.com/rs/zerolog/log"
 	"image/color"
+	"ppa-control/lib/client"
+	"ppa-control/lib/presets"
 	"ppa-control/lib/utils/debouncer"
+	"strings"
 	"time"
 )
 
 type UI struct {
-	window  fyne.Window
-	console binding.String
-	fyneApp fyne.App
+	window        fyne.Window
+	console       binding.String
+	devices       binding.String
+	presetButtons []*widget.Button
+	fyneApp       fyne.App
 }
 
 func (ui *UI) Log(line string) {
@@ -33,6 +38,54 @@ func (ui *UI) Log(line string) {
 	}
 }
 
+// SetDeviceStates shows the last known state of each device
+func (ui *UI) SetDeviceStates(states []client.DeviceState) {
+	lines := make([]string, 0, len(states))
+	for _, s := range states {
+		line := s.Addr
+		if s.Name != "" {
+			line = fmt.Sprintf("%s (%s)", s.Name, s.Addr)
+		}
+		if s.HasDeviceData {
+			line += fmt.Sprintf(" - serial %d - firmware %s - ip %s", s.SerialNumber, s.FirmwareVersion, s.StaticIP)
+		}
+		if s.Preset >= 0 {
+			line += fmt.Sprintf(" - preset %d", s.Preset+1)
+		}
+		if s.MasterVolume >= 0 {
+			line += fmt.Sprintf(" - volume %.0f%%", s.MasterVolume*100)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No devices")
+	}
+
+	err := ui.devices.Set(strings.Join(lines, "\n"))
+	if err != nil {
+		log.Error().Err(err).Msg("Error setting device states")
+	}
+}
+
+// SetPresets labels the preset buttons with their catalog names and highlights
+// the preset recalled last, -1 if unknown
+func (ui *UI) SetPresets(entries map[int]presets.Preset, last int) {
+	for i, b := range ui.presetButtons {
+		label := fmt.Sprintf("Preset %d", i+1)
+		if p, ok := entries[i]; ok && p.Name != "" {
+			label = fmt.Sprintf("%d: %s", i+1, p.Name)
+		}
+		importance := widget.MediumImportance
+		if i == last {
+			importance = widget.HighImportance
+		}
+		if b.Text != label || b.Importance != importance {
+			b.Importance = importance
+			b.SetText(label)
+		}
+	}
+}
+
 func (ui *UI) Run() {
 	ui.window.ShowAndRun()
 }
@@ -48,8 +101,12 @@ func (a *App) BuildUI(cancel context.CancelFunc) *UI {
 		fyneApp: fyneApp,
 		window:  fyneApp.NewWindow("PPA Control"),
 		console: binding.NewString(),
+		devices: binding.NewString(),
 	}
 	_ = ui.console.Set("")
+	_ = ui.devices.Set("No devices")
+
+	devicesLabel := widget.NewLabelWithData(ui.devices)
 
 	serverConsole := widget.NewLabelWithData(ui.console)
 	serverScrollContainer := container.NewVScroll(serverConsole)
@@ -70,11 +127,15 @@ func (a *App) BuildUI(cancel context.CancelFunc) *UI {
 	var presetButtons = make([]fyne.CanvasObject, presetCount)
 	for i := 0; i < presetCount; i++ {
 		j := i
-		presetButtons[i] = widget.NewButton(fmt.Sprintf("Preset %d", i+1),
+		b := widget.NewButton(fmt.Sprintf("Preset %d", i+1),
 			func() {
 				a.MultiClient.SendPresetRecallByPresetIndex(j)
 				log.Info().Msg(fmt.Sprintf("Preset %d clicked", j+1))
+				a.markRecalled(j)
+				a.refreshPresets()
 			})
+		ui.presetButtons = append(ui.presetButtons, b)
+		presetButtons[i] = b
 	}
 	presetButtonContainer := container.New(layout.NewGridLayout(4), presetButtons...)
 
@@ -110,6 +171,8 @@ func (a *App) BuildUI(cancel context.CancelFunc) *UI {
 	mainGridContainer := container.NewVBox(
 		presetButtonContainer,
 		widget.NewSeparator(),
+		devicesLabel,
+		widget.NewSeparator(),
 		settingsButtonContainer,
 		//widget.NewSeparator(),
 		//clientScrollContainer,
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package client
+
+import "time"
+
+// processCPUTime is only implemented on Linux
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"encoding/hex"
+	"ppa-control/lib/protocol"
+)
+
+// DeviceID identifies a device independently of its network address. It is the
+// DeviceUniqueId the device sends in the header of every message, so it stays
+// the same when the device gets a new DHCP lease.
+type DeviceID [4]byte
+
+// DeviceIDFromHeader returns the DeviceID of the device that sent h
+func DeviceIDFromHeader(h *protocol.BasicHeader) DeviceID {
+	if h == nil {
+		return DeviceID{}
+	}
+	return DeviceID(h.DeviceUniqueId)
+}
+
+// IsZero returns true if the device did not send a unique id,
+// in which case it can only be identified by its address.
+func (id DeviceID) IsZero() bool {
+	return id == DeviceID{}
+}
+
+func (id DeviceID) String() string {
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"ppa-control/lib/protocol"
+)
+
+// DeviceInfo describes a device, as reported in its DeviceData response.
+// It is comparable, so that a new response can be checked for changes.
+type DeviceInfo struct {
+	Name             string
+	DeviceTypeId     uint16
+	VendorID         uint8
+	FirmwareVersion  protocol.FirmwareVersion
+	SerialNumber     uint16
+	HardwareFeatures protocol.HardwareFeatures
+	DiagnosticState  protocol.DiagnosticState
+	// StaticIP is the configured address and subnet of the device
+	StaticIP  netip.Prefix
+	GatewayIP netip.Addr
+	// StartPreset is the preset the device recalls when powering up
+	StartPreset int
+}
+
+func NewDeviceInfo(dd *protocol.DeviceDataResponse) DeviceInfo {
+	return DeviceInfo{
+		Name:             dd.Name(),
+		DeviceTypeId:     dd.DeviceTypeId,
+		VendorID:         dd.VendorID,
+		FirmwareVersion:  dd.Firmware(),
+		SerialNumber:     dd.SerialNumber,
+		HardwareFeatures: dd.Features(),
+		DiagnosticState:  dd.Diagnostic(),
+		StaticIP:         netip.PrefixFrom(netip.AddrFrom4(dd.StaticIP), int(dd.SubnetPrefixLength)),
+		GatewayIP:        netip.AddrFrom4(dd.GatewayIP),
+		StartPreset:      int(dd.StartPresetId),
+	}
+}
+
+// Model returns the registered model of the device, see protocol.RegisterModel
+func (i DeviceInfo) Model() (*protocol.DeviceModel, bool) {
+	return protocol.LookupModel(i.VendorID, i.DeviceTypeId)
+}
+
+// DeviceInfoRetryPolicy is used by MultiClient to query the info of every device it adds.
+// Once all attempts went unanswered, the device is left without info, but a DeviceData
+// response received later still fills in its state.
+var DeviceInfoRetryPolicy = DefaultRetryPolicy
+
+// QueryDeviceInfo sends a DeviceData request and waits for the response, retrying according to policy.
+// If the model of the device is registered, further commands are checked against it.
+func (c *SingleDevice) QueryDeviceInfo(ctx context.Context, policy RetryPolicy) (DeviceInfo, error) {
+	reply, err := c.SendWithRetry(ctx, NewDeviceDataRequest(), policy)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	dd, ok := reply.Body.(*protocol.DeviceDataResponse)
+	if !ok {
+		if reply.BodyErr != nil {
+			return DeviceInfo{}, NewClientError("device info", c.Address(), reply.BodyErr)
+		}
+		return DeviceInfo{}, NewClientError("device info", c.Address(),
+			fmt.Errorf("unexpected %s reply with body %T", reply.Header.MessageType, reply.Body))
+	}
+	info := NewDeviceInfo(dd)
+	if m, ok := info.Model(); ok {
+		c.SetModel(m)
+	}
+	return info, nil
+}
@@ -2,8 +2,10 @@ package discovery
 
 import (
 	"context"
+	"net"
+	"net/netip"
 	"ppa-control/lib/client"
-	"time"
+	"ppa-control/lib/protocol"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
@@ -12,46 +14,69 @@ import (
 type PeerInformation interface {
 	GetAddress() string
 	GetInterface() string
+	// GetDeviceID returns the unique id of the peer, which is zero if the peer didn't send one
+	GetDeviceID() client.DeviceID
+	// GetPeer returns everything known about the peer when the event was emitted
+	GetPeer() Peer
 }
 
+// PeerDiscovered is emitted when a peer answers for the first time
 type PeerDiscovered struct {
-	addr  string
-	iface string
+	Peer
 }
 
+// PeerLost is emitted when a peer didn't answer for longer than Options.PeerTimeout
 type PeerLost struct {
-	addr  string
-	iface string
+	Peer
 }
 
-func (c PeerDiscovered) GetInterface() string {
-	return c.iface
+// PeerMoved is emitted when a known peer answers from a new address,
+// for example after getting a new DHCP lease.
+type PeerMoved struct {
+	Peer
+	previousAddr string
 }
 
-func (c PeerLost) GetInterface() string {
-	return c.iface
-}
-func (c PeerDiscovered) GetAddress() string {
-	return c.addr
+// GetPreviousAddress returns the address the peer was known at before
+func (c PeerMoved) GetPreviousAddress() string {
+	return c.previousAddr
 }
 
-func (c PeerLost) GetAddress() string {
-	return c.addr
+// PeerUpdated is emitted when the interface, local address, component id or
+// DeviceData of a known peer changed, for example once its DeviceData was received.
+type PeerUpdated struct {
+	Peer
 }
 
+// Discover sends discovery pings on the discoveryInterfaces (all valid interfaces if empty)
+// with DefaultOptions, and reports discovered, moved and lost peers on msgCh.
 func Discover(
 	ctx context.Context,
 	msgCh chan PeerInformation,
 	discoveryInterfaces []string,
 	port uint16) error {
+	return DiscoverWithOptions(ctx, msgCh, discoveryInterfaces, port, DefaultOptions)
+}
+
+// DiscoverWithOptions is Discover with the ping interval, peer timeout,
+// interface rescan interval and broadcast addresses given by opts.
+// If opts.ScanRanges is set, the ranges are swept too, see ScanInterface.
+func DiscoverWithOptions(
+	ctx context.Context,
+	msgCh chan PeerInformation,
+	discoveryInterfaces []string,
+	port uint16,
+	opts Options) error {
+	opts = opts.withDefaults()
 	receivedCh := make(chan client.ReceivedMessage)
 
-	interfaceManager := NewInterfaceManager(port, receivedCh)
-	interfaceDiscoverer := NewInterfaceDiscoverer(interfaceManager, discoveryInterfaces)
+	interfaceManager := NewInterfaceManager(port, receivedCh, opts)
+	interfaceDiscoverer := NewInterfaceDiscoverer(interfaceManager, discoveryInterfaces, opts)
 
 	// start the discoverer:
-	//   - GR1: interfaceDiscoverer.Run() which writes to addedInterfaceCh and removedInterfaceCh
-	//   - GR2: Run() which reads from addedInterfaceCh and removedInterfaceCh
+	//   - GR1: interfaceDiscoverer.Run() which writes to addedInterfaceCh, removedInterfaceCh
+	//     and changedInterfaceCh
+	//   - GR2: Run() which reads from addedInterfaceCh, removedInterfaceCh and changedInterfaceCh
 	//
 	// GR1 and GR2 use the same context tree
 	grp, ctx := errgroup.WithContext(ctx)
@@ -59,88 +84,229 @@ func Discover(
 		return interfaceDiscoverer.Run(ctx)
 	})
 
+	l := &discoveryLoop{
+		opts:               opts,
+		interfaces:         interfaceManager,
+		addedInterfaceCh:   interfaceDiscoverer.addedInterfaceCh,
+		removedInterfaceCh: interfaceDiscoverer.removedInterfaceCh,
+		changedInterfaceCh: interfaceDiscoverer.changedInterfaceCh,
+		receivedCh:         receivedCh,
+		msgCh:              msgCh,
+	}
+
+	// GR3 sweeps the scan ranges, its answers are handled by GR2 like the broadcast ones
+	if len(opts.ScanRanges) > 0 {
+		s := newScanner(port, opts)
+		l.scanner = s
+		grp.Go(func() error {
+			return s.Run(ctx, receivedCh)
+		})
+	}
+
 	grp.Go(func() error {
-		log.Debug().Msg("Starting discovery loop")
-
-		peerLastSeen := make(map[string]time.Time)
-		peerTimeout := 30 * time.Second
-
-		for {
-			t := time.NewTimer(5 * time.Second)
-
-			select {
-			case <-t.C:
-				for addr, lastSeen := range peerLastSeen {
-					if time.Since(lastSeen) > peerTimeout {
-						log.Debug().Str("addr", addr).Msg("peer lost")
-						delete(peerLastSeen, addr)
-						select {
-						case msgCh <- PeerLost{addr: addr}:
-						case <-ctx.Done():
-							return ctx.Err()
-						}
-					}
-				}
+		return l.run(ctx)
+	})
+
+	return grp.Wait()
+}
 
-				interfaceManager.SendPing()
+// interfaceClients are the broadcast clients of the discovery, one per interface.
+// It is implemented by the InterfaceManager.
+type interfaceClients interface {
+	StartInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice)
+	CancelInterfaceClient(iface InterfaceName) error
+	// RebindInterfaceClient restarts the clients of iface after its addresses changed
+	RebindInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice)
+	SendPing()
+	SendPingOn(iface InterfaceName)
+	SendDeviceDataRequestOn(ctx context.Context, iface InterfaceName)
+	// LocalIP returns the address of iface the remote peer answered on
+	LocalIP(iface InterfaceName, remote netip.Addr) netip.Addr
+	Wait()
+}
 
-			case newInterface := <-interfaceDiscoverer.addedInterfaceCh:
-				log.Debug().Str("iface", newInterface).Msg("new interface discovered")
-				err, c := interfaceManager.StartInterfaceClient(ctx, newInterface)
-				if err != nil {
-					return err
+// discoveryLoop pings on all interfaces, tracks the peers that answer and
+// reports them on msgCh.
+type discoveryLoop struct {
+	opts               Options
+	interfaces         interfaceClients
+	addedInterfaceCh   <-chan InterfaceName
+	removedInterfaceCh <-chan InterfaceName
+	changedInterfaceCh <-chan InterfaceName
+	receivedCh         <-chan client.ReceivedMessage
+	msgCh              chan<- PeerInformation
+	// scanner is nil if no ranges are swept
+	scanner unicastClients
+}
+
+func (l *discoveryLoop) run(ctx context.Context) error {
+	log.Debug().Msg("Starting discovery loop")
+
+	peers := newPeerTable(l.opts.PeerTimeout)
+	// interfaces and scanned peers the DeviceData was queried on since the last ping,
+	// so that a burst of new peers on an interface triggers a single broadcast query
+	queried := make(map[string]struct{})
+	query := func(p Peer) {
+		if l.opts.SkipDeviceData {
+			return
+		}
+		key := p.Interface
+		if p.Interface == ScanInterface {
+			if l.scanner == nil {
+				return
+			}
+			key = p.Addr
+		}
+		if _, ok := queried[key]; ok {
+			return
+		}
+		queried[key] = struct{}{}
+		log.Debug().Str("iface", p.Interface).Str("addr", p.Addr).Msg("querying device data")
+		if p.Interface == ScanInterface {
+			l.scanner.SendDeviceDataRequestTo(ctx, p.Addr)
+		} else {
+			l.interfaces.SendDeviceDataRequestOn(ctx, p.Interface)
+		}
+	}
+
+	ticker := l.opts.Clock.NewTicker(l.opts.PingInterval)
+	defer ticker.Stop()
+
+	send := func(info PeerInformation) error {
+		select {
+		case l.msgCh <- info:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C():
+			l.interfaces.SendPing()
+			if l.scanner != nil {
+				for _, addr := range peers.scanned() {
+					l.scanner.SendPingTo(ctx, addr)
 				}
-				// immediately send welcome ping
-				c.SendPing()
+			}
 
-			case removedInterface := <-interfaceDiscoverer.removedInterfaceCh:
-				log.Debug().Str("iface", removedInterface).Msg("interface removed")
-				err := interfaceManager.CancelInterfaceClient(removedInterface)
-				if err != nil {
+			for _, lost := range peers.expire(l.opts.Clock.Now(), l.opts.PeerTimeout) {
+				log.Debug().Str("addr", lost.Addr).Str("name", lost.Name()).Msg("peer lost")
+				if err := send(lost); err != nil {
 					return err
 				}
+			}
+
+			clear(queried)
+			for _, p := range peers.withoutDeviceData() {
+				query(p)
+			}
+
+		case newInterface := <-l.addedInterfaceCh:
+			log.Debug().Str("iface", newInterface).Msg("new interface discovered")
+			err, _ := l.interfaces.StartInterfaceClient(ctx, newInterface)
+			if err != nil {
+				return err
+			}
+			// immediately send welcome pings
+			l.interfaces.SendPingOn(newInterface)
+			if l.opts.InitialBurstPings > 1 {
+				go l.burst(ctx, newInterface)
+			}
+
+		case removedInterface := <-l.removedInterfaceCh:
+			log.Debug().Str("iface", removedInterface).Msg("interface removed")
+			err := l.interfaces.CancelInterfaceClient(removedInterface)
+			if err != nil {
+				return err
+			}
+
+		case changedInterface := <-l.changedInterfaceCh:
+			log.Debug().Str("iface", changedInterface).Msg("interface addresses changed")
+			err, _ := l.interfaces.RebindInterfaceClient(ctx, changedInterface)
+			if err != nil {
+				return err
+			}
+			// the devices may have changed network too, find them right away
+			l.interfaces.SendPingOn(changedInterface)
 
-			case msg := <-receivedCh:
-				if msg.Header != nil {
-					log.Info().Str("from", msg.RemoteAddress.String()).
-						Str("pkg", msg.Client.Name()).
-						Str("iface", msg.Interface).
-						Str("type", msg.Header.MessageType.String()).
-						Str("status", msg.Header.Status.String()).
-						Msg("received message")
-
-					_, peerFound := peerLastSeen[msg.RemoteAddress.String()]
-					peerLastSeen[msg.RemoteAddress.String()] = time.Now()
-					if !peerFound {
-						log.Info().
-							Str("addr", msg.RemoteAddress.String()).
-							Str("iface", msg.Interface).
-							Msg("new peer discovered")
-						select {
-						case msgCh <- PeerDiscovered{
-							msg.RemoteAddress.String(),
-							msg.Interface,
-						}:
-						case <-ctx.Done():
-							return ctx.Err()
-						}
+		case msg := <-l.receivedCh:
+			if msg.Header != nil {
+				log.Info().Str("from", msg.RemoteAddress.String()).
+					Str("pkg", msg.Client.Name()).
+					Str("iface", msg.Interface).
+					Str("type", msg.Header.MessageType.String()).
+					Str("status", msg.Header.Status.String()).
+					Msg("received message")
+
+				if info := peers.seen(l.sighting(msg), l.opts.Clock.Now()); info != nil {
+					p := info.GetPeer()
+					e := log.Info().
+						Str("addr", p.Addr).
+						Str("iface", p.Interface).
+						Str("name", p.Name()).
+						Str("deviceId", p.DeviceID.String())
+					switch info := info.(type) {
+					case PeerMoved:
+						e.Str("previousAddr", info.previousAddr).Msg("peer moved")
+					case PeerUpdated:
+						e.Msg("peer updated")
+					default:
+						e.Msg("new peer discovered")
+					}
+					if err := send(info); err != nil {
+						return err
+					}
+					if !p.HasDeviceData {
+						query(p)
 					}
-					log.Debug().Str("addr", msg.RemoteAddress.String()).Msg("peer lastSeen updated")
-				} else {
-					log.Debug().Str("from", msg.RemoteAddress.String()).
-						Str("pkg", msg.Client.Name()).
-						Msg("received unknown message")
 				}
+				log.Debug().Str("addr", msg.RemoteAddress.String()).Msg("peer lastSeen updated")
+			} else {
+				log.Debug().Str("from", msg.RemoteAddress.String()).
+					Str("pkg", msg.Client.Name()).
+					Msg("received unknown message")
+			}
 
-			case <-ctx.Done():
-				log.Info().Msg("waiting for clients to stop")
+		case <-ctx.Done():
+			log.Info().Msg("waiting for clients to stop")
 
-				interfaceManager.Wait()
+			l.interfaces.Wait()
 
-				return ctx.Err()
-			}
+			return ctx.Err()
 		}
-	})
+	}
+}
 
-	return grp.Wait()
+// sighting extracts the identity of the peer from a received message
+func (l *discoveryLoop) sighting(msg client.ReceivedMessage) sighting {
+	s := sighting{
+		addr:        msg.RemoteAddress.String(),
+		iface:       msg.Interface,
+		deviceId:    client.DeviceIDFromHeader(msg.Header),
+		componentId: msg.Header.ComponentId,
+	}
+	if udpAddr, ok := msg.RemoteAddress.(*net.UDPAddr); ok && msg.Interface != ScanInterface {
+		if remote, ok := netip.AddrFromSlice(udpAddr.IP); ok {
+			s.localIP = l.interfaces.LocalIP(msg.Interface, remote.Unmap())
+		}
+	}
+	if dd, ok := msg.Body.(*protocol.DeviceDataResponse); ok {
+		info := client.NewDeviceInfo(dd)
+		s.info = &info
+	}
+	return s
+}
+
+// burst sends the remaining InitialBurstPings on a newly added interface
+func (l *discoveryLoop) burst(ctx context.Context, iface InterfaceName) {
+	for i := 1; i < l.opts.InitialBurstPings; i++ {
+		select {
+		case <-l.opts.Clock.After(l.opts.InitialBurstInterval):
+			l.interfaces.SendPingOn(iface)
+		case <-ctx.Done():
+			return
+		}
+	}
 }
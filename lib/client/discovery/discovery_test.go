@@ -0,0 +1,338 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"ppa-control/lib/client"
+	"ppa-control/lib/protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when Advance is called
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock  *fakeClock
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d time.Duration, period time.Duration) *fakeWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{clock: c, at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c.add(d, d)
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) Stop() {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	w.clock.remove(w)
+}
+
+func (c *fakeClock) remove(w *fakeWaiter) {
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward and fires the timers and tickers that are due.
+// Like time.Ticker, a ticker that wasn't read drops ticks.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, w := range append([]*fakeWaiter(nil), c.waiters...) {
+		if w.at.After(c.now) {
+			continue
+		}
+		select {
+		case w.ch <- c.now:
+		default:
+		}
+		if w.period == 0 {
+			c.remove(w)
+			continue
+		}
+		for !w.at.After(c.now) {
+			w.at = w.at.Add(w.period)
+		}
+	}
+}
+
+// BlockUntil waits until n timers or tickers are registered
+func (c *fakeClock) BlockUntil(tb testing.TB, n int) {
+	waitFor(tb, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return len(c.waiters) >= n
+	})
+}
+
+func waitFor(tb testing.TB, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeInterfaces counts the pings and DeviceData queries sent by the discovery loop
+type fakeInterfaces struct {
+	mutex   sync.Mutex
+	started []InterfaceName
+	rebound []InterfaceName
+	pings   int
+	pingsOn map[InterfaceName]int
+	queries map[InterfaceName]int
+}
+
+func (f *fakeInterfaces) StartInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.started = append(f.started, iface)
+	return nil, nil
+}
+
+func (f *fakeInterfaces) CancelInterfaceClient(iface InterfaceName) error {
+	return nil
+}
+
+func (f *fakeInterfaces) RebindInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rebound = append(f.rebound, iface)
+	return nil, nil
+}
+
+func (f *fakeInterfaces) SendPing() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.pings++
+}
+
+func (f *fakeInterfaces) SendPingOn(iface InterfaceName) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.pingsOn[iface]++
+}
+
+func (f *fakeInterfaces) SendDeviceDataRequestOn(ctx context.Context, iface InterfaceName) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queries[iface]++
+}
+
+func (f *fakeInterfaces) LocalIP(iface InterfaceName, remote netip.Addr) netip.Addr {
+	return netip.MustParseAddr("10.0.0.1")
+}
+
+func (f *fakeInterfaces) Wait() {}
+
+func (f *fakeInterfaces) counts(iface InterfaceName) (int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.pings, f.pingsOn[iface]
+}
+
+func (f *fakeInterfaces) queryCount(iface InterfaceName) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.queries[iface]
+}
+
+func TestDiscoveryLoopTiming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := Options{
+		PingInterval:         5 * time.Second,
+		PeerTimeout:          12 * time.Second,
+		InitialBurstPings:    3,
+		InitialBurstInterval: time.Second,
+		Clock:                clock,
+	}.withDefaults()
+
+	interfaces := &fakeInterfaces{pingsOn: make(map[InterfaceName]int), queries: make(map[InterfaceName]int)}
+	addedCh := make(chan InterfaceName)
+	changedCh := make(chan InterfaceName)
+	receivedCh := make(chan client.ReceivedMessage)
+	msgCh := make(chan PeerInformation)
+	l := &discoveryLoop{
+		opts:               opts,
+		interfaces:         interfaces,
+		addedInterfaceCh:   addedCh,
+		removedInterfaceCh: make(chan InterfaceName),
+		changedInterfaceCh: changedCh,
+		receivedCh:         receivedCh,
+		msgCh:              msgCh,
+	}
+	done := make(chan error)
+	go func() { done <- l.run(ctx) }()
+
+	// a new interface gets a burst of pings, one second apart
+	addedCh <- "eth0"
+	for burst := 1; burst <= opts.InitialBurstPings; burst++ {
+		waitFor(t, func() bool { _, on := interfaces.counts("eth0"); return on == burst })
+		if burst < opts.InitialBurstPings {
+			clock.BlockUntil(t, 2)
+			clock.Advance(opts.InitialBurstInterval)
+		}
+	}
+
+	// a peer answers 2 seconds in, and its DeviceData is queried
+	start := clock.Now()
+	id := client.DeviceID{1, 2, 3, 4}
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 5001}
+	c := client.NewSingleDevice("255.255.255.255:5001", "eth0", 0xfe)
+	receivedCh <- client.ReceivedMessage{
+		Header:        protocol.NewBasicHeader(protocol.MessageTypePing, protocol.StatusResponseServer, id, 1, 0xff),
+		RemoteAddress: remote,
+		Interface:     "eth0",
+		Client:        c,
+	}
+	peer := Peer{
+		Addr:        "10.0.0.5:5001",
+		Interface:   "eth0",
+		LocalIP:     netip.MustParseAddr("10.0.0.1"),
+		DeviceID:    id,
+		ComponentID: 0xff,
+		FirstSeen:   start,
+		LastSeen:    start,
+	}
+	if info := <-msgCh; info != (PeerDiscovered{peer}) {
+		t.Fatalf("Expected the peer to be discovered, got %#v", info)
+	}
+	waitFor(t, func() bool { return interfaces.queryCount("eth0") == 1 })
+
+	// its DeviceData reply updates the peer
+	dd := &protocol.DeviceDataResponse{}
+	copy(dd.DeviceName[:], "Front Left")
+	receivedCh <- client.ReceivedMessage{
+		Header:        protocol.NewBasicHeader(protocol.MessageTypeDeviceData, protocol.StatusResponseServer, id, 2, 0xff),
+		RemoteAddress: remote,
+		Interface:     "eth0",
+		Client:        c,
+		Body:          dd,
+	}
+	updated := <-msgCh
+	if _, ok := updated.(PeerUpdated); !ok || updated.GetPeer().Name() != "Front Left" || !updated.GetPeer().HasDeviceData {
+		t.Fatalf("Expected the peer to be updated with its name, got %#v", updated)
+	}
+
+	// pings are sent every PingInterval, at 5, 10 and 15 seconds, and the peer is lost
+	// on the first tick more than PeerTimeout after it was seen, at 15 seconds
+	clock.Advance(3 * time.Second)
+	waitFor(t, func() bool { pings, _ := interfaces.counts("eth0"); return pings == 1 })
+	clock.Advance(opts.PingInterval)
+	waitFor(t, func() bool { pings, _ := interfaces.counts("eth0"); return pings == 2 })
+	clock.Advance(opts.PingInterval)
+	lost := <-msgCh
+	if _, ok := lost.(PeerLost); !ok || lost.GetAddress() != "10.0.0.5:5001" {
+		t.Fatalf("Expected the peer to be lost, got %#v", lost)
+	}
+	if pings, _ := interfaces.counts("eth0"); pings != 3 {
+		t.Errorf("Expected 3 pings before the peer was lost, got %d", pings)
+	}
+	if elapsed := clock.Now().Sub(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); elapsed != 15*time.Second {
+		t.Errorf("Expected the peer to be lost after 15 seconds, got %s", elapsed)
+	}
+	if lost.GetPeer().Name() != "Front Left" {
+		t.Errorf("Expected the lost peer to keep its name, got %q", lost.GetPeer().Name())
+	}
+	if queries := interfaces.queryCount("eth0"); queries != 1 {
+		t.Errorf("Expected the device data to be queried once, got %d queries", queries)
+	}
+
+	// an address change rebinds the clients of the interface and pings right away
+	changedCh <- "eth0"
+	waitFor(t, func() bool { _, on := interfaces.counts("eth0"); return on == opts.InitialBurstPings+1 })
+	interfaces.mutex.Lock()
+	rebound := interfaces.rebound
+	interfaces.mutex.Unlock()
+	if len(rebound) != 1 || rebound[0] != "eth0" {
+		t.Errorf("Expected eth0 to be rebound, got %v", rebound)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestDiscoveryLoopSkipsDeviceData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := Options{SkipDeviceData: true, Clock: clock}.withDefaults()
+	interfaces := &fakeInterfaces{pingsOn: make(map[InterfaceName]int), queries: make(map[InterfaceName]int)}
+	receivedCh := make(chan client.ReceivedMessage)
+	msgCh := make(chan PeerInformation)
+	l := &discoveryLoop{
+		opts:               opts,
+		interfaces:         interfaces,
+		addedInterfaceCh:   make(chan InterfaceName),
+		removedInterfaceCh: make(chan InterfaceName),
+		changedInterfaceCh: make(chan InterfaceName),
+		receivedCh:         receivedCh,
+		msgCh:              msgCh,
+	}
+	done := make(chan error)
+	go func() { done <- l.run(ctx) }()
+
+	// neither a new peer nor the next tick query its DeviceData
+	receivedCh <- client.ReceivedMessage{
+		Header:        protocol.NewBasicHeader(protocol.MessageTypePing, protocol.StatusResponseServer, client.DeviceID{1, 2, 3, 4}, 1, 0xff),
+		RemoteAddress: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 5001},
+		Interface:     "eth0",
+		Client:        client.NewSingleDevice("255.255.255.255:5001", "eth0", 0xfe),
+	}
+	if info := <-msgCh; info.GetAddress() != "10.0.0.5:5001" {
+		t.Fatalf("Expected the peer to be discovered, got %#v", info)
+	}
+	clock.Advance(opts.PingInterval)
+	waitFor(t, func() bool { pings, _ := interfaces.counts("eth0"); return pings == 1 })
+	if queries := interfaces.queryCount("eth0"); queries != 0 {
+		t.Errorf("Expected no device data queries, got %d", queries)
+	}
+
+	cancel()
+	<-done
+}
@@ -2,21 +2,38 @@ package discovery
 
 import (
 	"context"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"net"
 	"ppa-control/lib/utils"
 	"time"
 )
 
+// interfaceEventDelay is the time a rescan waits after an interface event, for the
+// following events of the same change
+var interfaceEventDelay = 100 * time.Millisecond
+
 type InterfaceDiscoverer struct {
 	im *InterfaceManager
 	// if not empty, this is a list of the interfaces we will be using, ignoring other interfaces
 	acceptedInterfaces map[InterfaceName]struct{}
 	addedInterfaceCh   chan string
 	removedInterfaceCh chan string
+	// changedInterfaceCh reports the interfaces whose IPv4 networks changed
+	changedInterfaceCh chan string
+	rescanInterval     time.Duration
+	clock              Clock
+
+	// networks are the IPv4 networks of each interface at the last scan, used to notice
+	// address changes. It is only used by Run.
+	networks map[InterfaceName]string
+	// watch subscribes to link and address changes, see watchInterfaces
+	watch func(ctx context.Context) (<-chan struct{}, error)
 }
 
-func NewInterfaceDiscoverer(im *InterfaceManager, acceptedInterfaces []InterfaceName) *InterfaceDiscoverer {
+// NewInterfaceDiscoverer scans for interfaces every opts.InterfaceRescanInterval
+func NewInterfaceDiscoverer(im *InterfaceManager, acceptedInterfaces []InterfaceName, opts Options) *InterfaceDiscoverer {
+	opts = opts.withDefaults()
 	// TODO(@manuel) - The idiomatic way to do sets is a map of struct{}
 	acceptedInterfacesMap := make(map[InterfaceName]struct{})
 	for _, iface := range acceptedInterfaces {
@@ -27,19 +44,25 @@ func NewInterfaceDiscoverer(im *InterfaceManager, acceptedInterfaces []Interface
 		acceptedInterfaces: acceptedInterfacesMap,
 		addedInterfaceCh:   make(chan InterfaceName),
 		removedInterfaceCh: make(chan InterfaceName),
+		changedInterfaceCh: make(chan InterfaceName),
+		rescanInterval:     opts.InterfaceRescanInterval,
+		clock:              opts.Clock,
+		networks:           make(map[InterfaceName]string),
+		watch:              watchInterfaces,
 	}
 }
 
-func (id *InterfaceDiscoverer) updateInterfaces(currentInterfaces []InterfaceName) (newInterfaces []InterfaceName, removedInterfaces []InterfaceName, err error) {
+func (id *InterfaceDiscoverer) updateInterfaces(currentInterfaces []InterfaceName) (newInterfaces []InterfaceName, removedInterfaces []InterfaceName, changedInterfaces []InterfaceName, err error) {
 	validInterfaces, err := utils.GetValidInterfaces()
 	if err != nil {
 		log.Error().Err(err).Msg("failed to get interfaces")
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	log.Debug().Msgf("valid interfaces: %v", validInterfaces)
 
 	newInterfaces = make([]InterfaceName, 0)
 	removedInterfaces = make([]InterfaceName, 0)
+	changedInterfaces = make([]InterfaceName, 0)
 
 	currentInterfacesMap := make(map[InterfaceName]struct{})
 	for _, iface := range currentInterfaces {
@@ -54,6 +77,7 @@ func (id *InterfaceDiscoverer) updateInterfaces(currentInterfaces []InterfaceNam
 	for ifaceName := range currentInterfacesMap {
 		if _, ok := validInterfacesMap[ifaceName]; !ok {
 			removedInterfaces = append(removedInterfaces, ifaceName)
+			delete(id.networks, ifaceName)
 		}
 	}
 
@@ -64,8 +88,22 @@ func (id *InterfaceDiscoverer) updateInterfaces(currentInterfaces []InterfaceNam
 				continue
 			}
 		}
+		networks := ""
+		if prefixes, err := interfacePrefixes(iface.Name); err == nil {
+			networks = fmt.Sprint(prefixes)
+		}
+		previous, known := id.networks[iface.Name]
+		id.networks[iface.Name] = networks
+
 		if _, ok := currentInterfacesMap[iface.Name]; ok {
-			// already know interface
+			// already know interface, its client is bound to the previous addresses
+			if known && previous != networks {
+				log.Info().Str("iface", iface.Name).
+					Str("previous", previous).
+					Str("networks", networks).
+					Msg("interface addresses changed")
+				changedInterfaces = append(changedInterfaces, iface.Name)
+			}
 			continue
 		}
 
@@ -75,58 +113,109 @@ func (id *InterfaceDiscoverer) updateInterfaces(currentInterfaces []InterfaceNam
 	return
 }
 
-// Run will discover new and removed interfaces.
-// we use the InterfaceManager to get the current list of clients
+// Run will discover new, removed and changed interfaces.
+// we use the InterfaceManager to get the current list of clients.
+//
+// Interfaces are rescanned as soon as the operating system reports a link or address
+// change, on Linux through rtnetlink. Where this is not available, or if the subscription
+// fails, interfaces are polled every rescanInterval.
 func (id *InterfaceDiscoverer) Run(ctx context.Context) error {
+	send := func(ch chan<- InterfaceName, iface InterfaceName, action string) error {
+		log.Debug().Str("iface", iface).Msgf("%s interface", action)
+		// use non-blocking primitives to avoid hanging if the main loop gets cancelled
+		select {
+		case ch <- iface:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
 	scanInterfaces := func() error {
 		log.Debug().Msg("scanning interfaces")
 
 		clientInterfaces := id.im.GetClientInterfaces()
 
 		log.Debug().Msgf("current interfaces: %v", clientInterfaces)
-		newInterfaces, removedInterfaces, err := id.updateInterfaces(clientInterfaces)
+		newInterfaces, removedInterfaces, changedInterfaces, err := id.updateInterfaces(clientInterfaces)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to update interfaces")
 			return err
 		}
 
-		// use non-blocking primitives to avoid hanging if the main loop gets cancelled
 		for _, iface := range newInterfaces {
-			log.Debug().Str("iface", iface).Msg("adding interface")
-			select {
-			case id.addedInterfaceCh <- iface:
-				log.Debug().Str("iface", iface).Msg("added interface")
-			case <-ctx.Done():
-				return ctx.Err()
+			if err := send(id.addedInterfaceCh, iface, "adding"); err != nil {
+				return err
 			}
 		}
-
 		for _, iface := range removedInterfaces {
-			log.Debug().Str("iface", iface).Msg("removing interface")
-			select {
-			case id.removedInterfaceCh <- iface:
-				log.Debug().Str("iface", iface).Msg("removed interface")
-			case <-ctx.Done():
-				return ctx.Err()
+			if err := send(id.removedInterfaceCh, iface, "removing"); err != nil {
+				return err
+			}
+		}
+		for _, iface := range changedInterfaces {
+			if err := send(id.changedInterfaceCh, iface, "rebinding"); err != nil {
+				return err
 			}
 		}
 
 		return nil
 	}
 
-	err := scanInterfaces()
+	// subscribe before the first scan, so that no change is missed in between
+	events, err := id.watch(ctx)
+	if err != nil {
+		log.Info().Err(err).Dur("interval", id.rescanInterval).Msg("interface monitoring not available, polling interfaces")
+	}
+
+	err = scanInterfaces()
 	if err != nil {
 		return err
 	}
 
-	for {
-		t := time.NewTimer(5 * time.Second)
+	var ticker Ticker
+	var tick <-chan time.Time
+	poll := func() {
+		ticker = id.clock.NewTicker(id.rescanInterval)
+		tick = ticker.C()
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	if events == nil {
+		poll()
+	}
 
+	// changes come in bursts, for example a link going up and getting its address,
+	// so a scan waits for the burst to settle
+	var settled <-chan time.Time
+
+	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case <-t.C:
+		case _, ok := <-events:
+			if !ok {
+				log.Warn().Dur("interval", id.rescanInterval).Msg("interface monitoring stopped, polling interfaces")
+				events = nil
+				poll()
+				continue
+			}
+			if settled == nil {
+				settled = id.clock.After(interfaceEventDelay)
+			}
+
+		case <-settled:
+			settled = nil
+			err := scanInterfaces()
+			if err != nil {
+				return err
+			}
+
+		case <-tick:
 			err := scanInterfaces()
 			if err != nil {
 				return err
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"go.uber.org/atomic"
+	"net"
+	"net/netip"
 	"ppa-control/lib/client"
 	"sync"
 )
@@ -13,25 +15,35 @@ type InterfaceName = string
 
 type InterfaceManager struct {
 	port       uint16
+	broadcast  BroadcastMode
+	transports *client.TransportPool
 	receivedCh chan<- client.ReceivedMessage
 
 	// used to Wait for all clients to be done
 	wg sync.WaitGroup
 
-	// one Client and cancel per interface, protected by mutex
+	// one Client per broadcast address and one cancel per interface, protected by mutex.
+	// dones are closed once the clients of the interface are stopped and removed.
 	mutex   sync.RWMutex
-	clients map[InterfaceName]client.Client
+	clients map[InterfaceName][]client.Client
 	cancels map[InterfaceName]context.CancelFunc
+	dones   map[InterfaceName]chan struct{}
 
 	waiting atomic.Bool
 }
 
-func NewInterfaceManager(port uint16, receivedCh chan<- client.ReceivedMessage) *InterfaceManager {
+// NewInterfaceManager creates the clients of each interface for the broadcast addresses
+// selected by opts.Broadcast, on the transports of opts.Transports
+func NewInterfaceManager(port uint16, receivedCh chan<- client.ReceivedMessage, opts Options) *InterfaceManager {
+	opts = opts.withDefaults()
 	return &InterfaceManager{
-		clients:    make(map[InterfaceName]client.Client),
+		clients:    make(map[InterfaceName][]client.Client),
 		cancels:    make(map[InterfaceName]context.CancelFunc),
+		dones:      make(map[InterfaceName]chan struct{}),
 		receivedCh: receivedCh,
 		port:       port,
+		broadcast:  opts.Broadcast,
+		transports: opts.Transports,
 		waiting:    *atomic.NewBool(false),
 	}
 }
@@ -43,11 +55,130 @@ func (im *InterfaceManager) SendPing() {
 		im.mutex.RUnlock()
 	}()
 
-	for _, c := range im.clients {
+	for _, clients := range im.clients {
+		for _, c := range clients {
+			c.SendPing()
+		}
+	}
+}
+
+// SendPingOn sends a ping on the given interface only, if it has clients
+func (im *InterfaceManager) SendPingOn(iface InterfaceName) {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	for _, c := range im.clients[iface] {
 		c.SendPing()
 	}
 }
 
+// SendDeviceDataRequestOn broadcasts a DeviceData request on the given interface, if it has clients,
+// so that the peers on it report their name and serial number.
+func (im *InterfaceManager) SendDeviceDataRequestOn(ctx context.Context, iface InterfaceName) {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	for _, c := range im.clients[iface] {
+		if err := c.Send(ctx, client.NewDeviceDataRequest()); err != nil {
+			log.Warn().Err(err).Str("iface", iface).Msg("failed to send device data request")
+		}
+	}
+}
+
+// LocalIP returns the IPv4 address of iface in the same network as remote,
+// or its first IPv4 address if none matches.
+func (im *InterfaceManager) LocalIP(iface InterfaceName, remote netip.Addr) netip.Addr {
+	prefixes, err := interfacePrefixes(iface)
+	if err != nil {
+		log.Debug().Err(err).Str("iface", iface).Msg("failed to get interface addresses")
+		return netip.Addr{}
+	}
+	return localIP(prefixes, remote)
+}
+
+// interfacePrefixes returns the IPv4 networks configured on iface
+func interfacePrefixes(iface InterfaceName) ([]netip.Prefix, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			continue
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits == 128 {
+			// IPv4 address with an IPv6 length mask
+			ones -= 96
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, ones))
+	}
+	return prefixes, nil
+}
+
+// broadcastAddrs returns the addresses pings are sent to on an interface with the given
+// networks. Duplicate networks and point-to-point networks (/31, /32) are skipped.
+func broadcastAddrs(prefixes []netip.Prefix, mode BroadcastMode) []netip.Addr {
+	var addrs []netip.Addr
+	seen := make(map[netip.Addr]struct{})
+	if mode != BroadcastLimited {
+		for _, p := range prefixes {
+			b, ok := directedBroadcast(p)
+			if !ok {
+				continue
+			}
+			if _, ok := seen[b]; ok {
+				continue
+			}
+			seen[b] = struct{}{}
+			addrs = append(addrs, b)
+		}
+	}
+	if mode != BroadcastDirected || len(addrs) == 0 {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{255, 255, 255, 255}))
+	}
+	return addrs
+}
+
+// directedBroadcast returns the broadcast address of an IPv4 network, with all host bits set
+func directedBroadcast(p netip.Prefix) (netip.Addr, bool) {
+	if !p.Addr().Is4() || p.Bits() < 0 || p.Bits() >= 31 {
+		return netip.Addr{}, false
+	}
+	a := p.Addr().As4()
+	for i := p.Bits(); i < 32; i++ {
+		a[i/8] |= 1 << (7 - i%8)
+	}
+	return netip.AddrFrom4(a), true
+}
+
+func localIP(prefixes []netip.Prefix, remote netip.Addr) netip.Addr {
+	for _, p := range prefixes {
+		if p.Contains(remote) {
+			return p.Addr()
+		}
+	}
+	if len(prefixes) > 0 {
+		return prefixes[0].Addr()
+	}
+	return netip.Addr{}
+}
+
 func (im *InterfaceManager) DoesInterfaceExist(iface InterfaceName) bool {
 	im.mutex.RLock()
 	defer func() {
@@ -59,9 +190,9 @@ func (im *InterfaceManager) DoesInterfaceExist(iface InterfaceName) bool {
 	return ok
 }
 
-// StartInterfaceClient will create and start a pkg for the given interface,
-// with target address the broadcast address 255.255.255.255 .
-func (im *InterfaceManager) StartInterfaceClient(ctx context.Context, iface InterfaceName) (error, *client.SingleDevice) {
+// StartInterfaceClient will create and start a pkg for each broadcast address of the given
+// interface, see BroadcastMode. Interfaces without IPv4 network use 255.255.255.255 .
+func (im *InterfaceManager) StartInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice) {
 	if im.waiting.Load() {
 		panic("cannot add interface while waiting for clients to be done")
 	}
@@ -72,17 +203,28 @@ func (im *InterfaceManager) StartInterfaceClient(ctx context.Context, iface Inte
 		return fmt.Errorf("interface %s already exists", iface), nil
 	}
 
-	broadcastAddr := fmt.Sprintf("255.255.255.255:%d", im.port)
+	prefixes, err := interfacePrefixes(iface)
+	if err != nil {
+		log.Warn().Err(err).Str("iface", iface).Msg("failed to get interface addresses")
+	}
 
-	log.Debug().Str("iface", iface).Str("addr", broadcastAddr).Msg("creating pkg")
+	var clients []client.Client
+	var devices []*client.SingleDevice
+	for _, addr := range broadcastAddrs(prefixes, im.broadcast) {
+		broadcastAddr := netip.AddrPortFrom(addr, im.port).String()
+		log.Debug().Str("iface", iface).Str("addr", broadcastAddr).Msg("creating pkg")
 
-	// now, create a pkg bound to the interface with the address being 255.255.255.255
-	c := client.NewSingleDevice(broadcastAddr, iface, 0xfe)
+		// the pkg is bound to the interface, and receives the answers of all devices
+		c := client.NewDiscoveryClient(broadcastAddr, iface, 0xfe, im.transports)
+		clients = append(clients, c)
+		devices = append(devices, c)
+	}
 
 	clientCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
 	log.Debug().
 		Str("iface", iface).
-		Str("addr", broadcastAddr).
+		Int("clients", len(clients)).
 		Msg("adding pkg")
 	func() {
 		im.mutex.Lock()
@@ -91,43 +233,53 @@ func (im *InterfaceManager) StartInterfaceClient(ctx context.Context, iface Inte
 			im.mutex.Unlock()
 		}()
 
-		im.clients[iface] = c
+		im.clients[iface] = clients
 		im.cancels[iface] = cancel
+		im.dones[iface] = done
 	}()
 
 	im.wg.Add(1)
 	go func() {
+		var wg sync.WaitGroup
+		for _, c := range devices {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				log.Info().
+					Str("iface", iface).
+					Str("addr", c.Address()).
+					Msg("starting pkg")
+				err := c.Run(clientCtx, im.receivedCh)
+				if err != nil {
+					log.Error().Err(err).Msg("error while running pkg")
+				}
+				log.Info().Str("iface", iface).Str("addr", c.Address()).Err(err).Msg("pkg stopped")
+			}()
+		}
+		wg.Wait()
 
-		log.Info().
-			Str("iface", iface).
-			Str("addr", broadcastAddr).
-			Msg("starting pkg")
-		err := c.Run(clientCtx, im.receivedCh)
-
-		// remove the pkg from the hashtables once done
+		// remove the pkgs from the hashtables once done
 		func() {
 			im.mutex.Lock()
 			defer im.mutex.Unlock()
 
 			delete(im.clients, iface)
 			delete(im.cancels, iface)
+			delete(im.dones, iface)
 		}()
+		close(done)
 
 		im.wg.Done()
-		if err != nil {
-			log.Error().Err(err).Msg("error while running pkg")
-		}
-
-		log.Info().Str("iface", iface).Err(err).Msg("pkg stopped")
 	}()
 
-	return nil, c
+	return nil, devices
 }
 
 // CancelInterfaceClient will cancel the pkg for the given interface.
 // The interface pkg will be removed from the list of interfaces once it
 // is done.
-func (im *InterfaceManager) CancelInterfaceClient(iface string) error {
+func (im *InterfaceManager) CancelInterfaceClient(iface InterfaceName) error {
 	if !im.DoesInterfaceExist(iface) {
 		return fmt.Errorf("interface %s does not exist", iface)
 	}
@@ -139,6 +291,29 @@ func (im *InterfaceManager) CancelInterfaceClient(iface string) error {
 	return nil
 }
 
+// RebindInterfaceClient replaces the clients of the given interface, once the old ones are
+// stopped, so that they are bound to the current addresses and broadcast addresses of the
+// interface.
+func (im *InterfaceManager) RebindInterfaceClient(ctx context.Context, iface InterfaceName) (error, []*client.SingleDevice) {
+	im.mutex.RLock()
+	done := im.dones[iface]
+	im.mutex.RUnlock()
+
+	if done != nil {
+		if err := im.CancelInterfaceClient(iface); err != nil {
+			return err, nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err(), nil
+		}
+	}
+
+	log.Info().Str("iface", iface).Msg("rebinding interface")
+	return im.StartInterfaceClient(ctx, iface)
+}
+
 // Wait waits for all clients to be done.
 func (im *InterfaceManager) Wait() {
 	// sanity check to make sure we are not adding or removing clients while waiting
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"ppa-control/lib/client"
+	"testing"
+)
+
+func TestLocalIP(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.10/24"),
+		netip.MustParsePrefix("10.20.0.3/16"),
+	}
+
+	tests := []struct {
+		name     string
+		prefixes []netip.Prefix
+		remote   string
+		expected netip.Addr
+	}{
+		{"first network", prefixes, "192.168.1.77", netip.MustParseAddr("192.168.1.10")},
+		{"second network", prefixes, "10.20.4.1", netip.MustParseAddr("10.20.0.3")},
+		{"no matching network", prefixes, "172.16.0.1", netip.MustParseAddr("192.168.1.10")},
+		{"no address", nil, "172.16.0.1", netip.Addr{}},
+	}
+
+	for _, tt := range tests {
+		if ip := localIP(tt.prefixes, netip.MustParseAddr(tt.remote)); ip != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, ip)
+		}
+	}
+}
+
+func TestBroadcastAddrs(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.10/24"),
+		netip.MustParsePrefix("192.168.1.11/24"),
+		netip.MustParsePrefix("10.20.0.3/20"),
+		netip.MustParsePrefix("172.16.0.1/32"),
+	}
+
+	tests := []struct {
+		name     string
+		prefixes []netip.Prefix
+		mode     BroadcastMode
+		expected string
+	}{
+		{"directed", prefixes, BroadcastDirected, "[192.168.1.255 10.20.15.255]"},
+		{"limited", prefixes, BroadcastLimited, "[255.255.255.255]"},
+		{"both", prefixes, BroadcastBoth, "[192.168.1.255 10.20.15.255 255.255.255.255]"},
+		{"no network", nil, BroadcastDirected, "[255.255.255.255]"},
+		{"point-to-point only", prefixes[3:], BroadcastDirected, "[255.255.255.255]"},
+	}
+
+	for _, tt := range tests {
+		if addrs := fmt.Sprint(broadcastAddrs(tt.prefixes, tt.mode)); addrs != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, addrs)
+		}
+	}
+}
+
+func TestDiscoverySharesTransports(t *testing.T) {
+	tests := []struct {
+		name  string
+		start func(ctx context.Context, opts Options, receivedCh chan client.ReceivedMessage) error
+	}{
+		{"interface clients", func(ctx context.Context, opts Options, receivedCh chan client.ReceivedMessage) error {
+			im := NewInterfaceManager(45005, receivedCh, opts)
+			err, _ := im.StartInterfaceClient(ctx, ScanInterface)
+			return err
+		}},
+		{"scanner", func(ctx context.Context, opts Options, receivedCh chan client.ReceivedMessage) error {
+			s := newScanner(45005, opts.withDefaults())
+			go func() {
+				_ = s.Run(ctx, receivedCh)
+			}()
+			return nil
+		}},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		transports := client.NewTransportPool()
+		opts := Options{
+			Broadcast:  BroadcastBoth,
+			ScanRanges: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+			Transports: transports,
+		}
+		if err := tt.start(ctx, opts, make(chan client.ReceivedMessage, 10)); err != nil {
+			t.Fatalf("%s: failed to start: %v", tt.name, err)
+		}
+		waitFor(t, func() bool { return transports.Len() == 1 })
+
+		cancel()
+		transports.Wait()
+		if transports.Len() != 0 {
+			t.Errorf("%s: expected the transport to be released, got %d", tt.name, transports.Len())
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package discovery
+
+import (
+	"context"
+	"errors"
+)
+
+// watchInterfaces is only implemented on Linux, other platforms poll the interfaces
+func watchInterfaces(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("interface monitoring is not supported on this platform")
+}
@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"fmt"
+	"net/netip"
+	"ppa-control/lib/client"
+	"time"
+)
+
+// Options configures the timing of the discovery. Zero fields use the value of DefaultOptions.
+type Options struct {
+	// PingInterval is the time between two broadcast pings on each interface.
+	// Shorter intervals detect new devices faster, at the cost of more traffic.
+	PingInterval time.Duration
+	// PeerTimeout is the time after which a peer that didn't answer is reported as lost
+	PeerTimeout time.Duration
+	// InterfaceRescanInterval is the time between two scans for added or removed interfaces,
+	// on platforms where interface changes are not monitored or when monitoring failed
+	InterfaceRescanInterval time.Duration
+	// InitialBurstPings is the number of pings sent on a newly added interface,
+	// the first one immediately and the others InitialBurstInterval apart,
+	// so that devices are found before the first PingInterval elapsed.
+	InitialBurstPings    int
+	InitialBurstInterval time.Duration
+	// Broadcast selects the broadcast addresses pings are sent to on each interface
+	Broadcast BroadcastMode
+	// ScanRanges are IPv4 ranges swept with unicast pings, for devices in routed networks
+	// that broadcasts don't reach. A sweep starts PingInterval after the previous one ended,
+	// the peers found are pinged every PingInterval like the others.
+	ScanRanges []netip.Prefix
+	// ScanRate is the maximum number of unicast pings per second sent by the sweep
+	ScanRate int
+	// SkipDeviceData disables the DeviceData queries for peers whose DeviceData is unknown,
+	// for callers that add every peer to a client.MultiClient, which queries it itself.
+	// Peers are then only reported with the info of DeviceData responses seen anyway.
+	SkipDeviceData bool
+	// Transports is the pool the broadcast and scan clients share their sockets with, usually
+	// the one of the client.MultiClient the peers are added to. If nil, each client opens its own.
+	Transports *client.TransportPool
+
+	// Clock is used for all timers and timestamps, tests inject a fake one
+	Clock Clock
+}
+
+// DefaultOptions pings every 5 seconds on the limited broadcast address, loses peers after
+// 30 seconds without an answer, and doesn't sweep any range
+var DefaultOptions = Options{
+	PingInterval:            5 * time.Second,
+	PeerTimeout:             30 * time.Second,
+	InterfaceRescanInterval: 5 * time.Second,
+	InitialBurstPings:       1,
+	InitialBurstInterval:    500 * time.Millisecond,
+	Broadcast:               BroadcastLimited,
+	ScanRate:                50,
+	Clock:                   SystemClock,
+}
+
+// withDefaults returns the options with zero fields set from DefaultOptions
+func (o Options) withDefaults() Options {
+	if o.PingInterval <= 0 {
+		o.PingInterval = DefaultOptions.PingInterval
+	}
+	if o.PeerTimeout <= 0 {
+		o.PeerTimeout = DefaultOptions.PeerTimeout
+	}
+	if o.InterfaceRescanInterval <= 0 {
+		o.InterfaceRescanInterval = DefaultOptions.InterfaceRescanInterval
+	}
+	if o.InitialBurstPings <= 0 {
+		o.InitialBurstPings = DefaultOptions.InitialBurstPings
+	}
+	if o.InitialBurstInterval <= 0 {
+		o.InitialBurstInterval = DefaultOptions.InitialBurstInterval
+	}
+	if o.ScanRate <= 0 {
+		o.ScanRate = DefaultOptions.ScanRate
+	}
+	if o.Clock == nil {
+		o.Clock = DefaultOptions.Clock
+	}
+	return o
+}
+
+// BroadcastMode selects where the discovery pings of an interface are sent
+type BroadcastMode int
+
+const (
+	// BroadcastLimited sends to the limited broadcast address 255.255.255.255,
+	// relying on the socket being bound to the interface to pick the NIC. It is the default.
+	BroadcastLimited BroadcastMode = iota
+	// BroadcastDirected sends to the directed broadcast address of each IPv4 network
+	// of the interface, for example 192.168.1.255 for 192.168.1.10/24. Interfaces without
+	// an IPv4 network fall back to the limited broadcast address.
+	BroadcastDirected
+	// BroadcastBoth sends to the directed and the limited broadcast addresses
+	BroadcastBoth
+)
+
+func (m BroadcastMode) String() string {
+	switch m {
+	case BroadcastLimited:
+		return "limited"
+	case BroadcastDirected:
+		return "directed"
+	case BroadcastBoth:
+		return "both"
+	default:
+		return fmt.Sprintf("BroadcastMode(%d)", int(m))
+	}
+}
+
+// ParseBroadcastMode parses "directed", "limited" or "both"
+func ParseBroadcastMode(s string) (BroadcastMode, error) {
+	for _, m := range []BroadcastMode{BroadcastDirected, BroadcastLimited, BroadcastBoth} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown broadcast mode %q, expected directed, limited or both", s)
+}
+
+// Clock abstracts time, so that the ping, rescan and timeout logic can be tested
+// without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker used by the discovery
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
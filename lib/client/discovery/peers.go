@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"net/netip"
+	"ppa-control/lib/client"
+	"time"
+)
+
+// Peer is a device that answered a discovery ping
+type Peer struct {
+	Addr      string
+	Interface string
+	// LocalIP is the address of the local interface the peer answered on, invalid if unknown
+	LocalIP netip.Addr
+	// DeviceID is the unique id sent by the peer, zero if it didn't send one
+	DeviceID    client.DeviceID
+	ComponentID uint8
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	// HasDeviceData is true once the peer answered a DeviceData request, which fills in DeviceInfo
+	HasDeviceData bool
+	DeviceInfo    client.DeviceInfo
+}
+
+func (p Peer) GetAddress() string {
+	return p.Addr
+}
+
+func (p Peer) GetInterface() string {
+	return p.Interface
+}
+
+func (p Peer) GetDeviceID() client.DeviceID {
+	return p.DeviceID
+}
+
+func (p Peer) GetPeer() Peer {
+	return p
+}
+
+// Name returns the device name of the peer, or its address while its DeviceData is unknown
+func (p Peer) Name() string {
+	if p.HasDeviceData && p.DeviceInfo.Name != "" {
+		return p.DeviceInfo.Name
+	}
+	return p.Addr
+}
+
+// sighting is a message received from a peer
+type sighting struct {
+	addr        string
+	iface       string
+	localIP     netip.Addr
+	deviceId    client.DeviceID
+	componentId uint8
+	// info is set if the message was a DeviceData response
+	info *client.DeviceInfo
+}
+
+// peerTable tracks the discovered peers by their DeviceID, so that a peer that
+// changed its address is reported as moved instead of lost and discovered again.
+// Peers that don't send a unique id are tracked by address.
+type peerTable struct {
+	peers map[string]*Peer
+	// ifaceSeen is when a peer last answered on its recorded interface. A peer that answers
+	// on several interfaces keeps the first one until it stops answering there for timeout.
+	ifaceSeen map[string]time.Time
+	timeout   time.Duration
+}
+
+func newPeerTable(timeout time.Duration) *peerTable {
+	return &peerTable{
+		peers:     make(map[string]*Peer),
+		ifaceSeen: make(map[string]time.Time),
+		timeout:   timeout,
+	}
+}
+
+func peerKey(addr string, deviceId client.DeviceID) string {
+	if deviceId.IsZero() {
+		return addr
+	}
+	return deviceId.String()
+}
+
+// seen records a message from a peer received at now, and returns the PeerDiscovered,
+// PeerMoved or PeerUpdated to emit, or nil if nothing but the LastSeen time changed.
+func (pt *peerTable) seen(s sighting, now time.Time) PeerInformation {
+	key := peerKey(s.addr, s.deviceId)
+	p, ok := pt.peers[key]
+	if !ok {
+		p = &Peer{Addr: s.addr, DeviceID: s.deviceId, FirstSeen: now}
+		pt.peers[key] = p
+	}
+
+	previous := *p
+	if pt.takesInterface(key, p, s, now, ok) {
+		p.Interface = s.iface
+		p.LocalIP = s.localIP
+		pt.ifaceSeen[key] = now
+	}
+	p.ComponentID = s.componentId
+	p.LastSeen = now
+	if s.info != nil {
+		p.HasDeviceData = true
+		p.DeviceInfo = *s.info
+	}
+
+	switch {
+	case !ok:
+		return PeerDiscovered{Peer: *p}
+	case p.Addr != s.addr:
+		p.Addr = s.addr
+		return PeerMoved{Peer: *p, previousAddr: previous.Addr}
+	}
+
+	previous.LastSeen = now
+	if previous != *p {
+		return PeerUpdated{Peer: *p}
+	}
+	return nil
+}
+
+// takesInterface returns true if the interface of s is recorded for p. A peer that also
+// answers on another interface, or to the scanner, keeps its interface until it didn't
+// answer there for timeout, so that its Interface doesn't flip with every reply.
+// Only a scanned peer answering the broadcasts of an interface changes right away.
+func (pt *peerTable) takesInterface(key string, p *Peer, s sighting, now time.Time, known bool) bool {
+	switch {
+	case !known, s.iface == p.Interface:
+		return true
+	case p.Interface == ScanInterface:
+		return true
+	}
+	return now.Sub(pt.ifaceSeen[key]) > pt.timeout
+}
+
+// expire removes the peers not seen for longer than timeout and returns them as PeerLost
+func (pt *peerTable) expire(now time.Time, timeout time.Duration) []PeerLost {
+	var lost []PeerLost
+	for key, p := range pt.peers {
+		if now.Sub(p.LastSeen) > timeout {
+			delete(pt.peers, key)
+			delete(pt.ifaceSeen, key)
+			lost = append(lost, PeerLost{Peer: *p})
+		}
+	}
+	return lost
+}
+
+// withoutDeviceData returns the peers whose DeviceData is unknown
+func (pt *peerTable) withoutDeviceData() []Peer {
+	var peers []Peer
+	for _, p := range pt.peers {
+		if !p.HasDeviceData {
+			peers = append(peers, *p)
+		}
+	}
+	return peers
+}
+
+// scanned returns the addresses of the peers found by sweeping the scan ranges
+func (pt *peerTable) scanned() []string {
+	var addrs []string
+	for _, p := range pt.peers {
+		if p.Interface == ScanInterface {
+			addrs = append(addrs, p.Addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"net/netip"
+	"ppa-control/lib/client"
+	"testing"
+	"time"
+)
+
+func TestPeerTable(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := client.DeviceID{1, 2, 3, 4}
+	localIP := netip.MustParseAddr("10.0.0.1")
+	info := client.DeviceInfo{Name: "Front Left", SerialNumber: 42}
+
+	first := Peer{Addr: "10.0.0.5:5001", Interface: "eth0", LocalIP: localIP, DeviceID: id, ComponentID: 0xff, FirstSeen: start, LastSeen: start}
+	moved := first
+	moved.Addr, moved.LastSeen = "10.0.0.9:5001", start.Add(2*time.Second)
+	updated := moved
+	updated.LastSeen, updated.HasDeviceData, updated.DeviceInfo = start.Add(3*time.Second), true, info
+	renamed := updated
+	renamed.LastSeen, renamed.DeviceInfo.Name = start.Add(5*time.Second), "Front Right"
+
+	tests := []struct {
+		name     string
+		sighting sighting
+		after    time.Duration
+		expected PeerInformation
+	}{
+		{"new peer", sighting{addr: "10.0.0.5:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff}, 0, PeerDiscovered{first}},
+		{"same address", sighting{addr: "10.0.0.5:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff}, time.Second, nil},
+		{"new address", sighting{addr: "10.0.0.9:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff}, 2 * time.Second, PeerMoved{Peer: moved, previousAddr: "10.0.0.5:5001"}},
+		{"device data", sighting{addr: "10.0.0.9:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff, info: &info}, 3 * time.Second, PeerUpdated{updated}},
+		{"device data kept", sighting{addr: "10.0.0.9:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff}, 4 * time.Second, nil},
+		{"new name", sighting{addr: "10.0.0.9:5001", iface: "eth0", localIP: localIP, deviceId: id, componentId: 0xff, info: &client.DeviceInfo{Name: "Front Right", SerialNumber: 42}}, 5 * time.Second, PeerUpdated{renamed}},
+		{"also scanned", sighting{addr: "10.0.0.9:5001", iface: ScanInterface, deviceId: id, componentId: 0xff}, 5 * time.Second, nil},
+		{"scanned peer", sighting{addr: "10.20.0.7:5001", iface: ScanInterface, deviceId: client.DeviceID{5, 6, 7, 8}}, 6 * time.Second, PeerDiscovered{Peer{Addr: "10.20.0.7:5001", DeviceID: client.DeviceID{5, 6, 7, 8}, FirstSeen: start.Add(6 * time.Second), LastSeen: start.Add(6 * time.Second)}}},
+		{"peer without id", sighting{addr: "10.0.0.7:5001", iface: "eth0"}, 3 * time.Second, PeerDiscovered{Peer{Addr: "10.0.0.7:5001", Interface: "eth0", FirstSeen: start.Add(3 * time.Second), LastSeen: start.Add(3 * time.Second)}}},
+		{"other peer without id", sighting{addr: "10.0.0.8:5001", iface: "eth0"}, 6 * time.Second, PeerDiscovered{Peer{Addr: "10.0.0.8:5001", Interface: "eth0", FirstSeen: start.Add(6 * time.Second), LastSeen: start.Add(6 * time.Second)}}},
+	}
+
+	pt := newPeerTable(30 * time.Second)
+	for _, tt := range tests {
+		if info := pt.seen(tt.sighting, start.Add(tt.after)); info != tt.expected {
+			t.Errorf("%s: expected %#v, got %#v", tt.name, tt.expected, info)
+		}
+	}
+
+	if peers := pt.withoutDeviceData(); len(peers) != 3 {
+		t.Errorf("Expected the scanned peer and the peers without id to lack device data, got %v", peers)
+	}
+	if scanned := pt.scanned(); len(scanned) != 1 || scanned[0] != "10.20.0.7:5001" {
+		t.Errorf("Expected only the scanned peer to be pinged by address, got %v", scanned)
+	}
+
+	lost := pt.expire(start.Add(35*time.Second+500*time.Millisecond), 30*time.Second)
+	if len(lost) != 2 {
+		t.Fatalf("Expected the moved peer and the first peer without id to be lost, got %v", lost)
+	}
+	for _, l := range lost {
+		if l.Addr != "10.0.0.9:5001" && l.Addr != "10.0.0.7:5001" {
+			t.Errorf("Unexpected lost peer %s", l.Addr)
+		}
+		if l.Addr == "10.0.0.9:5001" && l.Peer != renamed {
+			t.Errorf("Expected the lost peer to keep its device data, got %#v", l.Peer)
+		}
+	}
+	if len(pt.peers) != 2 {
+		t.Errorf("Expected 2 remaining peers, got %d", len(pt.peers))
+	}
+}
+
+func TestPeerTableKeepsInterface(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := client.DeviceID{1, 2, 3, 4}
+	eth0 := sighting{addr: "10.0.0.5:5001", iface: "eth0", localIP: netip.MustParseAddr("10.0.0.1"), deviceId: id, componentId: 0xff}
+	wlan0 := sighting{addr: "10.0.0.5:5001", iface: "wlan0", localIP: netip.MustParseAddr("10.0.0.2"), deviceId: id, componentId: 0xff}
+	scan := sighting{addr: "10.0.0.5:5001", iface: ScanInterface, deviceId: id, componentId: 0xff}
+
+	tests := []struct {
+		name      string
+		sighting  sighting
+		after     time.Duration
+		iface     string
+		emitsInfo bool
+	}{
+		{"first interface", eth0, 0, "eth0", true},
+		{"second interface", wlan0, time.Second, "eth0", false},
+		{"first interface again", eth0, 2 * time.Second, "eth0", false},
+		{"scanned", scan, 3 * time.Second, "eth0", false},
+		{"second interface while the first answers", wlan0, 31 * time.Second, "eth0", false},
+		{"first interface expired", wlan0, 33 * time.Second, "wlan0", true},
+		{"first interface back", eth0, 34 * time.Second, "wlan0", false},
+	}
+
+	pt := newPeerTable(30 * time.Second)
+	for _, tt := range tests {
+		info := pt.seen(tt.sighting, start.Add(tt.after))
+		if (info != nil) != tt.emitsInfo {
+			t.Errorf("%s: expected an event: %v, got %#v", tt.name, tt.emitsInfo, info)
+		}
+		if p := pt.peers[id.String()]; p.Interface != tt.iface {
+			t.Errorf("%s: expected interface %s, got %s", tt.name, tt.iface, p.Interface)
+		}
+	}
+}
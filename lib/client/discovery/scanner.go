@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"ppa-control/lib/client"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ScanInterface is the interface of the peers found by sweeping Options.ScanRanges.
+// Their packets are routed by the operating system instead of being bound to an interface.
+const ScanInterface InterfaceName = ""
+
+// MaxScanRangeBits is the largest range that can be swept, a /16 has 65534 hosts
+const MaxScanRangeBits = 16
+
+// ParseScanRanges parses CIDR ranges like 10.20.0.0/24, see Options.ScanRanges
+func ParseScanRanges(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkScanRange(p); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func checkScanRange(p netip.Prefix) error {
+	if !p.Addr().Is4() {
+		return fmt.Errorf("scan range %s is not an IPv4 range", p)
+	}
+	if p.Bits() < MaxScanRangeBits {
+		return fmt.Errorf("scan range %s is larger than a /%d", p, MaxScanRangeBits)
+	}
+	return nil
+}
+
+// hosts returns the host addresses of p, without the network and broadcast
+// addresses unless p is a point-to-point network (/31, /32).
+func hosts(p netip.Prefix) []netip.Addr {
+	p = p.Masked()
+	var addrs []netip.Addr
+	for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+		addrs = append(addrs, a)
+	}
+	if p.Bits() < 31 && len(addrs) > 2 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs
+}
+
+// unicastClients sends to single peers, for the peers of the scanned ranges which
+// the broadcasts of the interfaces don't reach. It is implemented by the scanner.
+type unicastClients interface {
+	SendPingTo(ctx context.Context, addr string)
+	SendDeviceDataRequestTo(ctx context.Context, addr string)
+}
+
+// scanner sweeps the scan ranges with unicast pings at a bounded rate, for devices in
+// routed networks. The answers are received by a client that is not bound to an
+// interface, like the broadcast answers of the interface clients.
+type scanner struct {
+	ranges   []netip.Prefix
+	port     uint16
+	rate     int
+	interval time.Duration
+	clock    Clock
+	client   *client.SingleDevice
+}
+
+func newScanner(port uint16, opts Options) *scanner {
+	return &scanner{
+		ranges:   opts.ScanRanges,
+		port:     port,
+		rate:     opts.ScanRate,
+		interval: opts.PingInterval,
+		clock:    opts.Clock,
+		client:   client.NewDiscoveryClient(fmt.Sprintf("0.0.0.0:%d", port), ScanInterface, 0xfe, opts.Transports),
+	}
+}
+
+// Run sweeps the ranges until ctx is done, waiting PingInterval between two sweeps
+func (s *scanner) Run(ctx context.Context, receivedCh chan<- client.ReceivedMessage) error {
+	for _, p := range s.ranges {
+		if err := checkScanRange(p); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.client.Run(ctx, receivedCh)
+	}()
+
+	ticker := s.clock.NewTicker(time.Second / time.Duration(s.rate))
+	defer ticker.Stop()
+	for {
+		for _, p := range s.ranges {
+			log.Debug().Stringer("range", p).Int("rate", s.rate).Msg("sweeping scan range")
+			for _, addr := range hosts(p) {
+				select {
+				case <-ticker.C():
+					s.SendPingTo(ctx, netip.AddrPortFrom(addr, s.port).String())
+				case err := <-done:
+					return err
+				case <-ctx.Done():
+					return <-done
+				}
+			}
+		}
+
+		select {
+		case <-s.clock.After(s.interval):
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return <-done
+		}
+	}
+}
+
+// SendPingTo pings a single peer
+func (s *scanner) SendPingTo(ctx context.Context, addr string) {
+	if err := s.client.SendTo(ctx, client.NewPingRequest(), addr); err != nil {
+		log.Debug().Err(err).Str("addr", addr).Msg("failed to send scan ping")
+	}
+}
+
+// SendDeviceDataRequestTo asks a single peer for its name and serial number
+func (s *scanner) SendDeviceDataRequestTo(ctx context.Context, addr string) {
+	if err := s.client.SendTo(ctx, client.NewDeviceDataRequest(), addr); err != nil {
+		log.Warn().Err(err).Str("addr", addr).Msg("failed to send device data request")
+	}
+}
@@ -0,0 +1,46 @@
+package discovery
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestParseScanRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   []string
+		expected string
+		hosts    int
+		err      bool
+	}{
+		{"subnet", []string{"10.20.0.0/24"}, "[10.20.0.0/24]", 254, false},
+		{"host bits are masked", []string{" 10.20.0.17/28"}, "[10.20.0.16/28]", 14, false},
+		{"single host", []string{"10.20.0.5/32"}, "[10.20.0.5/32]", 1, false},
+		{"point-to-point", []string{"10.20.0.4/31"}, "[10.20.0.4/31]", 2, false},
+		{"too large", []string{"10.0.0.0/8"}, "", 0, true},
+		{"ipv6", []string{"fd00::/120"}, "", 0, true},
+		{"invalid", []string{"10.20.0.0"}, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		ranges, err := ParseScanRanges(tt.ranges)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if s := fmt.Sprint(ranges); s != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, s)
+		}
+		if n := len(hosts(ranges[0])); n != tt.hosts {
+			t.Errorf("%s: expected %d hosts, got %d", tt.name, tt.hosts, n)
+		}
+	}
+
+	if h := hosts(netip.MustParsePrefix("10.20.0.0/30")); fmt.Sprint(h) != "[10.20.0.1 10.20.0.2]" {
+		t.Errorf("Expected the network and broadcast addresses to be skipped, got %v", h)
+	}
+}
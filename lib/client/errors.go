@@ -1,6 +1,11 @@
 package client
 
-import "fmt"
+import (
+	"fmt"
+	"ppa-control/lib/protocol"
+	"sort"
+	"strings"
+)
 
 // ClientError represents base error type for client package
 type ClientError struct {
@@ -54,4 +59,111 @@ func NewClientError(op string, addr string, err error) error {
 		Addr: addr,
 		Err:  err,
 	}
-} 
\ No newline at end of file
+}
+
+// ErrRequestTimeout indicates that a device did not reply to a request in time
+type ErrRequestTimeout struct {
+	Addr           string
+	MessageType    protocol.MessageType
+	SequenceNumber uint16
+	Attempts       int
+}
+
+func (e *ErrRequestTimeout) Error() string {
+	return fmt.Sprintf("no reply from %s to %s request (seq %d) after %d attempt(s)",
+		e.Addr, e.MessageType, e.SequenceNumber, e.Attempts)
+}
+
+// DeviceError is returned when a device replies to a request with StatusErrorServer.
+// The meaning of the error payload is not documented, its first byte is reported as
+// the error code.
+type DeviceError struct {
+	Addr string
+	// Header is the header of the error reply
+	Header *protocol.BasicHeader
+	// Command is the rejected request, nil if it was sent without waiting for the reply
+	Command *Request
+	// Payload is the payload of the error reply, nil if it had none
+	Payload []byte
+}
+
+// NewDeviceError builds the error for the StatusErrorServer reply msg to command, which can be nil
+func NewDeviceError(addr string, msg ReceivedMessage, command *Request) *DeviceError {
+	e := &DeviceError{Addr: addr, Header: msg.Header, Command: command}
+	if raw, ok := msg.Body.(*protocol.RawPayload); ok && len(*raw) > 0 {
+		e.Payload = []byte(*raw)
+	}
+	return e
+}
+
+// Code returns the first byte of the error payload, if there is one
+func (e *DeviceError) Code() (uint8, bool) {
+	if len(e.Payload) == 0 {
+		return 0, false
+	}
+	return e.Payload[0], true
+}
+
+func (e *DeviceError) Error() string {
+	msg := fmt.Sprintf("%s rejected %s request (seq %d)", e.Addr, e.Header.MessageType, e.Header.SequenceNumber)
+	if code, ok := e.Code(); ok {
+		msg += fmt.Sprintf(" with code %#02x", code)
+	}
+	return msg
+}
+
+// ErrQueueFull indicates that the send queue of a client stayed full until the context was done
+type ErrQueueFull struct {
+	Addr     string
+	Capacity int
+	Err      error
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("send queue of %s is full (capacity %d): %v", e.Addr, e.Capacity, e.Err)
+}
+
+func (e *ErrQueueFull) Unwrap() error {
+	return e.Err
+}
+
+// ErrClientStopped indicates that a command was sent to a client that is no longer running
+type ErrClientStopped struct {
+	Addr string
+}
+
+func (e *ErrClientStopped) Error() string {
+	return fmt.Sprintf("client for %s is stopped", e.Addr)
+}
+
+// ErrDevicesFailed aggregates the errors of the devices of a MultiClient a command failed for.
+// Errors maps the address of each failed device to its error.
+type ErrDevicesFailed struct {
+	Errors map[string]error
+}
+
+func (e *ErrDevicesFailed) addrs() []string {
+	addrs := make([]string, 0, len(e.Errors))
+	for addr := range e.Errors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (e *ErrDevicesFailed) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, addr := range e.addrs() {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", addr, e.Errors[addr]))
+	}
+	return fmt.Sprintf("%d device(s) failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of all devices, so that errors.Is and errors.As look at each of them
+func (e *ErrDevicesFailed) Unwrap() []error {
+	ret := make([]error, 0, len(e.Errors))
+	for _, addr := range e.addrs() {
+		ret = append(ret, e.Errors[addr])
+	}
+	return ret
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"net"
+	"ppa-control/lib/protocol"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+//go:generate go run golang.org/x/tools/cmd/stringer -type=EventType
+
+// EventType identifies the kind of an Event, to filter subscriptions
+type EventType uint8
+
+const (
+	EventDeviceOnline EventType = iota
+	EventDeviceOffline
+	EventMessageReceived
+	EventCommandAcked
+	EventCommandFailed
+	EventStateChanged
+	EventUnknownPacket
+	EventDeviceMoved
+	EventDeviceInfoReceived
+)
+
+// Event is published by a MultiClient on its EventBus
+type Event interface {
+	Type() EventType
+	GetAddress() string
+	GetTime() time.Time
+}
+
+// EventInfo holds the fields common to all events
+type EventInfo struct {
+	Addr string
+	Time time.Time
+}
+
+func newEventInfo(addr string) EventInfo {
+	return EventInfo{Addr: addr, Time: time.Now()}
+}
+
+func (e EventInfo) GetAddress() string {
+	return e.Addr
+}
+
+func (e EventInfo) GetTime() time.Time {
+	return e.Time
+}
+
+// DeviceOnline is published when a client for a device has been added and can receive commands
+type DeviceOnline struct {
+	EventInfo
+	Interface string
+	Client    Client
+}
+
+// DeviceOffline is published when the client for a device stopped. Err is set if it stopped with an error.
+type DeviceOffline struct {
+	EventInfo
+	Interface string
+	Err       error
+}
+
+// DeviceMoved is published when the client of a device changed its address from From to Addr,
+// keeping its state. See MultiClient.MoveClient.
+type DeviceMoved struct {
+	EventInfo
+	From string
+}
+
+// DeviceInfoReceived is published when a device answered the DeviceData query
+// sent when its client was added
+type DeviceInfoReceived struct {
+	EventInfo
+	Info DeviceInfo
+}
+
+// MessageReceived is published for every message with a valid header received from a device
+type MessageReceived struct {
+	EventInfo
+	Message ReceivedMessage
+}
+
+// CommandAcked is published when a device replies to a command with StatusResponseServer
+type CommandAcked struct {
+	EventInfo
+	Header *protocol.BasicHeader
+}
+
+// CommandFailed is published when a device replies with StatusErrorServer,
+// or when a command could not be sent or was not acknowledged.
+// Header is nil if no reply was received.
+type CommandFailed struct {
+	EventInfo
+	Header *protocol.BasicHeader
+	Err    error
+}
+
+// StateChanged is published with a snapshot of a device state every time it changes
+type StateChanged struct {
+	EventInfo
+	State DeviceState
+}
+
+// UnknownPacket is published for packets whose header could not be decoded
+type UnknownPacket struct {
+	EventInfo
+	RemoteAddress net.Addr
+	Data          []byte
+	Err           error
+}
+
+func (DeviceOnline) Type() EventType       { return EventDeviceOnline }
+func (DeviceOffline) Type() EventType      { return EventDeviceOffline }
+func (MessageReceived) Type() EventType    { return EventMessageReceived }
+func (CommandAcked) Type() EventType       { return EventCommandAcked }
+func (CommandFailed) Type() EventType      { return EventCommandFailed }
+func (StateChanged) Type() EventType       { return EventStateChanged }
+func (UnknownPacket) Type() EventType      { return EventUnknownPacket }
+func (DeviceMoved) Type() EventType        { return EventDeviceMoved }
+func (DeviceInfoReceived) Type() EventType { return EventDeviceInfoReceived }
+
+// EventFilter returns true for the events a subscriber wants to receive
+type EventFilter func(e Event) bool
+
+// FilterTypes accepts events of the given types
+func FilterTypes(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type() == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilterAddress accepts events of the device at addr
+func FilterAddress(addr string) EventFilter {
+	return func(e Event) bool {
+		return e.GetAddress() == addr
+	}
+}
+
+// DropPolicy decides which event is discarded when a subscriber buffer is full
+type DropPolicy int
+
+const (
+	// DropNewest discards the event being published
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for the new one
+	DropOldest
+)
+
+// DefaultEventBuffer is the buffer size of subscriptions that don't set one
+const DefaultEventBuffer = 32
+
+// SubscribeOptions configures a Subscription. All filters have to accept an event for it to be delivered.
+type SubscribeOptions struct {
+	Buffer  int
+	Policy  DropPolicy
+	Filters []EventFilter
+}
+
+// Subscription delivers the events of an EventBus on C. C is closed
+// when the subscription is cancelled or the bus is closed.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	bus     *EventBus
+	options SubscribeOptions
+	mutex   sync.Mutex
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops the delivery of events and closes C
+func (s *Subscription) Unsubscribe() {
+	s.bus.unsubscribe(s)
+}
+
+func (s *Subscription) accepts(e Event) bool {
+	for _, filter := range s.options.Filters {
+		if !filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver hands e to the subscriber without ever blocking
+func (s *Subscription) deliver(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case s.ch <- e:
+		return
+	default:
+	}
+
+	s.dropped.Inc()
+	if s.options.Policy != DropOldest {
+		return
+	}
+
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- e:
+	default:
+	}
+}
+
+// EventBus fans events out to subscribers. Publishing never blocks:
+// events that don't fit in a subscriber buffer are dropped according to its DropPolicy.
+type EventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (b *EventBus) Subscribe(options SubscribeOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultEventBuffer
+	}
+
+	ch := make(chan Event, options.Buffer)
+	s := &Subscription{
+		C:       ch,
+		ch:      ch,
+		bus:     b,
+		options: options,
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+func (b *EventBus) unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for s := range b.subscribers {
+		if s.accepts(e) {
+			s.deliver(e)
+		}
+	}
+}
+
+// Close closes all subscriptions. Later subscriptions are closed immediately.
+func (b *EventBus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
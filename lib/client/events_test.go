@@ -0,0 +1,68 @@
+package client
+
+import "testing"
+
+func TestEventBusFiltersAndDropPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  SubscribeOptions
+		events   []Event
+		expected []string
+		dropped  uint64
+	}{
+		{
+			name:     "filter by type",
+			options:  SubscribeOptions{Filters: []EventFilter{FilterTypes(EventDeviceOnline)}},
+			events:   []Event{DeviceOffline{EventInfo: EventInfo{Addr: "a"}}, DeviceOnline{EventInfo: EventInfo{Addr: "b"}}},
+			expected: []string{"b"},
+		},
+		{
+			name:     "filter by address",
+			options:  SubscribeOptions{Filters: []EventFilter{FilterAddress("b")}},
+			events:   []Event{DeviceOnline{EventInfo: EventInfo{Addr: "a"}}, DeviceOffline{EventInfo: EventInfo{Addr: "b"}}},
+			expected: []string{"b"},
+		},
+		{
+			name:     "drop newest",
+			options:  SubscribeOptions{Buffer: 2, Policy: DropNewest},
+			events:   []Event{DeviceOnline{EventInfo: EventInfo{Addr: "a"}}, DeviceOnline{EventInfo: EventInfo{Addr: "b"}}, DeviceOnline{EventInfo: EventInfo{Addr: "c"}}},
+			expected: []string{"a", "b"},
+			dropped:  1,
+		},
+		{
+			name:     "drop oldest",
+			options:  SubscribeOptions{Buffer: 2, Policy: DropOldest},
+			events:   []Event{DeviceOnline{EventInfo: EventInfo{Addr: "a"}}, DeviceOnline{EventInfo: EventInfo{Addr: "b"}}, DeviceOnline{EventInfo: EventInfo{Addr: "c"}}},
+			expected: []string{"b", "c"},
+			dropped:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewEventBus()
+			sub := bus.Subscribe(tt.options)
+			for _, e := range tt.events {
+				bus.Publish(e)
+			}
+			bus.Close()
+
+			var received []string
+			for e := range sub.C {
+				received = append(received, e.GetAddress())
+			}
+			if len(received) != len(tt.expected) {
+				t.Fatalf("Expected events %v, got %v", tt.expected, received)
+			}
+			for i := range received {
+				if received[i] != tt.expected[i] {
+					t.Errorf("Expected events %v, got %v", tt.expected, received)
+					break
+				}
+			}
+			if sub.Dropped() != tt.dropped {
+				t.Errorf("Expected %d dropped events, got %d", tt.dropped, sub.Dropped())
+			}
+		})
+	}
+}
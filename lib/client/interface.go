@@ -2,18 +2,68 @@ package client
 
 import (
 	"context"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
 )
 
 // Commander defines the command-sending capabilities of a client
 type Commander interface {
 	SendPing()
 	SendPresetRecallByPresetIndex(index int)
+	SendPresetRecallByPresetPosition(position int)
+	SendPresetSave(index int, name string)
 	SendMasterVolume(volume float32)
+
+	// Live control of the parameters addressed by protocol.Path.
+	// Channels are inputs or outputs (protocol.Input(0), protocol.Output(1)),
+	// EQ bands are paths like protocol.Input(0).Eq(2).
+	SendLiveCmd(lc *protocol.LiveCmd)
+	SendGain(channel protocol.Path, db float32)
+	SendMute(channel protocol.Path, muted bool)
+	SendDelay(channel protocol.Path, ms float32)
+	SendPhaseInversion(channel protocol.Path, inverted bool)
+	SendEqType(eq protocol.Path, eqType units.EqType)
+	SendEqQuality(eq protocol.Path, q float32)
+	SendEqActive(eq protocol.Path, active bool)
+}
+
+// CommanderV2 defines the command-sending capabilities of a client, reporting errors
+// instead of logging them. The methods return once the command is queued for sending,
+// use a Requester to wait for the device to acknowledge it.
+//
+// Errors are request construction errors (invalid paths, out of range values),
+// encoding errors, *ErrQueueFull, *ErrClientStopped and, for a MultiClient,
+// *ErrDevicesFailed with the error of each device.
+type CommanderV2 interface {
+	Send(ctx context.Context, req Request) error
+	Ping(ctx context.Context) error
+	RecallPreset(ctx context.Context, index int) error
+	RecallPresetByPosition(ctx context.Context, position int) error
+	SavePreset(ctx context.Context, index int, name string) error
+	SetMasterVolume(ctx context.Context, volume float32) error
+	SetGain(ctx context.Context, channel protocol.Path, db float32) error
+	SetMute(ctx context.Context, channel protocol.Path, muted bool) error
+	SetDelay(ctx context.Context, channel protocol.Path, ms float32) error
+	SetPhaseInversion(ctx context.Context, channel protocol.Path, inverted bool) error
+	SetEqType(ctx context.Context, eq protocol.Path, eqType units.EqType) error
+	SetEqQuality(ctx context.Context, eq protocol.Path, q float32) error
+	SetEqActive(ctx context.Context, eq protocol.Path, active bool) error
+}
+
+// Requester defines the capability of sending a request and waiting for the device to reply
+type Requester interface {
+	SendAndWait(ctx context.Context, req Request) (*Reply, error)
+	SendWithRetry(ctx context.Context, req Request, policy RetryPolicy) (*Reply, error)
 }
 
 // Client extends Commander with lifecycle management
 type Client interface {
 	Commander
+	CommanderV2
 	Run(ctx context.Context, receivedCh chan<- ReceivedMessage) error
 	Name() string
 }
+
+var _ Client = &SingleDevice{}
+var _ Requester = &SingleDevice{}
+var _ Client = &MultiClient{}
@@ -2,12 +2,17 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/rs/zerolog/log"
 	"go.uber.org/atomic"
+	"golang.org/x/sync/errgroup"
 )
 
 type MultiClient struct {
@@ -22,52 +27,297 @@ type MultiClient struct {
 	receivedCh chan ReceivedMessage
 	errorCh    chan error // Channel for error propagation
 
+	states *stateStore
+	events *EventBus
+
+	// transports shares one socket per interface between all clients
+	transports *TransportPool
+
 	waiting atomic.Bool
 }
 
 func NewMultiClient(name string) *MultiClient {
+	events := NewEventBus()
 	return &MultiClient{
 		name:       name,
 		clients:    make(map[string]Client),
 		cancels:    make(map[string]context.CancelFunc),
 		receivedCh: make(chan ReceivedMessage, 10),
 		errorCh:    make(chan error, 10), // Buffer for errors
+		states: newStateStore(func(s DeviceState) {
+			events.Publish(StateChanged{EventInfo: newEventInfo(s.Addr), State: s})
+		}),
+		events:     events,
+		transports: NewTransportPool(),
 		waiting:    *atomic.NewBool(false),
 	}
 }
 
 // Commander interface implementation
 func (mc *MultiClient) SendPing() {
+	mc.sendToAll("ping", func(c Client) { c.SendPing() })
+}
+
+func (mc *MultiClient) SendPresetRecallByPresetIndex(index int) {
+	mc.sendToAll("preset recall", func(c Client) { c.SendPresetRecallByPresetIndex(index) })
+}
+
+func (mc *MultiClient) SendPresetRecallByPresetPosition(position int) {
+	mc.sendToAll("preset recall", func(c Client) { c.SendPresetRecallByPresetPosition(position) })
+}
+
+func (mc *MultiClient) SendPresetSave(index int, name string) {
+	mc.sendToAll("preset save", func(c Client) { c.SendPresetSave(index, name) })
+}
+
+func (mc *MultiClient) SendMasterVolume(volume float32) {
+	mc.sendToAll("master volume", func(c Client) { c.SendMasterVolume(volume) })
+}
+
+func (mc *MultiClient) SendLiveCmd(lc *protocol.LiveCmd) {
+	mc.sendToAll("live command", func(c Client) { c.SendLiveCmd(lc) })
+}
+
+func (mc *MultiClient) SendGain(channel protocol.Path, db float32) {
+	mc.sendToAll("gain", func(c Client) { c.SendGain(channel, db) })
+}
+
+func (mc *MultiClient) SendMute(channel protocol.Path, muted bool) {
+	mc.sendToAll("mute", func(c Client) { c.SendMute(channel, muted) })
+}
+
+func (mc *MultiClient) SendDelay(channel protocol.Path, ms float32) {
+	mc.sendToAll("delay", func(c Client) { c.SendDelay(channel, ms) })
+}
+
+func (mc *MultiClient) SendPhaseInversion(channel protocol.Path, inverted bool) {
+	mc.sendToAll("phase inversion", func(c Client) { c.SendPhaseInversion(channel, inverted) })
+}
+
+func (mc *MultiClient) SendEqType(eq protocol.Path, eqType units.EqType) {
+	mc.sendToAll("eq type", func(c Client) { c.SendEqType(eq, eqType) })
+}
+
+func (mc *MultiClient) SendEqQuality(eq protocol.Path, q float32) {
+	mc.sendToAll("eq quality", func(c Client) { c.SendEqQuality(eq, q) })
+}
+
+func (mc *MultiClient) SendEqActive(eq protocol.Path, active bool) {
+	mc.sendToAll("eq active", func(c Client) { c.SendEqActive(eq, active) })
+}
+
+// sendToAll calls send for every client, logging failures
+func (mc *MultiClient) sendToAll(what string, send func(c Client)) {
 	mc.mutex.RLock()
 	defer mc.mutex.RUnlock()
 
 	for addr, c := range mc.clients {
-		if err := mc.safeSend(addr, c.SendPing); err != nil {
-			log.Error().Err(err).Str("addr", addr).Msg("failed to send ping")
+		if err := mc.safeSend(addr, func() { send(c) }); err != nil {
+			log.Error().Err(err).Str("addr", addr).Msgf("failed to send %s", what)
 		}
 	}
 }
 
-func (mc *MultiClient) SendPresetRecallByPresetIndex(index int) {
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+// CommanderV2 interface implementation
 
-	for addr, c := range mc.clients {
-		if err := mc.safeSend(addr, func() { c.SendPresetRecallByPresetIndex(index) }); err != nil {
-			log.Error().Err(err).Str("addr", addr).Msg("failed to send preset recall")
-		}
+// Send queues req on all clients concurrently. The errors of the devices
+// it could not be queued on are returned as an *ErrDevicesFailed.
+func (mc *MultiClient) Send(ctx context.Context, req Request) error {
+	if mc.waiting.Load() {
+		return &ErrClientBusy{Operation: "shutdown"}
+	}
+
+	clients := mc.Clients()
+
+	var errorsMutex sync.Mutex
+	errs := make(map[string]error)
+
+	grp := errgroup.Group{}
+	for addr, c := range clients {
+		addr, c := addr, c
+		grp.Go(func() error {
+			if err := c.Send(ctx, req); err != nil {
+				errorsMutex.Lock()
+				defer errorsMutex.Unlock()
+				errs[addr] = err
+			}
+			return nil
+		})
+	}
+	_ = grp.Wait()
+
+	if len(errs) > 0 {
+		return &ErrDevicesFailed{Errors: errs}
 	}
+	return nil
 }
 
-func (mc *MultiClient) SendMasterVolume(volume float32) {
+// sendBuilt sends a request returned by one of the request constructors,
+// returning the constructor error if there is one.
+func (mc *MultiClient) sendBuilt(ctx context.Context, req Request, err error) error {
+	if err != nil {
+		return err
+	}
+	return mc.Send(ctx, req)
+}
+
+func (mc *MultiClient) Ping(ctx context.Context) error {
+	return mc.Send(ctx, NewPingRequest())
+}
+
+func (mc *MultiClient) RecallPreset(ctx context.Context, index int) error {
+	req, err := NewPresetRecallByPresetIndexRequest(index)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) RecallPresetByPosition(ctx context.Context, position int) error {
+	req, err := NewPresetRecallByPresetPositionRequest(position)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SavePreset(ctx context.Context, index int, name string) error {
+	req, err := NewPresetSaveRequest(index, name)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetMasterVolume(ctx context.Context, volume float32) error {
+	req, err := NewMasterVolumeRequest(volume)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetGain(ctx context.Context, channel protocol.Path, db float32) error {
+	req, err := NewGainRequest(channel, db)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetMute(ctx context.Context, channel protocol.Path, muted bool) error {
+	req, err := NewMuteRequest(channel, muted)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetDelay(ctx context.Context, channel protocol.Path, ms float32) error {
+	req, err := NewDelayRequest(channel, ms)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetPhaseInversion(ctx context.Context, channel protocol.Path, inverted bool) error {
+	req, err := NewPhaseInversionRequest(channel, inverted)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetEqType(ctx context.Context, eq protocol.Path, eqType units.EqType) error {
+	req, err := NewEqTypeRequest(eq, eqType)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetEqQuality(ctx context.Context, eq protocol.Path, q float32) error {
+	req, err := NewEqQualityRequest(eq, q)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+func (mc *MultiClient) SetEqActive(ctx context.Context, eq protocol.Path, active bool) error {
+	req, err := NewEqActiveRequest(eq, active)
+	return mc.sendBuilt(ctx, req, err)
+}
+
+// Clients returns a copy of the current clients by address, including the broadcast
+// clients, which have no DeviceState. The copy can be used without holding the lock.
+func (mc *MultiClient) Clients() map[string]Client {
 	mc.mutex.RLock()
 	defer mc.mutex.RUnlock()
 
+	clients := make(map[string]Client, len(mc.clients))
 	for addr, c := range mc.clients {
-		if err := mc.safeSend(addr, func() { c.SendMasterVolume(volume) }); err != nil {
-			log.Error().Err(err).Str("addr", addr).Msg("failed to send master volume")
-		}
+		clients[addr] = c
+	}
+	return clients
+}
+
+// Transports returns the pool of transports shared by the clients, so that the clients of
+// the discovery can share them too, see discovery.Options.Transports.
+func (mc *MultiClient) Transports() *TransportPool {
+	return mc.transports
+}
+
+// DeviceState returns a snapshot of the state of the device at addr
+func (mc *MultiClient) DeviceState(addr string) (DeviceState, bool) {
+	return mc.states.get(addr)
+}
+
+// DeviceStates returns a snapshot of the state of all devices, sorted by address
+func (mc *MultiClient) DeviceStates() []DeviceState {
+	return mc.states.all()
+}
+
+// Subscribe returns a subscription to the events of all devices.
+// The subscription is closed when Run returns.
+func (mc *MultiClient) Subscribe(options SubscribeOptions) *Subscription {
+	return mc.events.Subscribe(options)
+}
+
+// Result is the outcome of a request sent to one of the clients of a MultiClient
+type Result struct {
+	Addr  string
+	Reply *Reply
+	Err   error
+	// Broadcast is set if Addr is a broadcast address. The request was sent once without
+	// waiting for a reply, as it reaches any number of devices, see SendWithRetry.
+	Broadcast bool
+}
+
+// SendWithRetry sends req to all clients concurrently, retrying according to policy,
+// and returns the outcome for each device once all of them replied or gave up.
+// Requests to broadcast clients are done once sent, the replies of the devices they
+// reach can't be told apart from the replies to other requests.
+func (mc *MultiClient) SendWithRetry(ctx context.Context, req Request, policy RetryPolicy) []Result {
+	clients := mc.Clients()
+
+	var resultsMutex sync.Mutex
+	results := make([]Result, 0, len(clients))
+
+	grp := errgroup.Group{}
+	for addr, c := range clients {
+		addr, c := addr, c
+		grp.Go(func() error {
+			result := sendWithRetry(ctx, addr, c, req, policy)
+
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			results = append(results, result)
+			return nil
+		})
+	}
+	_ = grp.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Addr < results[j].Addr
+	})
+	return results
+}
+
+// SendWithRetryTo sends req to the client of addr, retrying according to policy,
+// see SendWithRetry.
+func (mc *MultiClient) SendWithRetryTo(ctx context.Context, addr string, req Request, policy RetryPolicy) Result {
+	c, ok := mc.Client(addr)
+	if !ok {
+		return Result{Addr: addr, Err: &ErrClientNotFound{Addr: addr}}
+	}
+	return sendWithRetry(ctx, addr, c, req, policy)
+}
+
+func sendWithRetry(ctx context.Context, addr string, c Client, req Request, policy RetryPolicy) Result {
+	result := Result{Addr: addr}
+	if IsBroadcast(c) {
+		result.Broadcast = true
+		result.Err = c.Send(ctx, req)
+		return result
+	}
+	if r, ok := c.(Requester); ok {
+		result.Reply, result.Err = r.SendWithRetry(ctx, req, policy)
+	} else {
+		result.Err = NewClientError("request", addr, fmt.Errorf("%s does not support requests", c.Name()))
 	}
+	return result
 }
 
 // safeSend executes a send operation safely and returns any error
@@ -90,6 +340,15 @@ func (mc *MultiClient) DoesClientExist(addr string) bool {
 	return exists
 }
 
+// Client returns the client of the device at addr
+func (mc *MultiClient) Client(addr string) (Client, bool) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	c, ok := mc.clients[addr]
+	return c, ok
+}
+
 func (mc *MultiClient) AddClient(ctx context.Context, addrPort string, iface string, componentId uint) (Client, error) {
 	if mc.waiting.Load() {
 		return nil, &ErrClientBusy{Operation: "shutdown"}
@@ -101,18 +360,50 @@ func (mc *MultiClient) AddClient(ctx context.Context, addrPort string, iface str
 		Str("addrPort", addrPort).
 		Msg("adding client")
 
-	if mc.DoesClientExist(addrPort) {
-		return nil, &ErrClientExists{Addr: addrPort}
+	broadcast, err := isBroadcastAddress(addrPort)
+	if err != nil {
+		return nil, NewClientError("resolve", addrPort, err)
 	}
 
+	// the hooks use the current address of the client, as it changes when the device moves
 	c := NewSingleDevice(addrPort, iface, componentId)
+	c.broadcast = broadcast
+	c.transports = mc.transports
+	c.onSent = func(req Request) {
+		mc.states.updateExisting(c.Address(), func(s *DeviceState) bool {
+			return s.applyRequest(req)
+		})
+	}
+	c.onFailed = func(req Request, err error) {
+		e := CommandFailed{EventInfo: newEventInfo(c.Address()), Err: err}
+		var deviceErr *DeviceError
+		if errors.As(err, &deviceErr) {
+			e.Header = deviceErr.Header
+		}
+		mc.events.Publish(e)
+	}
+
+	// the check and the insert share the lock, so that concurrent calls for the same
+	// address, like discovery and --addresses, don't both start a client
 	clientCtx, cancel := context.WithCancel(ctx)
-	func() {
+	err = func() error {
 		mc.mutex.Lock()
 		defer mc.mutex.Unlock()
+		if _, exists := mc.clients[addrPort]; exists {
+			return &ErrClientExists{Addr: addrPort}
+		}
 		mc.clients[addrPort] = c
 		mc.cancels[addrPort] = cancel
+		// broadcast clients reach many devices, so they have no state or device info
+		if !broadcast {
+			mc.states.update(addrPort, func(s *DeviceState) bool { return true })
+		}
+		return nil
 	}()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
 	mc.wg.Add(1)
 	go func() {
@@ -124,7 +415,9 @@ func (mc *MultiClient) AddClient(ctx context.Context, addrPort string, iface str
 			Str("addrPort", addrPort).
 			Msg("starting client")
 
-		if err := c.Run(clientCtx, mc.receivedCh); err != nil {
+		err := c.Run(clientCtx, mc.receivedCh)
+		addrPort := c.Address()
+		if err != nil {
 			mc.errorCh <- NewClientError("run", addrPort, err)
 			log.Error().
 				Str("name", mc.name).
@@ -143,14 +436,57 @@ func (mc *MultiClient) AddClient(ctx context.Context, addrPort string, iface str
 		func() {
 			mc.mutex.Lock()
 			defer mc.mutex.Unlock()
+			addrPort = c.Address()
 			delete(mc.clients, addrPort)
 			delete(mc.cancels, addrPort)
+			mc.states.remove(addrPort)
 		}()
+
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		mc.events.Publish(DeviceOffline{EventInfo: newEventInfo(addrPort), Interface: iface, Err: err})
 	}()
 
+	mc.events.Publish(DeviceOnline{EventInfo: newEventInfo(addrPort), Interface: iface, Client: c})
+
+	if !broadcast {
+		mc.wg.Add(1)
+		go func() {
+			defer mc.wg.Done()
+			mc.queryDeviceInfo(clientCtx, c)
+		}()
+	}
+
 	return c, nil
 }
 
+// queryDeviceInfo asks the device of c for its DeviceData, retrying with DeviceInfoRetryPolicy.
+// The response updates the device state, and is then published as a DeviceInfoReceived event.
+func (mc *MultiClient) queryDeviceInfo(ctx context.Context, c *SingleDevice) {
+	info, err := c.QueryDeviceInfo(ctx, DeviceInfoRetryPolicy)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn().
+				Str("name", mc.name).
+				Str("addrPort", c.Address()).
+				Err(err).
+				Msg("device did not send its device info")
+		}
+		return
+	}
+	log.Info().
+		Str("name", mc.name).
+		Str("addrPort", c.Address()).
+		Str("device", info.Name).
+		Uint16("serial", info.SerialNumber).
+		Msg("received device info")
+	mc.states.updateExisting(c.Address(), func(s *DeviceState) bool {
+		return s.applyDeviceInfo(info)
+	})
+	mc.events.Publish(DeviceInfoReceived{EventInfo: newEventInfo(c.Address()), Info: info})
+}
+
 func (mc *MultiClient) CancelClient(addr string) error {
 	if mc.waiting.Load() {
 		return &ErrClientBusy{Operation: "shutdown"}
@@ -175,6 +511,50 @@ func (mc *MultiClient) CancelClient(addr string) error {
 	return &ErrClientNotFound{Addr: addr}
 }
 
+// MoveClient changes the address of the client at from to to, keeping the client,
+// its device state and its pending requests. It is used when a device got a new
+// address, see discovery.PeerMoved. The client keeps using its interface.
+func (mc *MultiClient) MoveClient(from string, to string) error {
+	if mc.waiting.Load() {
+		return &ErrClientBusy{Operation: "shutdown"}
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	c, ok := mc.clients[from]
+	if !ok {
+		return &ErrClientNotFound{Addr: from}
+	}
+	if _, exists := mc.clients[to]; exists {
+		return &ErrClientExists{Addr: to}
+	}
+	sd, ok := c.(*SingleDevice)
+	if !ok {
+		return NewClientError("move", from, fmt.Errorf("%s can't change its address", c.Name()))
+	}
+	if err := sd.SetAddress(to); err != nil {
+		return err
+	}
+
+	mc.clients[to] = c
+	mc.cancels[to] = mc.cancels[from]
+	delete(mc.clients, from)
+	delete(mc.cancels, from)
+	mc.states.move(from, to)
+
+	log.Info().
+		Str("name", mc.name).
+		Str("from", from).
+		Str("to", to).
+		Msg("client moved")
+	mc.events.Publish(DeviceMoved{EventInfo: newEventInfo(to), From: from})
+
+	return nil
+}
+
+// Run runs the MultiClient until ctx is done, then stops all clients.
+// Received messages are forwarded to receivedCh, which can be nil when using Subscribe.
 func (mc *MultiClient) Run(ctx context.Context, receivedCh chan<- ReceivedMessage) (err error) {
 	// Error handling goroutine
 	go func() {
@@ -187,10 +567,14 @@ func (mc *MultiClient) Run(ctx context.Context, receivedCh chan<- ReceivedMessag
 	for {
 		select {
 		case m := <-mc.receivedCh:
-			select {
-			case receivedCh <- m:
-			case <-ctx.Done():
-				return ctx.Err()
+			mc.handleReceivedMessage(m)
+
+			if receivedCh != nil {
+				select {
+				case receivedCh <- m:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 
 		case <-ctx.Done():
@@ -209,7 +593,9 @@ func (mc *MultiClient) Run(ctx context.Context, receivedCh chan<- ReceivedMessag
 			}()
 
 			mc.wg.Wait()
+			mc.transports.Wait()
 			close(mc.errorCh) // Close error channel after all clients are done
+			mc.events.Close()
 
 			log.Debug().
 				Str("name", mc.name).
@@ -220,6 +606,37 @@ func (mc *MultiClient) Run(ctx context.Context, receivedCh chan<- ReceivedMessag
 	}
 }
 
+// handleReceivedMessage updates the device state from m and publishes the matching events.
+// Messages received by a broadcast client come from devices without a client of their own,
+// they are published with the address of the sender and don't update any state.
+func (mc *MultiClient) handleReceivedMessage(m ReceivedMessage) {
+	addr := ""
+	if c, ok := m.Client.(*SingleDevice); ok {
+		if c.broadcast {
+			if m.RemoteAddress != nil {
+				addr = m.RemoteAddress.String()
+			}
+		} else {
+			addr = c.Address()
+			mc.states.updateExisting(addr, func(s *DeviceState) bool {
+				return s.applyMessage(m)
+			})
+		}
+	}
+
+	info := newEventInfo(addr)
+	if m.Header == nil {
+		mc.events.Publish(UnknownPacket{EventInfo: info, RemoteAddress: m.RemoteAddress, Data: m.Data})
+		return
+	}
+
+	mc.events.Publish(MessageReceived{EventInfo: info, Message: m})
+	// error replies are published as CommandFailed by the client, see SingleDevice.onFailed
+	if m.Header.Status == protocol.StatusResponseServer {
+		mc.events.Publish(CommandAcked{EventInfo: info, Header: m.Header})
+	}
+}
+
 func (mc *MultiClient) Name() string {
 	var names []string
 	for _, c := range mc.clients {
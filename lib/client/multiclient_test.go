@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"ppa-control/lib/protocol"
+	"testing"
+	"time"
+)
+
+func TestMultiClientMoveClientKeepsState(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mc := NewMultiClient("test")
+	events := mc.Subscribe(SubscribeOptions{Filters: []EventFilter{FilterTypes(EventDeviceMoved)}})
+
+	c, err := mc.AddClient(ctx, "127.0.0.1:45001", "", 0xff)
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	mc.states.update("127.0.0.1:45001", func(s *DeviceState) bool {
+		s.Preset = 4
+		return true
+	})
+
+	if err := mc.MoveClient("127.0.0.1:45001", "127.0.0.1:45002"); err != nil {
+		t.Fatalf("Failed to move client: %v", err)
+	}
+
+	if mc.DoesClientExist("127.0.0.1:45001") || !mc.DoesClientExist("127.0.0.1:45002") {
+		t.Error("Expected the client to be known at its new address only")
+	}
+	if addr := c.(*SingleDevice).Address(); addr != "127.0.0.1:45002" {
+		t.Errorf("Expected client address 127.0.0.1:45002, got %s", addr)
+	}
+	if s, ok := mc.DeviceState("127.0.0.1:45002"); !ok || s.Preset != 4 {
+		t.Errorf("Expected state with preset 4 at the new address, got %+v (found: %v)", s, ok)
+	}
+	if e := <-events.C; e.(DeviceMoved).From != "127.0.0.1:45001" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+
+	if err := mc.MoveClient("127.0.0.1:45001", "127.0.0.1:45003"); err == nil {
+		t.Error("Expected moving an unknown client to fail")
+	}
+}
+
+func TestMultiClientQueriesDeviceInfo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mc := NewMultiClient("test")
+	events := mc.Subscribe(SubscribeOptions{Filters: []EventFilter{FilterTypes(EventDeviceInfoReceived, EventStateChanged)}})
+	go func() {
+		_ = mc.Run(ctx, nil)
+	}()
+
+	addr := startResponder(t, DeviceID{0, 0, 0, 7})
+	if _, err := mc.AddClient(ctx, addr, "", 0xff); err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+
+	var infoReceived, stateUpdated bool
+	for !infoReceived || !stateUpdated {
+		select {
+		case e := <-events.C:
+			switch ev := e.(type) {
+			case DeviceInfoReceived:
+				if ev.Addr != addr || ev.Info.Name != "responder" || ev.Info.SerialNumber != 7 {
+					t.Fatalf("Unexpected device info %+v", ev)
+				}
+				infoReceived = true
+			case StateChanged:
+				stateUpdated = stateUpdated || (ev.State.HasDeviceData && ev.State.SerialNumber == 7)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out, info received: %v, state updated: %v", infoReceived, stateUpdated)
+		}
+	}
+}
+
+func TestMultiClientBroadcastRepliesDontUpdateState(t *testing.T) {
+	mc := NewMultiClient("test")
+	events := mc.Subscribe(SubscribeOptions{Filters: []EventFilter{FilterTypes(EventMessageReceived)}})
+
+	c := NewBroadcastClient("255.255.255.255:5001", "", 0xff)
+	mc.handleReceivedMessage(ReceivedMessage{
+		Header:        protocol.NewBasicHeader(protocol.MessageTypePing, protocol.StatusResponseServer, DeviceID{1, 2, 3, 4}, 1, 0xff),
+		RemoteAddress: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 5001},
+		Client:        c,
+	})
+
+	if states := mc.DeviceStates(); len(states) != 0 {
+		t.Errorf("Expected no device state for the broadcast address, got %+v", states)
+	}
+	if e := <-events.C; e.(MessageReceived).Addr != "10.0.0.5:5001" {
+		t.Errorf("Expected the message to be published with the address of the sender, got %+v", e)
+	}
+}
+
+func TestMultiClientDeviceInfoQuery(t *testing.T) {
+	policy := DeviceInfoRetryPolicy
+	DeviceInfoRetryPolicy = RetryPolicy{MaxAttempts: 2, AttemptTimeout: 50 * time.Millisecond}
+	defer func() { DeviceInfoRetryPolicy = policy }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mc := NewMultiClient("test")
+	go func() {
+		_ = mc.Run(ctx, nil)
+	}()
+
+	// a device that never answers is asked DeviceInfoRetryPolicy.MaxAttempts times
+	addr, requests := startCountingDevice(t, 0)
+	if _, err := mc.AddClient(ctx, addr, "", 0xff); err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	// broadcast clients are neither queried nor have a state
+	if _, err := mc.AddClient(ctx, "255.255.255.255:45001", "", 0xff); err != nil {
+		t.Fatalf("Failed to add broadcast client: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if n := len(requests()); n != 2 {
+		t.Errorf("Expected 2 DeviceData requests, got %d", n)
+	}
+	if states := mc.DeviceStates(); len(states) != 1 || states[0].Addr != addr {
+		t.Errorf("Expected a device state for %s only, got %+v", addr, states)
+	}
+}
+
+func TestMultiClientBroadcastSendsDontCreateState(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mc := NewMultiClient("test")
+	events := mc.Subscribe(SubscribeOptions{Filters: []EventFilter{FilterTypes(EventStateChanged)}})
+
+	c, err := mc.AddClient(ctx, "255.255.255.255:45004", "", 0xff)
+	if err != nil {
+		t.Fatalf("Failed to add broadcast client: %v", err)
+	}
+	c.SendPing()
+	c.SendPresetRecallByPresetIndex(3)
+
+	if states := mc.DeviceStates(); len(states) != 0 {
+		t.Errorf("Expected no device state for the broadcast address, got %+v", states)
+	}
+	select {
+	case e := <-events.C:
+		t.Errorf("Unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMultiClientConcurrentAddClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mc := NewMultiClient("test")
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := mc.AddClient(ctx, "127.0.0.1:45005", "", 0xff)
+			errs <- err
+		}()
+	}
+
+	added := 0
+	for i := 0; i < n; i++ {
+		err := <-errs
+		var existsErr *ErrClientExists
+		switch {
+		case err == nil:
+			added++
+		case !errors.As(err, &existsErr):
+			t.Errorf("Expected ErrClientExists, got %v", err)
+		}
+	}
+	if added != 1 {
+		t.Errorf("Expected the client to be added once, got %d", added)
+	}
+}
+
+func TestMultiClientSendWithRetryToBroadcast(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mc := NewMultiClient("test")
+	if _, err := mc.AddClient(ctx, "255.255.255.255:45006", "", 0xff); err != nil {
+		t.Fatalf("Failed to add broadcast client: %v", err)
+	}
+	clients := mc.Clients()
+	if _, ok := clients["255.255.255.255:45006"]; !ok || len(clients) != 1 {
+		t.Fatalf("Expected the broadcast client, got %v", clients)
+	}
+
+	// nobody answers, the request is done once sent
+	policy := RetryPolicy{MaxAttempts: 3, AttemptTimeout: time.Second}
+	results := mc.SendWithRetry(ctx, NewPingRequest(), policy)
+	if len(results) != 1 || !results[0].Broadcast || results[0].Err != nil {
+		t.Errorf("Expected the broadcast request to be sent, got %+v", results)
+	}
+
+	var notFound *ErrClientNotFound
+	if result := mc.SendWithRetryTo(ctx, "127.0.0.1:45007", NewPingRequest(), policy); !errors.As(result.Err, &notFound) {
+		t.Errorf("Expected ErrClientNotFound, got %v", result.Err)
+	}
+}
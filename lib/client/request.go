@@ -0,0 +1,304 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
+	"sync"
+)
+
+// Request describes a message sent to a device, independent of its sequence number.
+// The same Request can be encoded multiple times, for example to resend it.
+type Request struct {
+	MessageType protocol.MessageType
+	Status      protocol.StatusType
+	// Payload is the message body following the header. It is nil for messages
+	// without a payload, like pings.
+	Payload protocol.Message
+	// CoalesceKey is set for continuous parameters like volume and gain. A request
+	// that is still queued is dropped when a newer one with the same key is sent,
+	// so that only the latest value reaches the device.
+	CoalesceKey string
+}
+
+// Reply is the answer of a device to a request sent with SendAndWait.
+type Reply struct {
+	Header        *protocol.BasicHeader
+	RemoteAddress net.Addr
+	// Body is the decoded payload, see ReceivedMessage.Body
+	Body    protocol.Message
+	BodyErr error
+	Data    []byte
+}
+
+func NewPingRequest() Request {
+	return Request{
+		MessageType: protocol.MessageTypePing,
+		Status:      protocol.StatusRequestServer,
+	}
+}
+
+// NewDeviceDataRequest asks the device for its DeviceData, see DeviceInfo
+func NewDeviceDataRequest() Request {
+	return Request{
+		MessageType: protocol.MessageTypeDeviceData,
+		Status:      protocol.StatusRequestServer,
+		Payload:     &protocol.DeviceDataRequest{},
+	}
+}
+
+// presetRange is the range of preset indexes and positions, which are sent as a single byte
+var presetRange = units.Range{Min: 0, Max: 255}
+
+// presetByte checks that v fits the byte of a preset index or position
+func presetByte(quantity string, v int) (byte, error) {
+	if !presetRange.Contains(float64(v)) {
+		return 0, &units.ErrOutOfRange{Quantity: quantity, Value: float64(v), Range: presetRange}
+	}
+	return byte(v), nil
+}
+
+// NewPresetRecallByPresetIndexRequest recalls the preset index.
+// Indexes outside of 0 to 255 return a *units.ErrOutOfRange.
+func NewPresetRecallByPresetIndexRequest(index int) (Request, error) {
+	b, err := presetByte("preset index", index)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{
+		MessageType: protocol.MessageTypePresetRecall,
+		Status:      protocol.StatusCommandClient,
+		Payload:     protocol.NewPresetRecall(protocol.RecallByPresetIndex, 0, b),
+	}, nil
+}
+
+// NewPresetRecallByPresetPositionRequest recalls the preset at position, the order in which
+// the presets are listed on the device, instead of its index.
+// Positions outside of 0 to 255 return a *units.ErrOutOfRange.
+func NewPresetRecallByPresetPositionRequest(position int) (Request, error) {
+	b, err := presetByte("preset position", position)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{
+		MessageType: protocol.MessageTypePresetRecall,
+		Status:      protocol.StatusCommandClient,
+		Payload:     protocol.NewPresetRecall(protocol.RecallByPresetPosition, 0, b),
+	}, nil
+}
+
+// NewPresetSaveRequest stores the current settings of the device as preset index,
+// named name. Names longer than protocol.PresetNameSize return an *protocol.ErrStringTooLong,
+// indexes outside of 0 to 255 a *units.ErrOutOfRange.
+func NewPresetSaveRequest(index int, name string) (Request, error) {
+	b, err := presetByte("preset index", index)
+	if err != nil {
+		return Request{}, err
+	}
+	ps, err := protocol.NewPresetSave(b, name)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{
+		MessageType: protocol.MessageTypePresetSave,
+		Status:      protocol.StatusCommandClient,
+		Payload:     ps,
+	}, nil
+}
+
+// NewMasterVolumeRequest sets the master volume, where 0 is -80 dB and 1 is +20 dB.
+// Volumes outside of that range return a *units.ErrOutOfRange.
+func NewMasterVolumeRequest(volume float32) (Request, error) {
+	gain, err := units.MasterVolumeToValue(float64(volume))
+	if err != nil {
+		return Request{}, err
+	}
+
+	payload := append(protocol.RawPayload{}, masterVolumePrefix...)
+	payload = binary.LittleEndian.AppendUint32(payload, gain)
+
+	return Request{
+		MessageType: protocol.MessageTypeDeviceData,
+		Status:      protocol.StatusCommandClient,
+		Payload:     &payload,
+		CoalesceKey: "master-volume",
+	}, nil
+}
+
+// masterVolumePrefix starts the DeviceData payload of a master volume command,
+// followed by the raw volume as uint32.
+var masterVolumePrefix = protocol.RawPayload{01, 00, 03, 06}
+
+// masterVolumeFromRequest returns the raw volume of a request built by NewMasterVolumeRequest
+func masterVolumeFromRequest(req Request) (uint32, bool) {
+	payload, ok := req.Payload.(*protocol.RawPayload)
+	if !ok || req.MessageType != protocol.MessageTypeDeviceData ||
+		len(*payload) != len(masterVolumePrefix)+4 ||
+		!bytes.HasPrefix(*payload, masterVolumePrefix) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32((*payload)[len(masterVolumePrefix):]), true
+}
+
+func NewLiveCmdRequest(lc *protocol.LiveCmd) Request {
+	return Request{
+		MessageType: protocol.MessageTypeLiveCmd,
+		Status:      protocol.StatusCommandClient,
+		Payload:     lc,
+	}
+}
+
+// newLiveCmdPathRequest builds a LiveCmd request for path with the given value options.
+// The path is validated against the LevelType hierarchy.
+func newLiveCmdPathRequest(path protocol.Path, opts ...protocol.LiveCmdOption) (Request, error) {
+	lc, err := protocol.NewLiveCmd(append([]protocol.LiveCmdOption{protocol.WithPath(path...)}, opts...)...)
+	if err != nil {
+		return Request{}, err
+	}
+	return NewLiveCmdRequest(lc), nil
+}
+
+// NewGainRequest sets the gain in dB of channel, which is an input, an output
+// or an EQ band, for example protocol.Output(1).
+func NewGainRequest(channel protocol.Path, db float32) (Request, error) {
+	req, err := newLiveCmdPathRequest(channel.Gain(), protocol.WithGain(db))
+	if err != nil {
+		return Request{}, err
+	}
+	req.CoalesceKey = channel.Gain().String()
+	return req, nil
+}
+
+// NewMuteRequest mutes or unmutes the input or output channel.
+func NewMuteRequest(channel protocol.Path, muted bool) (Request, error) {
+	return newLiveCmdPathRequest(channel.Mute(), protocol.WithBool(muted))
+}
+
+// NewDelayRequest sets the delay in ms of the input or output channel.
+func NewDelayRequest(channel protocol.Path, ms float32) (Request, error) {
+	return newLiveCmdPathRequest(channel.Delay(), protocol.WithDelay(ms))
+}
+
+// NewPhaseInversionRequest inverts the phase of the input or output channel.
+func NewPhaseInversionRequest(channel protocol.Path, inverted bool) (Request, error) {
+	return newLiveCmdPathRequest(channel.PhaseInversion(), protocol.WithBool(inverted))
+}
+
+// NewEqTypeRequest sets the filter type of the EQ band, for example protocol.Input(0).Eq(2).
+func NewEqTypeRequest(eq protocol.Path, eqType units.EqType) (Request, error) {
+	return newLiveCmdPathRequest(eq.EqType(), protocol.WithEqType(uint8(eqType)))
+}
+
+// NewEqQualityRequest sets the Q factor of the EQ band.
+func NewEqQualityRequest(eq protocol.Path, q float32) (Request, error) {
+	return newLiveCmdPathRequest(eq.Quality(), protocol.WithQuality(q))
+}
+
+// NewEqActiveRequest enables or bypasses the EQ band.
+func NewEqActiveRequest(eq protocol.Path, active bool) (Request, error) {
+	return newLiveCmdPathRequest(eq.Active(), protocol.WithBool(active))
+}
+
+// encodeRequest encodes the header and payload of req for the given sequence number.
+func encodeRequest(req Request, seq uint16, componentId byte) (*bytes.Buffer, error) {
+	packet := &protocol.Packet{
+		Header: protocol.NewBasicHeader(
+			req.MessageType,
+			req.Status,
+			[4]byte{0, 0, 0, 0},
+			seq,
+			componentId,
+		),
+		Payload: req.Payload,
+	}
+
+	buf, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(buf), nil
+}
+
+// isReplyStatus returns true if the status is one a device uses to answer a client request.
+func isReplyStatus(status protocol.StatusType) bool {
+	switch status {
+	case protocol.StatusResponseServer, protocol.StatusErrorServer, protocol.StatusWaitServer:
+		return true
+	default:
+		return false
+	}
+}
+
+type pendingRequest struct {
+	messageType protocol.MessageType
+	replyCh     chan ReceivedMessage
+}
+
+// pendingRequests keeps track of the requests waiting for a reply, keyed by sequence number.
+type pendingRequests struct {
+	mutex    sync.Mutex
+	requests map[uint16]*pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		requests: make(map[uint16]*pendingRequest),
+	}
+}
+
+func (pr *pendingRequests) add(seq uint16, messageType protocol.MessageType) *pendingRequest {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	p := &pendingRequest{
+		messageType: messageType,
+		// buffered so that the read loop never blocks on a waiter
+		replyCh: make(chan ReceivedMessage, 1),
+	}
+	pr.requests[seq] = p
+	return p
+}
+
+func (pr *pendingRequests) remove(seq uint16) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	delete(pr.requests, seq)
+}
+
+// resolve hands msg to the request waiting for its sequence number.
+// It returns false if no request matches.
+func (pr *pendingRequests) resolve(msg ReceivedMessage) bool {
+	if msg.Header == nil || !isReplyStatus(msg.Header.Status) {
+		return false
+	}
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	p, ok := pr.requests[msg.Header.SequenceNumber]
+	if !ok || p.messageType != msg.Header.MessageType {
+		return false
+	}
+
+	select {
+	case p.replyCh <- msg:
+	default:
+		// a previous reply has not been consumed yet. A final reply replaces it,
+		// so that it is not lost behind a StatusWaitServer reply.
+		if msg.Header.Status != protocol.StatusWaitServer {
+			select {
+			case <-p.replyCh:
+			default:
+			}
+			select {
+			case p.replyCh <- msg:
+			default:
+			}
+		}
+	}
+	return true
+}
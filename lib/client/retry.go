@@ -0,0 +1,87 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how often and how fast a request is resent when the device
+// doesn't reply. UDP packets get lost, especially on venue Wi-Fi.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times the request is sent, including the first one.
+	MaxAttempts int
+	// AttemptTimeout is how long to wait for a reply before resending. Defaults to Timeout.
+	AttemptTimeout time.Duration
+	// WaitTimeout is how long to wait for the final reply after the device answered with
+	// StatusWaitServer, for example while recalling a preset. Defaults to Timeout.
+	WaitTimeout time.Duration
+	// InitialBackoff is the pause after the first unanswered attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the pause between attempts, jitter included.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the backoff after each unanswered attempt.
+	Multiplier float64
+	// Jitter randomizes each backoff by up to this fraction (0 to 1), so that
+	// many clients retrying at once don't stay in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is a sensible policy for commands on a lossy network.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	AttemptTimeout: 1 * time.Second,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     4 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) attemptTimeout() time.Duration {
+	if p.AttemptTimeout <= 0 {
+		return Timeout
+	}
+	return p.AttemptTimeout
+}
+
+func (p RetryPolicy) waitTimeout() time.Duration {
+	if p.WaitTimeout <= 0 {
+		return Timeout
+	}
+	return p.WaitTimeout
+}
+
+// Backoff returns how long to wait after the given number of unanswered attempts (starting at 1).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 || p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		// spread uniformly over [backoff * (1 - jitter), backoff * (1 + jitter)]
+		backoff *= 1 + jitter*(2*rand.Float64()-1)
+		if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+			backoff = float64(p.MaxBackoff)
+		}
+	}
+
+	return time.Duration(backoff)
+}
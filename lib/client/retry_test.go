@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"ppa-control/lib/protocol"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 250 * time.Millisecond,
+		MaxBackoff:     4 * time.Second,
+		Multiplier:     2,
+	}
+	jittered := policy
+	jittered.Jitter = 0.2
+
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"no attempt yet", policy, 0, 0, 0},
+		{"first retry", policy, 1, 250 * time.Millisecond, 250 * time.Millisecond},
+		{"grows", policy, 2, 500 * time.Millisecond, 500 * time.Millisecond},
+		{"grows again", policy, 4, 2 * time.Second, 2 * time.Second},
+		{"capped", policy, 6, 4 * time.Second, 4 * time.Second},
+		{"no backoff", RetryPolicy{Multiplier: 2}, 3, 0, 0},
+		{"multiplier below 1", RetryPolicy{InitialBackoff: time.Second, Multiplier: 0.5}, 3, time.Second, time.Second},
+		{"jitter", jittered, 2, 400 * time.Millisecond, 600 * time.Millisecond},
+		{"jitter stays below the cap", jittered, 6, 3200 * time.Millisecond, 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		// jitter is random, so sample it
+		for i := 0; i < 100; i++ {
+			if d := tt.policy.Backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("%s: expected a backoff in [%s, %s], got %s", tt.name, tt.min, tt.max, d)
+			}
+		}
+	}
+}
+
+// startCountingDevice starts a fake device that records the sequence number of every
+// request it receives, and only acknowledges a request once it received it answerOn times.
+// answerOn 0 never answers.
+func startCountingDevice(tb testing.TB, answerOn int) (string, func() []uint16) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	var mutex sync.Mutex
+	var seqs []uint16
+	go func() {
+		buf := make([]byte, MaxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hdr, err := protocol.ParseHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			mutex.Lock()
+			seqs = append(seqs, hdr.SequenceNumber)
+			received := len(seqs)
+			mutex.Unlock()
+
+			if answerOn > 0 && received >= answerOn {
+				h := protocol.NewBasicHeader(hdr.MessageType, protocol.StatusResponseServer, DeviceID{}, hdr.SequenceNumber, hdr.ComponentId)
+				data, _ := h.MarshalBinary()
+				_, _ = conn.WriteTo(data, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() []uint16 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]uint16(nil), seqs...)
+	}
+}
+
+func TestSendWithRetryResendsWithSameSequenceNumber(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		AttemptTimeout: 50 * time.Millisecond,
+		InitialBackoff: 10 * time.Millisecond,
+		Multiplier:     2,
+	}
+
+	tests := []struct {
+		name     string
+		answerOn int
+		attempts int
+	}{
+		{"answered on the last attempt", 3, 0},
+		{"never answered", 0, 3},
+	}
+
+	for _, tt := range tests {
+		addr, received := startCountingDevice(t, tt.answerOn)
+		c := NewSingleDevice(addr, "", 0xff)
+		go func() { _ = c.Run(ctx, nil) }()
+
+		_, err := c.SendWithRetry(ctx, NewPingRequest(), policy)
+		var timeoutErr *ErrRequestTimeout
+		switch {
+		case tt.attempts == 0 && err != nil:
+			t.Errorf("%s: expected a reply, got %v", tt.name, err)
+		case tt.attempts > 0 && !errors.As(err, &timeoutErr):
+			t.Errorf("%s: expected ErrRequestTimeout, got %v", tt.name, err)
+		case tt.attempts > 0 && timeoutErr.Attempts != tt.attempts:
+			t.Errorf("%s: expected %d attempts, got %d", tt.name, tt.attempts, timeoutErr.Attempts)
+		}
+
+		seqs := received()
+		if len(seqs) != policy.MaxAttempts {
+			t.Fatalf("%s: expected %d packets, got %d", tt.name, policy.MaxAttempts, len(seqs))
+		}
+		for _, seq := range seqs {
+			if seq != seqs[0] {
+				t.Errorf("%s: expected all attempts to use sequence number %d, got %v", tt.name, seqs[0], seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestSendWithRetryDeadlineDuringBackoff(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr, received := startCountingDevice(t, 0)
+	c := NewSingleDevice(addr, "", 0xff)
+	go func() { _ = c.Run(runCtx, nil) }()
+
+	// the deadline expires while waiting for the second attempt
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		AttemptTimeout: 20 * time.Millisecond,
+		InitialBackoff: time.Second,
+	}
+	ctx, cancelDeadline := context.WithTimeout(runCtx, 100*time.Millisecond)
+	defer cancelDeadline()
+
+	_, err := c.SendWithRetry(ctx, NewPingRequest(), policy)
+	var timeoutErr *ErrRequestTimeout
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+	if timeoutErr.Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", timeoutErr.Attempts)
+	}
+	if seqs := received(); len(seqs) != 1 {
+		t.Errorf("expected 1 packet, got %d", len(seqs))
+	}
+}
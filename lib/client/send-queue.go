@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// errQueueStopped is returned by sendQueue.push when the writer stopped
+var errQueueStopped = errors.New("send queue stopped")
+
+// queuedPacket is an encoded request waiting to be written, to the address of the
+// client or to to if it is set, see SingleDevice.SendTo.
+// Packets with the same non-empty key replace each other, see Request.CoalesceKey.
+type queuedPacket struct {
+	key string
+	buf *bytes.Buffer
+	to  *net.UDPAddr
+}
+
+// sendQueue is the bounded FIFO between the senders of a device and its single writer.
+// Pushing a packet with the key of a packet that is still queued drops the queued one
+// and appends the new one, so that only the latest value of a continuous parameter is
+// written, in the order it was set relative to the other commands.
+type sendQueue struct {
+	mutex   sync.Mutex
+	packets []queuedPacket
+
+	// slots holds one token per queued packet, so that pushing blocks while the queue is full
+	slots chan struct{}
+	// notify is signalled when packets were pushed
+	notify chan struct{}
+}
+
+func newSendQueue(capacity int) *sendQueue {
+	return &sendQueue{
+		slots:  make(chan struct{}, capacity),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *sendQueue) capacity() int {
+	return cap(q.slots)
+}
+
+// replace swaps the queued packet with the same key for p and moves it to the end
+// of the queue. It returns false if there is no such packet.
+func (q *sendQueue) replace(p queuedPacket) bool {
+	if p.key == "" {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, queued := range q.packets {
+		if queued.key == p.key {
+			q.packets = append(append(q.packets[:i:i], q.packets[i+1:]...), p)
+			return true
+		}
+	}
+	return false
+}
+
+// push appends p to the queue, waiting for room until ctx is done or stopped is closed.
+// It returns errQueueStopped or the context error if p could not be queued.
+func (q *sendQueue) push(ctx context.Context, stopped <-chan struct{}, p queuedPacket) error {
+	if q.replace(p) {
+		q.signal()
+		return nil
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+	case <-stopped:
+		return errQueueStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// a packet with the same key might have been queued while waiting for room
+	if q.replace(p) {
+		<-q.slots
+	} else {
+		q.mutex.Lock()
+		q.packets = append(q.packets, p)
+		q.mutex.Unlock()
+	}
+	q.signal()
+	return nil
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest packet from the queue
+func (q *sendQueue) pop() (queuedPacket, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.packets) == 0 {
+		return queuedPacket{}, false
+	}
+	p := q.packets[0]
+	q.packets[0] = queuedPacket{}
+	q.packets = q.packets[1:]
+	<-q.slots
+	return p, true
+}
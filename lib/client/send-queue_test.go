@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendQueueCoalescing(t *testing.T) {
+	tests := []struct {
+		name     string
+		pushed   []queuedPacket
+		expected []string
+	}{
+		{
+			name:     "keeps order",
+			pushed:   []queuedPacket{{buf: bytes.NewBufferString("ping")}, {buf: bytes.NewBufferString("recall")}},
+			expected: []string{"ping", "recall"},
+		},
+		{
+			name: "latest value wins",
+			pushed: []queuedPacket{
+				{key: "master-volume", buf: bytes.NewBufferString("volume 0.1")},
+				{key: "master-volume", buf: bytes.NewBufferString("volume 0.2")},
+				{key: "master-volume", buf: bytes.NewBufferString("volume 0.3")},
+			},
+			expected: []string{"volume 0.3"},
+		},
+		{
+			name: "coalesced value moves after newer commands",
+			pushed: []queuedPacket{
+				{key: "master-volume", buf: bytes.NewBufferString("volume 0.1")},
+				{key: "input[0]/gain", buf: bytes.NewBufferString("gain -3")},
+				{buf: bytes.NewBufferString("recall")},
+				{key: "master-volume", buf: bytes.NewBufferString("volume 0.2")},
+			},
+			expected: []string{"gain -3", "recall", "volume 0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue(10)
+			for _, p := range tt.pushed {
+				if err := q.push(context.Background(), nil, p); err != nil {
+					t.Fatalf("Failed to push: %v", err)
+				}
+			}
+
+			var popped []string
+			for p, ok := q.pop(); ok; p, ok = q.pop() {
+				popped = append(popped, p.buf.String())
+			}
+			if len(popped) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, popped)
+			}
+			for i := range popped {
+				if popped[i] != tt.expected[i] {
+					t.Fatalf("Expected %v, got %v", tt.expected, popped)
+				}
+			}
+			if len(q.slots) != 0 {
+				t.Errorf("Expected all slots to be free, got %d", len(q.slots))
+			}
+		})
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	q := newSendQueue(1)
+	_ = q.push(context.Background(), nil, queuedPacket{key: "master-volume", buf: bytes.NewBufferString("volume 0.1")})
+
+	if err := q.push(context.Background(), nil, queuedPacket{key: "master-volume", buf: bytes.NewBufferString("volume 0.2")}); err != nil {
+		t.Errorf("Expected coalescing into a full queue to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.push(ctx, nil, queuedPacket{buf: bytes.NewBufferString("ping")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	stopped := make(chan struct{})
+	close(stopped)
+	if err := q.push(context.Background(), stopped, queuedPacket{buf: bytes.NewBufferString("ping")}); !errors.Is(err, errQueueStopped) {
+		t.Errorf("Expected errQueueStopped, got %v", err)
+	}
+}
+
+func TestSequenceNumbersAreUnique(t *testing.T) {
+	c := NewSingleDevice("127.0.0.1:5001", "", 0xff)
+
+	var mutex sync.Mutex
+	seen := make(map[uint16]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				seq := c.nextSequenceNumber()
+				mutex.Lock()
+				if seen[seq] {
+					t.Errorf("Sequence number %d allocated twice", seq)
+				}
+				seen[seq] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if seen[0] {
+		t.Error("Expected sequence numbers to start at 1")
+	}
+}
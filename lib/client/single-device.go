@@ -3,24 +3,32 @@ package client
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-	"os"
 	"ppa-control/lib/protocol"
-	"ppa-control/lib/utils"
-	"syscall"
+	"ppa-control/lib/protocol/units"
+	"sync"
 	"time"
 
 	"github.com/augustoroman/hexdump"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
 )
 
-const MaxBufferSize = 1024
+const MaxBufferSize = protocol.MaxBufferSize
 const Timeout = 10 * time.Second
 
+// InboxSize is the number of received messages a client buffers until they are read from
+// the receivedCh passed to Run. Messages beyond that are dropped, so that a slow reader
+// doesn't hold up the read loop of the transport shared with the other devices.
+const InboxSize = 64
+
+// QueueTimeout is how long commands sent without a context, like SendPing, wait for room in
+// the send queue before they fail with ErrQueueFull.
+var QueueTimeout = time.Second
+
 // A pkg has multiple target addresses, and no source address (?).
 //That actually won't work either, will it...
 
@@ -34,302 +42,808 @@ type ReceivedMessage struct {
 	Header        *protocol.BasicHeader
 	RemoteAddress net.Addr
 	Interface     string
-	Body          interface{}
-	Data          []byte
-	Client        Client
+	// Body is the decoded payload, for example a *protocol.DeviceDataResponse,
+	// *protocol.PresetRecall or *protocol.LiveCmd. It is nil if the message has
+	// no payload, or if it could not be decoded, in which case BodyErr is set.
+	Body    protocol.Message
+	BodyErr error
+	// Data holds the raw bytes of the message, including the header
+	Data   []byte
+	Client Client
 }
 
 type SingleDevice struct {
-	AddrPort    string
 	Interface   string
-	SendChannel chan *bytes.Buffer
+	queue       *sendQueue
 	ComponentId uint
-	seqCmd      uint16
+	seqCmd      atomic.Uint32
+	pending     *pendingRequests
+
+	// onSent is called with every command that was queued, or acknowledged when
+	// sent with SendWithRetry. It is used by MultiClient to track the device state.
+	onSent func(req Request)
+	// onFailed is called with every command that could not be sent, was not
+	// acknowledged when sent with SendWithRetry, or was rejected by the device with a
+	// *DeviceError. Rejections of commands that were not waited for have a zero req.
+	onFailed func(req Request, err error)
+
+	// stopped is closed once Run returns
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// transports is the pool the transport is acquired from when running.
+	// If nil, the client opens its own socket.
+	transports *TransportPool
+
+	// broadcast is set for clients sending to a directed broadcast address, see NewBroadcastClient
+	broadcast bool
+	// monitor is set for discovery clients, see NewDiscoveryClient
+	monitor bool
+
+	// addrPort and raddr can change while running when the device moves, see SetAddress.
+	// transport and endpoint are set while running.
+	addrMutex sync.RWMutex
+	addrPort  string
+	raddr     *net.UDPAddr
+	transport *Transport
+	endpoint  *endpoint
+
+	// model is set once the device reported its type, see SetModel
+	modelMutex sync.RWMutex
+	model      *protocol.DeviceModel
 }
 
 func NewSingleDevice(address string, iface string, componentId uint) *SingleDevice {
 	return &SingleDevice{
-		// This channel is buffered to avoid blocking senders.
-		SendChannel: make(chan *bytes.Buffer, 10),
+		// The queue is buffered to avoid blocking senders.
+		queue:       newSendQueue(10),
 		Interface:   iface,
-		AddrPort:    address,
+		addrPort:    address,
 		ComponentId: componentId,
-		seqCmd:      1,
+		pending:     newPendingRequests(),
+		stopped:     make(chan struct{}),
 	}
 }
 
-func (c *SingleDevice) SendPing() {
-	buf := new(bytes.Buffer)
-	bh := protocol.NewBasicHeader(
-		protocol.MessageTypePing,
-		protocol.StatusRequestServer,
-		[4]byte{0, 0, 0, 0},
-		c.seqCmd,
-		byte(c.ComponentId),
-	)
-
-	c.seqCmd++
-
-	err := protocol.EncodeHeader(buf, bh)
+// NewBroadcastClient returns a client sending to a broadcast address, for example the
+// directed broadcast address 192.168.1.255:5001 of an interface. Like a client sending to
+// 255.255.255.255, it receives the packets of all the senders that have no client of their own.
+func NewBroadcastClient(address string, iface string, componentId uint) *SingleDevice {
+	c := NewSingleDevice(address, iface, componentId)
+	c.broadcast = true
+	return c
+}
+
+// IsBroadcast returns true if c sends to a broadcast address, so that its commands reach
+// any number of devices
+func IsBroadcast(c Client) bool {
+	d, ok := c.(*SingleDevice)
+	return ok && d.broadcast
+}
+
+// NewDiscoveryClient returns a broadcast client for the discovery, which receives every
+// packet of its transport, including those of the devices that have a client of their own,
+// so that they are still seen answering. If transports is not nil, the client shares the
+// transport of its interface with the other clients of the pool instead of opening a socket.
+func NewDiscoveryClient(address string, iface string, componentId uint, transports *TransportPool) *SingleDevice {
+	c := NewBroadcastClient(address, iface, componentId)
+	c.monitor = true
+	c.transports = transports
+	return c
+}
+
+// Address returns the address:port the client sends to
+func (c *SingleDevice) Address() string {
+	c.addrMutex.RLock()
+	defer c.addrMutex.RUnlock()
+	return c.addrPort
+}
+
+// SetAddress changes the address:port the client sends to, for example when the
+// device got a new DHCP lease. Pending requests and the sequence numbers are kept.
+func (c *SingleDevice) SetAddress(addrPort string) error {
+	raddr, err := net.ResolveUDPAddr("udp", addrPort)
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode header")
-		return
+		return NewClientError("resolve", addrPort, err)
+	}
+
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+	if c.endpoint != nil {
+		if err := c.transport.readdress(c.endpoint, addrPort); err != nil {
+			return err
+		}
+	}
+	c.addrPort = addrPort
+	c.raddr = raddr
+	return nil
+}
+
+func (c *SingleDevice) remoteAddr() *net.UDPAddr {
+	c.addrMutex.RLock()
+	defer c.addrMutex.RUnlock()
+	return c.raddr
+}
+
+// nextSequenceNumber returns a new sequence number, starting at 1. It is safe for concurrent use.
+func (c *SingleDevice) nextSequenceNumber() uint16 {
+	return uint16(c.seqCmd.Inc())
+}
+
+// send encodes req with a fresh sequence number and queues it for sending,
+// without waiting for a reply. Errors are logged.
+func (c *SingleDevice) send(req Request, what string) *bytes.Buffer {
+	buf, err := c.encode(req, c.nextSequenceNumber())
+	if err != nil {
+		log.Warn().Str("error", err.Error()).Msgf("Failed to encode %s", what)
+		c.failed(req, err)
+		return nil
 	}
 	log.Debug().
-		Str("address", c.AddrPort).
+		Str("address", c.Address()).
 		Str("interface", c.Interface).
 		Int("length", buf.Len()).
-		Msg("Sending ping to SendChannel")
-	c.SendChannel <- buf
+		Msgf("Sending %s", what)
+	ctx, cancel := context.WithTimeout(context.Background(), QueueTimeout)
+	defer cancel()
+	if err := c.enqueue(ctx, req.CoalesceKey, buf); err != nil {
+		log.Warn().Err(err).Msgf("Failed to send %s", what)
+		c.failed(req, err)
+		return nil
+	}
+	c.sent(req)
+	return buf
+}
+
+// encode checks req against the model of the device and encodes it
+func (c *SingleDevice) encode(req Request, seq uint16) (*bytes.Buffer, error) {
+	if err := c.validate(req); err != nil {
+		return nil, NewClientError("validate", c.Address(), err)
+	}
+	buf, err := encodeRequest(req, seq, byte(c.ComponentId))
+	if err != nil {
+		return nil, NewClientError("encode", c.Address(), err)
+	}
+	return buf, nil
+}
+
+// validate rejects commands for channels, EQ bands, parameters or presets that the
+// model of the device doesn't have. Nothing is rejected while the model is unknown.
+func (c *SingleDevice) validate(req Request) error {
+	m := c.Model()
+	if m == nil {
+		return nil
+	}
+	switch p := req.Payload.(type) {
+	case *protocol.LiveCmd:
+		path, err := p.ParsedPath()
+		if err != nil {
+			return err
+		}
+		return m.ValidatePath(path)
+	case *protocol.PresetRecall:
+		switch p.CrtFlags {
+		case protocol.RecallByPresetIndex:
+			return m.ValidatePreset(int(p.IndexPosition))
+		case protocol.RecallByPresetPosition:
+			return m.ValidatePresetPosition(int(p.IndexPosition))
+		}
+	case *protocol.PresetSave:
+		return m.ValidatePreset(int(p.IndexPosition))
+	}
+	return nil
+}
+
+// Model returns the model of the device, or nil if it is not known yet
+func (c *SingleDevice) Model() *protocol.DeviceModel {
+	c.modelMutex.RLock()
+	defer c.modelMutex.RUnlock()
+	return c.model
+}
+
+// SetModel sets the model commands are checked against. It is set by QueryDeviceInfo
+// once the device reported its type.
+func (c *SingleDevice) SetModel(m *protocol.DeviceModel) {
+	c.modelMutex.Lock()
+	defer c.modelMutex.Unlock()
+	c.model = m
+}
+
+func (c *SingleDevice) sent(req Request) {
+	if c.onSent != nil {
+		c.onSent(req)
+	}
+}
+
+func (c *SingleDevice) failed(req Request, err error) {
+	if c.onFailed != nil {
+		c.onFailed(req, err)
+	}
+}
+
+// enqueue hands buf to the send loop. If the queue is full, it waits for room
+// until ctx is done. A queued packet with the same non-empty coalesceKey is replaced by buf.
+func (c *SingleDevice) enqueue(ctx context.Context, coalesceKey string, buf *bytes.Buffer) error {
+	return c.enqueueTo(ctx, queuedPacket{key: coalesceKey, buf: buf})
+}
+
+func (c *SingleDevice) enqueueTo(ctx context.Context, p queuedPacket) error {
+	select {
+	case <-c.stopped:
+		return &ErrClientStopped{Addr: c.Address()}
+	default:
+	}
+
+	err := c.queue.push(ctx, c.stopped, p)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errQueueStopped):
+		return &ErrClientStopped{Addr: c.Address()}
+	default:
+		return &ErrQueueFull{Addr: c.Address(), Capacity: c.queue.capacity(), Err: err}
+	}
+}
+
+func (c *SingleDevice) SendPing() {
+	c.send(NewPingRequest(), "ping")
 }
 
 func (c *SingleDevice) SendPresetRecallByPresetIndex(index int) {
-	buf := new(bytes.Buffer)
-	bh := protocol.NewBasicHeader(
-		protocol.MessageTypePresetRecall,
-		protocol.StatusCommandClient,
-		[4]byte{0, 0, 0, 0},
-		c.seqCmd,
-		byte(c.ComponentId),
-	)
-	pr := protocol.NewPresetRecall(protocol.RecallByPresetIndex, 0, byte(index))
-	// TODO potentially need mutex here
-	c.seqCmd += 1
-
-	err := protocol.EncodeHeader(buf, bh)
+	req, err := NewPresetRecallByPresetIndexRequest(index)
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode header")
+		log.Warn().Err(err).Str("address", c.Address()).Msg("Invalid preset recall")
 		return
 	}
-	err = protocol.EncodePresetRecall(buf, pr)
+	c.send(req, "preset recall")
+}
+
+func (c *SingleDevice) SendPresetRecallByPresetPosition(position int) {
+	req, err := NewPresetRecallByPresetPositionRequest(position)
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode preset recall")
+		log.Warn().Err(err).Str("address", c.Address()).Msg("Invalid preset recall")
 		return
 	}
-	log.Debug().
-		Str("address", c.AddrPort).
-		Str("interface", c.Interface).
-		Int("length", buf.Len()).
-		Msg("Sending preset recall")
-	c.SendChannel <- buf
+	c.send(req, "preset recall")
 }
 
-func (c *SingleDevice) SendMasterVolume(volume float32) {
-	buf := new(bytes.Buffer)
-	bh := protocol.NewBasicHeader(
-		protocol.MessageTypeDeviceData,
-		protocol.StatusCommandClient,
-		[4]byte{0, 0, 0, 0},
-		c.seqCmd,
-		byte(c.ComponentId),
-	)
-	// volume = 1 -> 0dB
-	// volume = 0 -> -72dB
-
-	twentyDB := 0x3e8
-	minusEigthyDB := 0x00
-	gain := uint32(volume * float32(twentyDB-minusEigthyDB))
-
-	// TODO potentially need mutex here
-	c.seqCmd += 1
-
-	err := protocol.EncodeHeader(buf, bh)
+func (c *SingleDevice) SendPresetSave(index int, name string) {
+	req, err := NewPresetSaveRequest(index, name)
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode header")
+		log.Warn().Err(err).Str("address", c.Address()).Msg("Invalid preset save")
 		return
 	}
+	c.send(req, "preset save")
+}
 
-	err = binary.Write(buf, binary.LittleEndian, []int8{01, 00, 03, 06})
+func (c *SingleDevice) SendMasterVolume(volume float32) {
+	req, err := NewMasterVolumeRequest(float32(units.MasterVolumeRange.Clamp(float64(volume))))
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode header")
+		log.Warn().Err(err).Str("address", c.Address()).Msg("Invalid master volume")
 		return
 	}
+	buf := c.send(req, "master volume")
+	if buf != nil {
+		fmt.Printf("%s\n", hexdump.Dump(buf.Bytes()[:buf.Len()]))
+	}
+}
 
-	err = binary.Write(buf, binary.LittleEndian, gain)
+func (c *SingleDevice) SendLiveCmd(lc *protocol.LiveCmd) {
+	c.send(NewLiveCmdRequest(lc), "live command")
+}
+
+// sendLiveCmd queues a request built by one of the live command request constructors,
+// logging construction errors like invalid paths or out of range values.
+func (c *SingleDevice) sendLiveCmd(req Request, err error, what string) {
 	if err != nil {
-		log.Warn().Str("error", err.Error()).Msg("Failed to encode header")
+		log.Warn().Err(err).Str("address", c.Address()).Msgf("Invalid %s command", what)
 		return
 	}
+	c.send(req, what)
+}
+
+func (c *SingleDevice) SendGain(channel protocol.Path, db float32) {
+	req, err := NewGainRequest(channel, db)
+	c.sendLiveCmd(req, err, "gain")
+}
+
+func (c *SingleDevice) SendMute(channel protocol.Path, muted bool) {
+	req, err := NewMuteRequest(channel, muted)
+	c.sendLiveCmd(req, err, "mute")
+}
+
+func (c *SingleDevice) SendDelay(channel protocol.Path, ms float32) {
+	req, err := NewDelayRequest(channel, ms)
+	c.sendLiveCmd(req, err, "delay")
+}
+
+func (c *SingleDevice) SendPhaseInversion(channel protocol.Path, inverted bool) {
+	req, err := NewPhaseInversionRequest(channel, inverted)
+	c.sendLiveCmd(req, err, "phase inversion")
+}
+
+func (c *SingleDevice) SendEqType(eq protocol.Path, eqType units.EqType) {
+	req, err := NewEqTypeRequest(eq, eqType)
+	c.sendLiveCmd(req, err, "eq type")
+}
+
+func (c *SingleDevice) SendEqQuality(eq protocol.Path, q float32) {
+	req, err := NewEqQualityRequest(eq, q)
+	c.sendLiveCmd(req, err, "eq quality")
+}
+
+func (c *SingleDevice) SendEqActive(eq protocol.Path, active bool) {
+	req, err := NewEqActiveRequest(eq, active)
+	c.sendLiveCmd(req, err, "eq active")
+}
+
+// SendTo is Send to addrPort instead of the address of the client. It is used by
+// broadcast clients to reach single devices, see NewBroadcastClient. The reply is
+// received like the packets of any other sender without a client.
+func (c *SingleDevice) SendTo(ctx context.Context, req Request, addrPort string) error {
+	to, err := net.ResolveUDPAddr("udp", addrPort)
+	if err != nil {
+		return NewClientError("resolve", addrPort, err)
+	}
+	buf, err := c.encode(req, c.nextSequenceNumber())
+	if err != nil {
+		return err
+	}
+	key := ""
+	if req.CoalesceKey != "" {
+		key = addrPort + "/" + req.CoalesceKey
+	}
+	return c.enqueueTo(ctx, queuedPacket{key: key, buf: buf, to: to})
+}
 
+// Send encodes req with a fresh sequence number and queues it for sending,
+// without waiting for a reply.
+func (c *SingleDevice) Send(ctx context.Context, req Request) error {
+	buf, err := c.encode(req, c.nextSequenceNumber())
+	if err != nil {
+		c.failed(req, err)
+		return err
+	}
 	log.Debug().
-		Str("address", c.AddrPort).
+		Str("address", c.Address()).
 		Str("interface", c.Interface).
+		Str("type", req.MessageType.String()).
 		Int("length", buf.Len()).
-		Msg("Sending master volume")
+		Msg("Sending request")
+	if err := c.enqueue(ctx, req.CoalesceKey, buf); err != nil {
+		c.failed(req, err)
+		return err
+	}
+	c.sent(req)
+	return nil
+}
 
-	fmt.Printf("%s\n", hexdump.Dump(buf.Bytes()[:buf.Len()]))
-	c.SendChannel <- buf
+// sendBuilt sends a request returned by one of the request constructors,
+// returning the constructor error if there is one.
+func (c *SingleDevice) sendBuilt(ctx context.Context, req Request, err error) error {
+	if err != nil {
+		return err
+	}
+	return c.Send(ctx, req)
 }
 
-// Run is the main loop for the client. It will listen for messages on the sendChannel
-// and emit them on the UDP socket, and it will listen for incoming packets on the UDP socket,
-// parse them and emit them on the receiveChannel.
-func (c *SingleDevice) Run(ctx context.Context, receivedCh chan<- ReceivedMessage) (err error) {
-	raddr, err := net.ResolveUDPAddr("udp", c.AddrPort)
+func (c *SingleDevice) Ping(ctx context.Context) error {
+	return c.Send(ctx, NewPingRequest())
+}
+
+func (c *SingleDevice) RecallPreset(ctx context.Context, index int) error {
+	req, err := NewPresetRecallByPresetIndexRequest(index)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) RecallPresetByPosition(ctx context.Context, position int) error {
+	req, err := NewPresetRecallByPresetPositionRequest(position)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SavePreset(ctx context.Context, index int, name string) error {
+	req, err := NewPresetSaveRequest(index, name)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetMasterVolume(ctx context.Context, volume float32) error {
+	req, err := NewMasterVolumeRequest(volume)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetGain(ctx context.Context, channel protocol.Path, db float32) error {
+	req, err := NewGainRequest(channel, db)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetMute(ctx context.Context, channel protocol.Path, muted bool) error {
+	req, err := NewMuteRequest(channel, muted)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetDelay(ctx context.Context, channel protocol.Path, ms float32) error {
+	req, err := NewDelayRequest(channel, ms)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetPhaseInversion(ctx context.Context, channel protocol.Path, inverted bool) error {
+	req, err := NewPhaseInversionRequest(channel, inverted)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetEqType(ctx context.Context, eq protocol.Path, eqType units.EqType) error {
+	req, err := NewEqTypeRequest(eq, eqType)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetEqQuality(ctx context.Context, eq protocol.Path, q float32) error {
+	req, err := NewEqQualityRequest(eq, q)
+	return c.sendBuilt(ctx, req, err)
+}
+
+func (c *SingleDevice) SetEqActive(ctx context.Context, eq protocol.Path, active bool) error {
+	req, err := NewEqActiveRequest(eq, active)
+	return c.sendBuilt(ctx, req, err)
+}
+
+// SendAndWait sends req to the device and waits for the matching reply, identified
+// by its sequence number. If ctx has no deadline, Timeout is used.
+//
+// A StatusErrorServer reply is returned together with a *DeviceError.
+// StatusWaitServer replies extend the timeout, see SendWithRetry.
+// If no reply arrives in time, an *ErrRequestTimeout is returned.
+func (c *SingleDevice) SendAndWait(ctx context.Context, req Request) (*Reply, error) {
+	timeout := Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	return c.SendWithRetry(ctx, req, RetryPolicy{
+		MaxAttempts:    1,
+		AttemptTimeout: timeout,
+	})
+}
+
+// SendWithRetry sends req to the device and resends it according to policy until
+// a reply arrives. All attempts reuse the same sequence number, so that the device
+// can recognize duplicates.
+//
+// Devices that need more time, for example to recall a preset, reply with
+// StatusWaitServer: each of these replies extends the deadline of the current attempt
+// to policy.WaitTimeout from now, instead of letting it time out and resend.
+// The deadline of ctx still applies.
+func (c *SingleDevice) SendWithRetry(ctx context.Context, req Request, policy RetryPolicy) (*Reply, error) {
+	reply, err := c.sendWithRetry(ctx, req, policy)
+	if err == nil {
+		c.sent(req)
+	} else {
+		c.failed(req, err)
+	}
+	return reply, err
+}
+
+func (c *SingleDevice) sendWithRetry(ctx context.Context, req Request, policy RetryPolicy) (*Reply, error) {
+	seq := c.nextSequenceNumber()
+	buf, err := c.encode(req, seq)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	p := c.pending.add(seq, req.MessageType)
+	defer c.pending.remove(seq)
+
+	// the deadline of ctx is reported like running out of attempts,
+	// whether it expires while waiting for a reply or during a backoff
+	timedOut := func(attempts int, err error) error {
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		return &ErrRequestTimeout{
+			Addr:           c.Address(),
+			MessageType:    req.MessageType,
+			SequenceNumber: seq,
+			Attempts:       attempts,
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		log.Debug().
+			Str("address", c.Address()).
+			Str("interface", c.Interface).
+			Str("type", req.MessageType.String()).
+			Uint16("seq", seq).
+			Int("attempt", attempt).
+			Msg("Sending request")
+
+		reply, err := c.waitForReply(ctx, &req, p, buf, policy.attemptTimeout(), policy.waitTimeout())
+		if err != errAttemptTimeout {
+			// the device rejecting the request is final, it is not resent
+			var deviceErr *DeviceError
+			if err == nil || errors.As(err, &deviceErr) {
+				return reply, err
+			}
+			return nil, timedOut(attempt, err)
+		}
+
+		if attempt >= policy.attempts() {
+			return nil, timedOut(attempt, nil)
+		}
+
+		backoff := policy.Backoff(attempt)
+		log.Debug().
+			Str("address", c.Address()).
+			Uint16("seq", seq).
+			Int("attempt", attempt).
+			Dur("backoff", backoff).
+			Msg("No reply, retrying")
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, timedOut(attempt, ctx.Err())
+		}
 	}
-	conn, err := utils.ListenUDP(ctx, "0.0.0.0:0", c.Interface)
+}
+
+// errAttemptTimeout is returned by waitForReply when a single attempt timed out,
+// but the overall context is still valid.
+var errAttemptTimeout = errors.New("attempt timed out")
+
+// waitForReply queues buf for sending and waits at most timeout for the reply to p.
+// Every StatusWaitServer reply restarts the wait with waitTimeout.
+func (c *SingleDevice) waitForReply(
+	ctx context.Context,
+	req *Request,
+	p *pendingRequest,
+	buf *bytes.Buffer,
+	timeout time.Duration,
+	waitTimeout time.Duration,
+) (*Reply, error) {
+	timedOut := func() error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errAttemptTimeout
+	}
+
+	// requests waiting for a reply are never coalesced, as their reply is expected
+	enqueueCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := c.enqueue(enqueueCtx, "", buf)
+	cancel()
 	if err != nil {
+		if _, ok := err.(*ErrQueueFull); ok {
+			return nil, timedOut()
+		}
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-p.replyCh:
+			reply := &Reply{
+				Header:        msg.Header,
+				RemoteAddress: msg.RemoteAddress,
+				Body:          msg.Body,
+				BodyErr:       msg.BodyErr,
+				Data:          msg.Data,
+			}
+			switch msg.Header.Status {
+			case protocol.StatusWaitServer:
+				log.Debug().
+					Str("address", c.Address()).
+					Uint16("seq", msg.Header.SequenceNumber).
+					Dur("timeout", waitTimeout).
+					Msg("Device asked us to wait, extending deadline")
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(waitTimeout)
+				continue
+			case protocol.StatusErrorServer:
+				return reply, NewDeviceError(c.Address(), msg, req)
+			default:
+				return reply, nil
+			}
+
+		case <-c.stopped:
+			return nil, &ErrClientStopped{Addr: c.Address()}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-timer.C:
+			return nil, timedOut()
+		}
+	}
+}
+
+// Run is the main loop for the client. It will listen for messages on the sendChannel
+// and emit them on the transport of its interface, and it will parse the packets the
+// transport receives from the device and emit them on the receiveChannel.
+func (c *SingleDevice) Run(ctx context.Context, receivedCh chan<- ReceivedMessage) (err error) {
+	defer c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+
+	if err = c.SetAddress(c.Address()); err != nil {
 		return
 	}
-	defer func() {
-		_ = conn.Close()
-	}()
 
 	grp, ctx := errgroup.WithContext(ctx)
-	grp.Go(func() error {
-		return c.readLoop(ctx, conn, receivedCh)
+
+	var t *Transport
+	if c.transports != nil {
+		var release func()
+		t, release = c.transports.Acquire(c.Interface)
+		defer release()
+	} else {
+		t = NewTransport(c.Interface)
+	}
+
+	var inbox chan ReceivedMessage
+	if receivedCh != nil {
+		inbox = make(chan ReceivedMessage, InboxSize)
+		grp.Go(func() error {
+			return c.deliverLoop(ctx, inbox, receivedCh)
+		})
+	}
+
+	ep, err := c.registerWith(t, func(p packet) {
+		c.handlePacket(p, inbox)
 	})
+	if err != nil {
+		return
+	}
+	defer c.unregister()
+
+	if c.transports == nil {
+		grp.Go(func() error {
+			return t.Run(ctx)
+		})
+	}
 
 	grp.Go(func() error {
-		return c.sendLoop(ctx, conn, raddr)
+		return c.sendLoop(ctx, t)
 	})
 
-	log.Info().Str("address", c.AddrPort).Msg("Client started")
+	log.Info().
+		Str("address", c.Address()).
+		Str("endpoint", ep.addr).
+		Msg("Client started")
 	return grp.Wait()
 }
 
-func (c *SingleDevice) sendLoop(ctx context.Context, conn net.PacketConn, raddr *net.UDPAddr) error {
-	log.Info().Str("address", c.AddrPort).Msg("Starting send loop")
-	defer func() {
-		log.Info().Str("address", c.AddrPort).Msg("Exiting send loop")
-	}()
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("SingleDevice.go: cancelled")
-			return ctx.Err()
+func (c *SingleDevice) registerWith(t *Transport, handler packetHandler) (*endpoint, error) {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
 
-		case buf := <-c.SendChannel:
-			go func() {
-				log.Debug().Str("address", c.AddrPort).
-					Int("len", buf.Len()).
-					Msg("Sending packet")
-				deadline := time.Now().Add(Timeout)
-				err := conn.SetWriteDeadline(deadline)
-				if err != nil {
-					log.Warn().
-						Err(err).
-						Str("address", c.AddrPort).
-						Msg("Failed to set write deadline")
-				}
-				n, err := conn.WriteTo(buf.Bytes(), raddr)
-				if err != nil {
-					log.Warn().
-						Err(err).
-						Str("to", c.AddrPort).
-						Str("local", conn.LocalAddr().String()).
-						Int("length", buf.Len()).
-						Bytes("data", buf.Bytes()).
-						Msg("Failed to write to connection")
-				} else {
-					log.Debug().
-						Str("to", c.AddrPort).
-						Str("from", conn.LocalAddr().String()).
-						Int("length", buf.Len()).
-						Int("written", n).
-						Msg("Written packet")
-				}
-			}()
+	var ep *endpoint
+	if c.monitor {
+		ep = t.monitor(c.addrPort, handler)
+	} else {
+		var err error
+		ep, err = t.register(c.addrPort, c.broadcast, handler)
+		if err != nil {
+			return nil, err
 		}
 	}
+	c.transport = t
+	c.endpoint = ep
+	return ep, nil
 }
 
-func (c *SingleDevice) readLoop(ctx context.Context, conn net.PacketConn, receivedCh chan<- ReceivedMessage) error {
+func (c *SingleDevice) unregister() {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
+	c.transport.unregister(c.endpoint)
+	c.transport = nil
+	c.endpoint = nil
+}
+
+func (c *SingleDevice) sendLoop(ctx context.Context, t *Transport) error {
+	log.Info().Str("address", c.Address()).Msg("Starting send loop")
 	defer func() {
-		log.Info().
-			Str("address", conn.LocalAddr().String()).
-			Msg("Exiting read loop")
+		log.Info().Str("address", c.Address()).Msg("Exiting send loop")
 	}()
-
 	for {
-		if ctx.Err() != nil {
-			log.Debug().Msg("Context error, exiting read loop")
+		select {
+		case <-ctx.Done():
 			return ctx.Err()
-		}
-
-		buffer := make([]byte, MaxBufferSize)
 
-		log.Trace().
-			Str("address", conn.LocalAddr().String()).
-			Msg("Reading from connection")
+		case <-t.Done():
+			return t.Err()
 
-		deadline := time.Now().Add(200 * time.Millisecond)
-		err := conn.SetReadDeadline(deadline)
-		if err != nil {
-			log.Warn().
-				Str("address", conn.LocalAddr().String()).
-				Str("error", err.Error()).
-				Msg("Failed to set read deadline")
-			return err
-		}
-
-		nRead, addr, err := conn.ReadFrom(buffer)
-		if err != nil {
-			switch v := err.(type) {
-			case *net.OpError:
-				if v.Timeout() {
-					continue
+		case <-c.queue.notify:
+			// packets are written one at a time, in the order they were queued
+			for {
+				p, ok := c.queue.pop()
+				if !ok {
+					break
 				}
-				switch v2 := v.Err.(type) {
-				case *os.SyscallError:
-					if v2.Syscall == "recvfrom" && v2.Err == syscall.ECONNREFUSED {
-						log.Warn().Msg("Connection refused")
-					}
-				default:
-				}
-			default:
+				c.write(t, p)
 			}
-			log.Warn().Err(err).Msg("Failed to read from connection")
-			return err
 		}
+	}
+}
 
-		if zerolog.GlobalLevel() == zerolog.DebugLevel {
-			fmt.Printf("%s\n", hexdump.Dump(buffer[:nRead]))
-		}
-		log.Info().Int("received", nRead).
-			Str("from", addr.String()).
-			Str("iface", c.Interface).
-			Str("local", conn.LocalAddr().String()).
-			Bytes("data", buffer[:nRead]).
-			Msg("Received packet")
+func (c *SingleDevice) write(t *Transport, p queuedPacket) {
+	buf, to := p.buf, p.to
+	if to == nil {
+		to = c.remoteAddr()
+	}
+	log.Debug().Stringer("address", to).
+		Int("len", buf.Len()).
+		Msg("Sending packet")
+	n, err := t.WriteTo(buf.Bytes(), to)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Stringer("to", to).
+			Stringer("local", t.LocalAddr()).
+			Int("length", buf.Len()).
+			Bytes("data", buf.Bytes()).
+			Msg("Failed to write to connection")
+	} else {
+		log.Debug().
+			Stringer("to", to).
+			Stringer("from", t.LocalAddr()).
+			Int("length", buf.Len()).
+			Int("written", n).
+			Msg("Written packet")
+	}
+}
 
-		hdr, err := protocol.ParseHeader(buffer[:nRead])
+// handlePacket is called by the transport with the packets received from the device
+// handlePacket runs in the read loop of the transport, and must not block.
+func (c *SingleDevice) handlePacket(p packet, inbox chan<- ReceivedMessage) {
+	msg := ReceivedMessage{
+		Header:        p.Header,
+		RemoteAddress: p.RemoteAddress,
+		Interface:     c.Interface,
+		Client:        c,
+		Body:          p.Body,
+		BodyErr:       p.BodyErr,
+		Data:          p.Data,
+	}
+	// error replies to requests that are waited for are reported by SendWithRetry
+	if !c.pending.resolve(msg) && p.Header != nil && p.Header.Status == protocol.StatusErrorServer {
+		c.failed(Request{}, NewDeviceError(c.Address(), msg, nil))
+	}
 
-		if err != nil {
-			log.Warn().Err(err).
-				Bytes("payload", buffer[:nRead]).
-				Msg("Could not decode incoming message")
-
-			if receivedCh != nil {
-				receivedCh <- ReceivedMessage{
-					Header:        nil,
-					Interface:     c.Interface,
-					RemoteAddress: addr,
-					Client:        c,
-					Body:          nil,
-					Data:          buffer[:nRead],
-				}
-			}
-			continue
+	if inbox != nil {
+		select {
+		case inbox <- msg:
+		default:
+			log.Warn().
+				Str("address", c.Address()).
+				Str("from", p.RemoteAddress.String()).
+				Msg("Dropping received message, receiver is too slow")
 		}
+	}
+}
 
-		// TODO parse body further
-
-		if receivedCh != nil {
-			receivedCh <- ReceivedMessage{
-				Header:        hdr,
-				RemoteAddress: addr,
-				Interface:     c.Interface,
-				Client:        c,
-				Body:          nil,
-				Data:          buffer[:nRead],
+// deliverLoop forwards the messages buffered by handlePacket to receivedCh
+func (c *SingleDevice) deliverLoop(ctx context.Context, inbox <-chan ReceivedMessage, receivedCh chan<- ReceivedMessage) error {
+	for {
+		select {
+		case msg := <-inbox:
+			select {
+			case receivedCh <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
 func (c *SingleDevice) Name() string {
-	return fmt.Sprintf("SingleDevice-%s", c.AddrPort)
+	return fmt.Sprintf("SingleDevice-%s", c.Address())
 }
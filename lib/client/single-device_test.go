@@ -0,0 +1,297 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSingleDeviceValidatesAgainstModel(t *testing.T) {
+	ctx := context.Background()
+	c := NewSingleDevice("127.0.0.1:5001", "", 0xff)
+
+	// without a model, nothing is rejected
+	if err := c.SetMute(ctx, protocol.Output(7), true); err != nil {
+		t.Fatalf("Expected no validation without a model, got %v", err)
+	}
+
+	m, ok := protocol.LookupModel(0, protocol.SimulatedDeviceTypeId)
+	if !ok {
+		t.Fatal("Expected the simulated model to be registered")
+	}
+	c.SetModel(m)
+
+	var pathErr *protocol.ErrInvalidPath
+	if err := c.SetMute(ctx, protocol.Output(7), true); !errors.As(err, &pathErr) {
+		t.Errorf("Expected ErrInvalidPath for output 7, got %v", err)
+	}
+	if err := c.SetMute(ctx, protocol.Output(3), true); err != nil {
+		t.Errorf("Expected output 3 to be valid, got %v", err)
+	}
+
+	var presetErr *protocol.ErrInvalidPreset
+	if err := c.RecallPreset(ctx, m.PresetSlots); !errors.As(err, &presetErr) {
+		t.Errorf("Expected ErrInvalidPreset for preset %d, got %v", m.PresetSlots, err)
+	}
+	if err := c.RecallPresetByPosition(ctx, m.PresetSlots); !errors.As(err, &presetErr) || !presetErr.ByPosition {
+		t.Errorf("Expected ErrInvalidPreset for position %d, got %v", m.PresetSlots, err)
+	}
+
+	// indexes that don't fit a byte are rejected instead of wrapping around
+	var rangeErr *units.ErrOutOfRange
+	if err := c.RecallPreset(ctx, 256); !errors.As(err, &rangeErr) {
+		t.Errorf("Expected ErrOutOfRange for preset 256, got %v", err)
+	}
+	if err := c.RecallPresetByPosition(ctx, -1); !errors.As(err, &rangeErr) {
+		t.Errorf("Expected ErrOutOfRange for position -1, got %v", err)
+	}
+}
+
+func TestErrorRepliesAreReportedOnce(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var failures []error
+	c := NewSingleDevice(startSlowDevice(t, 0), "", 0xff)
+	c.onFailed = func(req Request, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failures = append(failures, err)
+	}
+	go func() { _ = c.Run(ctx, nil) }()
+	if _, err := c.SendAndWait(ctx, NewPingRequest()); err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	failed := func() []error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]error(nil), failures...)
+	}
+
+	// an error reply is terminal, the request is not resent
+	req, _ := NewPresetRecallByPresetIndexRequest(2)
+	policy := RetryPolicy{MaxAttempts: 3, AttemptTimeout: 100 * time.Millisecond}
+	var deviceErr *DeviceError
+	if _, err := c.SendWithRetry(ctx, req, policy); !errors.As(err, &deviceErr) {
+		t.Fatalf("Expected a DeviceError, got %v", err)
+	}
+	if f := failed(); len(f) != 1 || !errors.As(f[0], &deviceErr) || deviceErr.Command == nil {
+		t.Fatalf("Expected the rejected request to be reported once, got %v", f)
+	}
+
+	// the rejection of a command that is not waited for is reported without the command
+	if err := c.Send(ctx, req); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(failed()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if f := failed(); len(f) != 2 || !errors.As(f[1], &deviceErr) || deviceErr.Command != nil {
+		t.Fatalf("Expected the rejected command to be reported once, got %v", f)
+	}
+}
+
+func TestSendFailsWhenQueueStaysFull(t *testing.T) {
+	timeout := QueueTimeout
+	QueueTimeout = 50 * time.Millisecond
+	defer func() { QueueTimeout = timeout }()
+
+	var failures []error
+	c := NewSingleDevice("127.0.0.1:5001", "", 0xff)
+	c.onFailed = func(req Request, err error) {
+		failures = append(failures, err)
+	}
+
+	// the client isn't running, so nothing drains its queue
+	for i := 0; i <= c.queue.capacity(); i++ {
+		c.SendPing()
+	}
+	var full *ErrQueueFull
+	if len(failures) != 1 || !errors.As(failures[0], &full) {
+		t.Fatalf("Expected the last ping to fail with ErrQueueFull, got %v", failures)
+	}
+}
+
+func TestPendingRequestsResolve(t *testing.T) {
+	reply := func(mt protocol.MessageType, status protocol.StatusType, seq uint16) ReceivedMessage {
+		return ReceivedMessage{Header: protocol.NewBasicHeader(mt, status, DeviceID{}, seq, 0xff)}
+	}
+
+	tests := []struct {
+		name     string
+		msg      ReceivedMessage
+		expected bool
+	}{
+		{"matching reply", reply(protocol.MessageTypePing, protocol.StatusResponseServer, 5), true},
+		{"error reply", reply(protocol.MessageTypePing, protocol.StatusErrorServer, 5), true},
+		{"other sequence number", reply(protocol.MessageTypePing, protocol.StatusResponseServer, 6), false},
+		{"other message type", reply(protocol.MessageTypeLiveCmd, protocol.StatusResponseServer, 5), false},
+		{"request from the device", reply(protocol.MessageTypePing, protocol.StatusRequestServer, 5), false},
+		{"no header", ReceivedMessage{}, false},
+	}
+
+	for _, tt := range tests {
+		pr := newPendingRequests()
+		p := pr.add(5, protocol.MessageTypePing)
+		if resolved := pr.resolve(tt.msg); resolved != tt.expected {
+			t.Errorf("%s: expected resolved %v, got %v", tt.name, tt.expected, resolved)
+		}
+		if received := len(p.replyCh) == 1; received != tt.expected {
+			t.Errorf("%s: expected the reply to be delivered %v, got %v", tt.name, tt.expected, received)
+		}
+	}
+}
+
+// startMisreplyingDevice starts a fake device that answers every request with a reply
+// carrying another sequence number, followed by the matching reply if answer is set.
+func startMisreplyingDevice(tb testing.TB, answer bool) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hdr, err := protocol.ParseHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			seqs := []uint16{hdr.SequenceNumber + 100}
+			if answer {
+				seqs = append(seqs, hdr.SequenceNumber)
+			}
+			for _, seq := range seqs {
+				h := protocol.NewBasicHeader(hdr.MessageType, protocol.StatusResponseServer, DeviceID{}, seq, hdr.ComponentId)
+				data, _ := h.MarshalBinary()
+				_, _ = conn.WriteTo(data, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSendAndWaitMatchesSequenceNumber(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := startDevices(t, ctx, []string{startMisreplyingDevice(t, true)}, NewTransportPool())[0]
+	reply, err := c.SendAndWait(ctx, NewPingRequest())
+	if err != nil {
+		t.Fatalf("Expected a reply, got %v", err)
+	}
+	if seq := reply.Header.SequenceNumber; seq != uint16(c.seqCmd.Load()) {
+		t.Errorf("Expected the reply to request %d, got %d", c.seqCmd.Load(), seq)
+	}
+
+	// replies to other requests are ignored, and the request is forgotten once it timed out
+	silent := NewSingleDevice(startMisreplyingDevice(t, false), "", 0xff)
+	go func() { _ = silent.Run(ctx, nil) }()
+	waitCtx, waitCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer waitCancel()
+	_, err = silent.SendAndWait(waitCtx, NewPingRequest())
+	var timeoutErr *ErrRequestTimeout
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected ErrRequestTimeout, got %v", err)
+	}
+	silent.pending.mutex.Lock()
+	defer silent.pending.mutex.Unlock()
+	if len(silent.pending.requests) != 0 {
+		t.Errorf("Expected no pending request after the timeout, got %d", len(silent.pending.requests))
+	}
+}
+
+// startSlowDevice starts a fake device that answers preset recalls of preset 1 with
+// StatusWaitServer and acknowledges them after delay, and rejects all other presets
+// with error code 0x07.
+func startSlowDevice(tb testing.TB, delay time.Duration) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	reply := func(hdr *protocol.BasicHeader, status protocol.StatusType, payload []byte, addr net.Addr) {
+		h := protocol.NewBasicHeader(hdr.MessageType, status, DeviceID{0, 0, 0, 1}, hdr.SequenceNumber, hdr.ComponentId)
+		data, _ := h.MarshalBinary()
+		_, _ = conn.WriteTo(append(data, payload...), addr)
+	}
+
+	go func() {
+		buf := make([]byte, MaxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packet, err := protocol.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			pr, ok := packet.Payload.(*protocol.PresetRecall)
+			switch {
+			case !ok:
+				reply(packet.Header, protocol.StatusResponseServer, nil, addr)
+			case pr.IndexPosition == 1:
+				reply(packet.Header, protocol.StatusWaitServer, nil, addr)
+				time.AfterFunc(delay, func() {
+					reply(packet.Header, protocol.StatusResponseServer, nil, addr)
+				})
+			default:
+				reply(packet.Header, protocol.StatusErrorServer, []byte{0x07}, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSendWithRetryHandlesWaitAndErrorReplies(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := startDevices(t, ctx, []string{startSlowDevice(t, 300*time.Millisecond)}, NewTransportPool())[0]
+
+	// the recall takes longer than the attempt timeout, but the wait reply extends it
+	policy := RetryPolicy{MaxAttempts: 1, AttemptTimeout: 100 * time.Millisecond, WaitTimeout: time.Second}
+	recall, _ := NewPresetRecallByPresetIndexRequest(1)
+	reply, err := c.SendWithRetry(ctx, recall, policy)
+	if err != nil {
+		t.Fatalf("Expected the recall to be acknowledged after waiting, got %v", err)
+	}
+	if reply.Header.Status != protocol.StatusResponseServer {
+		t.Errorf("Expected a response, got %s", reply.Header.Status)
+	}
+
+	req, _ := NewPresetRecallByPresetIndexRequest(2)
+	_, err = c.SendWithRetry(ctx, req, policy)
+	var deviceErr *DeviceError
+	if !errors.As(err, &deviceErr) {
+		t.Fatalf("Expected a DeviceError, got %v", err)
+	}
+	if code, ok := deviceErr.Code(); !ok || code != 0x07 {
+		t.Errorf("Expected error code 0x07, got %#x (%v)", code, ok)
+	}
+	if deviceErr.Command == nil || deviceErr.Command.MessageType != req.MessageType {
+		t.Errorf("Expected the rejected command to be reported, got %+v", deviceErr.Command)
+	}
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/protocol/units"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeviceState is the last known state of a device, built from the commands sent to it
+// and the messages received from it. It is a snapshot and can be used without locking.
+type DeviceState struct {
+	Addr string
+	// DeviceID is the unique id sent by the device, zero until a message has been received.
+	// Unlike Addr, it doesn't change when the device gets a new address.
+	DeviceID DeviceID
+
+	// HasDeviceData is true once a DeviceData response has been received,
+	// which fills in the DeviceInfo.
+	HasDeviceData bool
+	DeviceInfo
+
+	// Preset is the index of the last recalled preset, or -1 if unknown
+	Preset int
+	// MasterVolume is the last master volume from 0 to 1, or -1 if unknown
+	MasterVolume float64
+
+	// Values holds the raw LiveCmd values by path, for example "output[1]/mute".
+	// Use Gain and Muted to get converted values.
+	Values map[string]uint32
+	// Strings holds the string LiveCmd values by path, for example channel names
+	Strings map[string]string
+
+	// LastSeen is the time the last message was received from the device
+	LastSeen time.Time
+	// UpdatedAt is the time any of the values above last changed
+	UpdatedAt time.Time
+}
+
+func NewDeviceState(addr string) DeviceState {
+	return DeviceState{
+		Addr:         addr,
+		Preset:       -1,
+		MasterVolume: -1,
+		Values:       make(map[string]uint32),
+		Strings:      make(map[string]string),
+	}
+}
+
+// Value returns the raw value of the parameter at path, if known
+func (s DeviceState) Value(path protocol.Path) (uint32, bool) {
+	v, ok := s.Values[path.String()]
+	return v, ok
+}
+
+// Gain returns the gain in dB of a channel or EQ band, if known
+func (s DeviceState) Gain(channel protocol.Path) (float64, bool) {
+	v, ok := s.Value(channel.Gain())
+	if !ok {
+		return 0, false
+	}
+	return units.GainFromValue(v), true
+}
+
+// Muted returns whether a channel is muted, if known
+func (s DeviceState) Muted(channel protocol.Path) (bool, bool) {
+	v, ok := s.Value(channel.Mute())
+	return v != 0, ok
+}
+
+func (s DeviceState) clone() DeviceState {
+	ret := s
+	ret.Values = make(map[string]uint32, len(s.Values))
+	for k, v := range s.Values {
+		ret.Values[k] = v
+	}
+	ret.Strings = make(map[string]string, len(s.Strings))
+	for k, v := range s.Strings {
+		ret.Strings[k] = v
+	}
+	return ret
+}
+
+// applyRequest updates the state from a command sent to the device.
+// It returns true if the state changed.
+func (s *DeviceState) applyRequest(req Request) bool {
+	if req.Status != protocol.StatusCommandClient {
+		return false
+	}
+
+	switch p := req.Payload.(type) {
+	case *protocol.PresetRecall:
+		return s.applyPresetRecall(p)
+	case *protocol.LiveCmd:
+		return s.applyLiveCmd(p)
+	}
+
+	if v, ok := masterVolumeFromRequest(req); ok {
+		volume := units.MasterVolumeFromValue(v)
+		if s.MasterVolume == volume {
+			return false
+		}
+		s.MasterVolume = volume
+		return true
+	}
+
+	return false
+}
+
+// applyMessage updates the state from a message received from the device.
+// It returns true if the state changed, not counting LastSeen.
+func (s *DeviceState) applyMessage(msg ReceivedMessage) bool {
+	s.LastSeen = time.Now()
+
+	if msg.Header == nil {
+		return false
+	}
+
+	changed := false
+	if id := DeviceIDFromHeader(msg.Header); !id.IsZero() && id != s.DeviceID {
+		s.DeviceID = id
+		changed = true
+	}
+
+	if msg.Header.Status == protocol.StatusErrorServer {
+		return changed
+	}
+
+	switch p := msg.Body.(type) {
+	case *protocol.DeviceDataResponse:
+		return s.applyDeviceData(p) || changed
+	case *protocol.PresetRecall:
+		return s.applyPresetRecall(p) || changed
+	case *protocol.LiveCmd:
+		return s.applyLiveCmd(p) || changed
+	default:
+		return changed
+	}
+}
+
+func (s *DeviceState) applyDeviceData(dd *protocol.DeviceDataResponse) bool {
+	return s.applyDeviceInfo(NewDeviceInfo(dd))
+}
+
+func (s *DeviceState) applyDeviceInfo(info DeviceInfo) bool {
+	if s.HasDeviceData && s.DeviceInfo == info {
+		return false
+	}
+
+	s.HasDeviceData = true
+	s.DeviceInfo = info
+	return true
+}
+
+func (s *DeviceState) applyPresetRecall(pr *protocol.PresetRecall) bool {
+	if pr.CrtFlags != protocol.RecallByPresetIndex || s.Preset == int(pr.IndexPosition) {
+		return false
+	}
+	s.Preset = int(pr.IndexPosition)
+	return true
+}
+
+func (s *DeviceState) applyLiveCmd(lc *protocol.LiveCmd) bool {
+	path, err := lc.ParsedPath()
+	if err != nil {
+		return false
+	}
+	key := path.String()
+
+	if lc.HasString() {
+		if v, ok := s.Strings[key]; ok && v == lc.ValueString {
+			return false
+		}
+		s.Strings[key] = lc.ValueString
+		return true
+	}
+
+	if v, ok := s.Values[key]; ok && v == lc.Value {
+		return false
+	}
+	s.Values[key] = lc.Value
+	return true
+}
+
+// stateStore keeps the DeviceState of each device and calls onChange with a snapshot when one changes
+type stateStore struct {
+	mutex    sync.RWMutex
+	states   map[string]*DeviceState
+	onChange func(s DeviceState)
+}
+
+func newStateStore(onChange func(s DeviceState)) *stateStore {
+	return &stateStore{
+		states:   make(map[string]*DeviceState),
+		onChange: onChange,
+	}
+}
+
+func (ss *stateStore) get(addr string) (DeviceState, bool) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	s, ok := ss.states[addr]
+	if !ok {
+		return DeviceState{}, false
+	}
+	return s.clone(), true
+}
+
+func (ss *stateStore) all() []DeviceState {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	ret := make([]DeviceState, 0, len(ss.states))
+	for _, s := range ss.states {
+		ret = append(ret, s.clone())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Addr < ret[j].Addr
+	})
+	return ret
+}
+
+// update applies fn to the state of addr, creating it if necessary,
+// and calls onChange if fn reports a change.
+func (ss *stateStore) update(addr string, fn func(s *DeviceState) bool) {
+	ss.apply(addr, true, fn)
+}
+
+// updateExisting is like update, but does nothing if there is no state for addr, for
+// example because the client sends to a broadcast address or was already removed.
+func (ss *stateStore) updateExisting(addr string, fn func(s *DeviceState) bool) {
+	ss.apply(addr, false, fn)
+}
+
+func (ss *stateStore) apply(addr string, create bool, fn func(s *DeviceState) bool) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	s, ok := ss.states[addr]
+	if !ok {
+		if !create {
+			return
+		}
+		state := NewDeviceState(addr)
+		s = &state
+		ss.states[addr] = s
+	}
+
+	if !fn(s) {
+		return
+	}
+	s.UpdatedAt = time.Now()
+
+	if ss.onChange != nil {
+		ss.onChange(s.clone())
+	}
+}
+
+// move changes the address of the state at from to to, and calls onChange
+func (ss *stateStore) move(from string, to string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	s, ok := ss.states[from]
+	if !ok {
+		return
+	}
+	delete(ss.states, from)
+	s.Addr = to
+	s.UpdatedAt = time.Now()
+	ss.states[to] = s
+
+	if ss.onChange != nil {
+		ss.onChange(s.clone())
+	}
+}
+
+func (ss *stateStore) remove(addr string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	delete(ss.states, addr)
+}
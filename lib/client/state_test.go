@@ -0,0 +1,67 @@
+package client
+
+import (
+	"ppa-control/lib/protocol"
+	"testing"
+)
+
+func TestDeviceStateUpdates(t *testing.T) {
+	mustRequest := func(req Request, err error) Request {
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		return req
+	}
+	receivedMessage := func(messageType protocol.MessageType, payload protocol.Message) ReceivedMessage {
+		packet := &protocol.Packet{
+			Header:  protocol.NewBasicHeader(messageType, protocol.StatusResponseServer, [4]byte{}, 1, 0xff),
+			Payload: payload,
+		}
+		buf, err := packet.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+		return ReceivedMessage{Header: packet.Header, Body: payload, Data: buf}
+	}
+
+	deviceName := [32]byte{}
+	copy(deviceName[:], "Stage Left")
+
+	s := NewDeviceState("10.0.0.1:5001")
+
+	if !s.applyRequest(mustRequest(NewPresetRecallByPresetIndexRequest(3))) || s.Preset != 3 {
+		t.Errorf("Expected preset 3, got %d", s.Preset)
+	}
+	if !s.applyRequest(mustRequest(NewMasterVolumeRequest(0.5))) || s.MasterVolume != 0.5 {
+		t.Errorf("Expected master volume 0.5, got %g", s.MasterVolume)
+	}
+	if !s.applyRequest(mustRequest(NewMuteRequest(protocol.Output(1), true))) {
+		t.Error("Expected mute to change the state")
+	}
+	if s.applyRequest(mustRequest(NewMuteRequest(protocol.Output(1), true))) {
+		t.Error("Expected repeated mute not to change the state")
+	}
+	if muted, ok := s.Muted(protocol.Output(1)); !ok || !muted {
+		t.Errorf("Expected output 1 to be muted, got %v (known: %v)", muted, ok)
+	}
+
+	s.applyMessage(receivedMessage(protocol.MessageTypeLiveCmd, &protocol.LiveCmd{
+		Path:  [10]byte{0, byte(protocol.LevelTypeInput), 0, byte(protocol.LevelTypeGain)},
+		Value: 740,
+	}))
+	if gain, ok := s.Gain(protocol.Input(0)); !ok || gain != -6 {
+		t.Errorf("Expected input 0 gain -6 dB, got %g (known: %v)", gain, ok)
+	}
+
+	s.applyMessage(receivedMessage(protocol.MessageTypeDeviceData, &protocol.DeviceDataResponse{
+		DeviceName:      deviceName,
+		FirmwareVersion: 0x01020304,
+		SerialNumber:    4711,
+	}))
+	if !s.HasDeviceData || s.Name != "Stage Left" || s.SerialNumber != 4711 {
+		t.Errorf("Unexpected device data in state: %+v", s)
+	}
+	if s.LastSeen.IsZero() {
+		t.Error("Expected LastSeen to be set")
+	}
+}
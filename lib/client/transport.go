@@ -0,0 +1,380 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"ppa-control/lib/protocol"
+	"ppa-control/lib/utils"
+	"sync"
+	"syscall"
+
+	"github.com/augustoroman/hexdump"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// packet is a datagram received by a Transport. Header is nil if it could not be decoded,
+// Body is nil if there is no payload or it could not be decoded, see BodyErr.
+type packet struct {
+	Header        *protocol.BasicHeader
+	Body          protocol.Message
+	BodyErr       error
+	RemoteAddress net.Addr
+	Data          []byte
+}
+
+// packetHandler is called by the read loop of a Transport, and should not block for long,
+// as it holds up the packets of all the other clients on the interface.
+type packetHandler func(p packet)
+
+// endpoint is a client registered with a Transport
+type endpoint struct {
+	addr    string
+	handler packetHandler
+}
+
+// Transport is a UDP socket bound to an interface, shared by the clients of all the
+// devices reached through that interface. A single read loop dispatches received packets
+// to the client registered for their source address. Packets from an unknown address
+// go to the client the DeviceID in their header was last seen with, in case the device
+// moved, or else to the broadcast clients. The discovery clients receive every packet,
+// see NewDiscoveryClient.
+type Transport struct {
+	Interface string
+
+	conn    net.PacketConn
+	ready   chan struct{}
+	stopped chan struct{}
+	err     error
+
+	mutex     sync.RWMutex
+	byAddr    map[string]*endpoint
+	byID      map[DeviceID]*endpoint
+	broadcast map[*endpoint]struct{}
+	monitors  map[*endpoint]struct{}
+}
+
+func NewTransport(iface string) *Transport {
+	return &Transport{
+		Interface: iface,
+		ready:     make(chan struct{}),
+		stopped:   make(chan struct{}),
+		byAddr:    make(map[string]*endpoint),
+		byID:      make(map[DeviceID]*endpoint),
+		broadcast: make(map[*endpoint]struct{}),
+		monitors:  make(map[*endpoint]struct{}),
+	}
+}
+
+// Run opens the socket and reads from it until ctx is done or reading fails.
+func (t *Transport) Run(ctx context.Context) (err error) {
+	defer func() {
+		t.err = err
+		close(t.stopped)
+	}()
+
+	conn, err := utils.ListenUDP(ctx, "0.0.0.0:0", t.Interface)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	close(t.ready)
+
+	// closing the socket unblocks the read loop
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	log.Info().
+		Str("iface", t.Interface).
+		Str("local", conn.LocalAddr().String()).
+		Msg("Transport started")
+	defer func() {
+		log.Info().
+			Str("iface", t.Interface).
+			Str("local", conn.LocalAddr().String()).
+			Msg("Exiting transport read loop")
+	}()
+
+	for {
+		buffer := make([]byte, MaxBufferSize)
+		nRead, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var syscallErr *os.SyscallError
+			if errors.As(err, &syscallErr) && syscallErr.Err == syscall.ECONNREFUSED {
+				log.Warn().Str("iface", t.Interface).Msg("Connection refused")
+				continue
+			}
+			log.Warn().Err(err).Str("iface", t.Interface).Msg("Failed to read from connection")
+			return err
+		}
+
+		if zerolog.GlobalLevel() == zerolog.DebugLevel {
+			fmt.Printf("%s\n", hexdump.Dump(buffer[:nRead]))
+		}
+		log.Info().Int("received", nRead).
+			Str("from", addr.String()).
+			Str("iface", t.Interface).
+			Str("local", conn.LocalAddr().String()).
+			Bytes("data", buffer[:nRead]).
+			Msg("Received packet")
+
+		p := packet{RemoteAddress: addr, Data: buffer[:nRead]}
+		hdr, err := protocol.ParseHeader(p.Data)
+		if err != nil {
+			log.Warn().Err(err).
+				Bytes("payload", p.Data).
+				Msg("Could not decode incoming message")
+		} else {
+			p.Header = hdr
+			p.Body, p.BodyErr = protocol.DecodePayload(hdr, p.Data[protocol.HeaderSize:])
+			if p.BodyErr != nil {
+				log.Debug().Err(p.BodyErr).
+					Str("from", addr.String()).
+					Str("type", hdr.MessageType.String()).
+					Msg("Could not decode payload")
+			}
+		}
+
+		t.dispatch(p)
+	}
+}
+
+// Done is closed once Run returned
+func (t *Transport) Done() <-chan struct{} {
+	return t.stopped
+}
+
+// Err returns the error Run returned, once Done is closed
+func (t *Transport) Err() error {
+	<-t.stopped
+	return t.err
+}
+
+func (t *Transport) dispatch(p packet) {
+	id := DeviceIDFromHeader(p.Header)
+
+	t.mutex.Lock()
+	ep, ok := t.byAddr[p.RemoteAddress.String()]
+	if ok && !id.IsZero() {
+		t.byID[id] = ep
+	} else if !ok && !id.IsZero() {
+		ep, ok = t.byID[id]
+	}
+	var handlers []packetHandler
+	if ok {
+		handlers = append(handlers, ep.handler)
+	} else {
+		for b := range t.broadcast {
+			handlers = append(handlers, b.handler)
+		}
+	}
+	for m := range t.monitors {
+		handlers = append(handlers, m.handler)
+	}
+	t.mutex.Unlock()
+
+	if len(handlers) == 0 {
+		log.Debug().
+			Str("from", p.RemoteAddress.String()).
+			Str("iface", t.Interface).
+			Msg("Dropping packet from unknown sender")
+		return
+	}
+	for _, handler := range handlers {
+		handler(p)
+	}
+}
+
+// register routes the packets from addr to handler. If broadcast is set or addr is the
+// limited broadcast address, handler receives the packets of all the senders that have no client.
+func (t *Transport) register(addr string, broadcast bool, handler packetHandler) (*endpoint, error) {
+	ep := &endpoint{addr: addr, handler: handler}
+	limited, err := isBroadcastAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	broadcast = broadcast || limited
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if broadcast {
+		t.broadcast[ep] = struct{}{}
+		return ep, nil
+	}
+	if _, exists := t.byAddr[addr]; exists {
+		return nil, &ErrClientExists{Addr: addr}
+	}
+	t.byAddr[addr] = ep
+	return ep, nil
+}
+
+// monitor passes all received packets to handler, in addition to the client they are
+// routed to. addr is the address the client sends to.
+func (t *Transport) monitor(addr string, handler packetHandler) *endpoint {
+	ep := &endpoint{addr: addr, handler: handler}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.monitors[ep] = struct{}{}
+	return ep
+}
+
+// readdress routes the packets from addr to ep instead of its previous address
+func (t *Transport) readdress(ep *endpoint, addr string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if other, exists := t.byAddr[addr]; exists && other != ep {
+		return &ErrClientExists{Addr: addr}
+	}
+	if t.byAddr[ep.addr] == ep {
+		delete(t.byAddr, ep.addr)
+	}
+	ep.addr = addr
+	t.byAddr[addr] = ep
+	return nil
+}
+
+func (t *Transport) unregister(ep *endpoint) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.broadcast, ep)
+	delete(t.monitors, ep)
+	if t.byAddr[ep.addr] == ep {
+		delete(t.byAddr, ep.addr)
+	}
+	for id, e := range t.byID {
+		if e == ep {
+			delete(t.byID, id)
+		}
+	}
+}
+
+// WriteTo sends buf to addr once the socket is open
+func (t *Transport) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.ready:
+	case <-t.stopped:
+		return 0, fmt.Errorf("transport for interface %q stopped: %w", t.Interface, t.err)
+	}
+	return t.conn.WriteTo(buf, addr)
+}
+
+// LocalAddr returns the address of the socket, or nil if it is not open yet
+func (t *Transport) LocalAddr() net.Addr {
+	select {
+	case <-t.ready:
+		return t.conn.LocalAddr()
+	default:
+		return nil
+	}
+}
+
+func isBroadcastAddress(addr string) (bool, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return false, err
+	}
+	return raddr.IP.Equal(net.IPv4bcast), nil
+}
+
+// TransportPool shares one Transport per interface between clients. A transport is
+// started by the first client that acquires it, and stopped when the last one releases it.
+type TransportPool struct {
+	mutex      sync.Mutex
+	transports map[string]*pooledTransport
+	wg         sync.WaitGroup
+}
+
+type pooledTransport struct {
+	transport *Transport
+	refs      int
+	cancel    context.CancelFunc
+}
+
+func NewTransportPool() *TransportPool {
+	return &TransportPool{
+		transports: make(map[string]*pooledTransport),
+	}
+}
+
+// Acquire returns the transport of iface, starting it if necessary.
+// release has to be called once the transport is not used anymore.
+func (tp *TransportPool) Acquire(iface string) (t *Transport, release func()) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	pt, ok := tp.transports[iface]
+	if !ok {
+		// transports outlive the clients that start them, so they get their own context
+		ctx, cancel := context.WithCancel(context.Background())
+		pt = &pooledTransport{transport: NewTransport(iface), cancel: cancel}
+		tp.transports[iface] = pt
+
+		tp.wg.Add(1)
+		go func() {
+			defer tp.wg.Done()
+			err := pt.transport.Run(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Str("iface", iface).Msg("transport stopped with error")
+			}
+
+			// a transport that failed is replaced on the next Acquire
+			tp.mutex.Lock()
+			defer tp.mutex.Unlock()
+			if tp.transports[iface] == pt {
+				delete(tp.transports, iface)
+			}
+		}()
+	}
+	pt.refs++
+
+	var once sync.Once
+	return pt.transport, func() {
+		once.Do(func() {
+			tp.release(iface, pt)
+		})
+	}
+}
+
+func (tp *TransportPool) release(iface string, pt *pooledTransport) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	pt.refs--
+	if pt.refs > 0 {
+		return
+	}
+	pt.cancel()
+	if tp.transports[iface] == pt {
+		delete(tp.transports, iface)
+	}
+}
+
+// Len returns the number of open transports
+func (tp *TransportPool) Len() int {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	return len(tp.transports)
+}
+
+// Wait waits for all released transports to stop
+func (tp *TransportPool) Wait() {
+	tp.wg.Wait()
+}
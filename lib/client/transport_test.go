@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"ppa-control/lib/protocol"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// startResponder starts a fake device on localhost that acknowledges every request
+// with the given unique id, echoing its payload. DeviceData requests are answered with
+// the name "responder" and the last byte of id as serial number.
+// It returns the address of the device.
+func startResponder(tb testing.TB, id DeviceID) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hdr, err := protocol.ParseHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			reply := protocol.NewBasicHeader(hdr.MessageType, protocol.StatusResponseServer, id, hdr.SequenceNumber, hdr.ComponentId)
+			data, _ := reply.MarshalBinary()
+			if hdr.MessageType == protocol.MessageTypeDeviceData && hdr.Status == protocol.StatusRequestServer {
+				dd := &protocol.DeviceDataResponse{SerialNumber: uint16(id[3])}
+				copy(dd.DeviceName[:], "responder")
+				payload, _ := dd.MarshalBinary()
+				data = append(data, payload...)
+			} else {
+				data = append(data, buf[protocol.HeaderSize:n]...)
+			}
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// startDevices starts a client for each of the addresses and waits until they are running
+func startDevices(tb testing.TB, ctx context.Context, addrs []string, transports *TransportPool) []*SingleDevice {
+	devices := make([]*SingleDevice, len(addrs))
+	for i, addr := range addrs {
+		c := NewSingleDevice(addr, "", 0xff)
+		c.transports = transports
+		devices[i] = c
+		go func() {
+			_ = c.Run(ctx, nil)
+		}()
+	}
+	for _, c := range devices {
+		if _, err := c.SendAndWait(ctx, NewPingRequest()); err != nil {
+			tb.Fatalf("Failed to ping %s: %v", c.Address(), err)
+		}
+	}
+	return devices
+}
+
+func TestSharedTransportDispatchesBySourceAddress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs := []string{
+		startResponder(t, DeviceID{0, 0, 0, 1}),
+		startResponder(t, DeviceID{0, 0, 0, 2}),
+		startResponder(t, DeviceID{}),
+	}
+	transports := NewTransportPool()
+	devices := startDevices(t, ctx, addrs, transports)
+
+	if transports.Len() != 1 {
+		t.Errorf("Expected 1 shared transport, got %d", transports.Len())
+	}
+	for i, c := range devices {
+		req, _ := NewPresetRecallByPresetIndexRequest(i)
+		reply, err := c.SendAndWait(ctx, req)
+		if err != nil {
+			t.Fatalf("Failed to recall preset on %s: %v", addrs[i], err)
+		}
+		if reply.RemoteAddress.String() != addrs[i] {
+			t.Errorf("Expected reply from %s, got %s", addrs[i], reply.RemoteAddress)
+		}
+		recall, ok := reply.Body.(*protocol.PresetRecall)
+		if !ok {
+			t.Fatalf("Expected a *protocol.PresetRecall body, got %T (%v)", reply.Body, reply.BodyErr)
+		}
+		if int(recall.IndexPosition) != i {
+			t.Errorf("Expected preset %d to be echoed, got %d", i, recall.IndexPosition)
+		}
+	}
+
+	cancel()
+	transports.Wait()
+	if transports.Len() != 0 {
+		t.Errorf("Expected transports to be released, got %d", transports.Len())
+	}
+}
+
+func TestTransportDispatchesToBroadcastClients(t *testing.T) {
+	tests := []struct {
+		name      string
+		addr      string
+		broadcast bool
+		expected  bool
+	}{
+		{"limited broadcast", "255.255.255.255:5001", false, true},
+		{"directed broadcast", "192.168.1.255:5001", true, true},
+		{"device", "192.168.1.255:5001", false, false},
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 5001}
+	for _, tt := range tests {
+		tr := NewTransport("eth0")
+		received := false
+		if _, err := tr.register(tt.addr, tt.broadcast, func(p packet) { received = true }); err != nil {
+			t.Fatalf("%s: failed to register: %v", tt.name, err)
+		}
+		tr.dispatch(packet{RemoteAddress: from})
+		if received != tt.expected {
+			t.Errorf("%s: expected received %v, got %v", tt.name, tt.expected, received)
+		}
+	}
+}
+
+func TestDiscoveryClientSharesTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transports := NewTransportPool()
+	addr := startResponder(t, DeviceID{0, 0, 0, 1})
+	device := startDevices(t, ctx, []string{addr}, transports)[0]
+
+	receivedCh := make(chan ReceivedMessage, InboxSize)
+	discovery := NewDiscoveryClient("255.255.255.255:45003", "", 0xfe, transports)
+	go func() {
+		_ = discovery.Run(ctx, receivedCh)
+	}()
+
+	// the replies to the device client are seen by the discovery client too,
+	// so that the discovery doesn't lose devices that have a client
+	for {
+		if _, err := device.SendAndWait(ctx, NewPingRequest()); err != nil {
+			t.Fatalf("Failed to ping %s: %v", addr, err)
+		}
+		select {
+		case m := <-receivedCh:
+			if m.RemoteAddress.String() != addr {
+				t.Errorf("Expected a message from %s, got %s", addr, m.RemoteAddress)
+			}
+			if transports.Len() != 1 {
+				t.Errorf("Expected 1 shared transport, got %d", transports.Len())
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+			// the discovery client may not be registered yet
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the discovery client to receive the reply")
+		}
+	}
+}
+
+func TestSlowReceiverDoesNotBlockSharedTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transports := NewTransportPool()
+	slow := NewSingleDevice(startResponder(t, DeviceID{0, 0, 0, 1}), "", 0xff)
+	slow.transports = transports
+	go func() {
+		// nobody reads the received messages of slow
+		_ = slow.Run(ctx, make(chan ReceivedMessage))
+	}()
+	other := startDevices(t, ctx, []string{startResponder(t, DeviceID{0, 0, 0, 2})}, transports)[0]
+
+	// the inbox of slow fills up, and later messages are dropped
+	for i := 0; i < InboxSize+10; i++ {
+		if _, err := slow.SendAndWait(ctx, NewPingRequest()); err != nil {
+			t.Fatalf("Failed to ping the slow receiver: %v", err)
+		}
+	}
+	if _, err := other.SendAndWait(ctx, NewPingRequest()); err != nil {
+		t.Fatalf("Failed to ping the other device: %v", err)
+	}
+}
+
+// pollingDevice is a client like the ones before the shared transport, with its own socket,
+// send loop and read loop polling with a 200 ms deadline. It is only used by BenchmarkTransports.
+type pollingDevice struct {
+	addr    net.Addr
+	sendCh  chan []byte
+	replies chan uint16
+	seq     uint16
+}
+
+func startPollingDevices(tb testing.TB, ctx context.Context, addrs []string) []*pollingDevice {
+	devices := make([]*pollingDevice, len(addrs))
+	for i, addr := range addrs {
+		remote, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			tb.Fatalf("Failed to resolve %s: %v", addr, err)
+		}
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			tb.Fatalf("Failed to listen: %v", err)
+		}
+		tb.Cleanup(func() { _ = conn.Close() })
+
+		d := &pollingDevice{
+			addr:    remote,
+			sendCh:  make(chan []byte),
+			replies: make(chan uint16, 1),
+		}
+		devices[i] = d
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case buf := <-d.sendCh:
+					go func() { _, _ = conn.WriteTo(buf, d.addr) }()
+				}
+			}
+		}()
+		go func() {
+			for ctx.Err() == nil {
+				buffer := make([]byte, MaxBufferSize)
+				if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+					return
+				}
+				n, _, err := conn.ReadFrom(buffer)
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						continue
+					}
+					return
+				}
+				if hdr, err := protocol.ParseHeader(buffer[:n]); err == nil {
+					d.replies <- hdr.SequenceNumber
+				}
+			}
+		}()
+	}
+	return devices
+}
+
+func (d *pollingDevice) ping(ctx context.Context) error {
+	d.seq++
+	data, _ := protocol.NewBasicHeader(protocol.MessageTypePing, protocol.StatusRequestServer, DeviceID{}, d.seq, 0xff).MarshalBinary()
+	d.sendCh <- data
+	for {
+		select {
+		case seq := <-d.replies:
+			if seq == d.seq {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// idleCPU returns the CPU time per second used by the process while the devices are idle
+func idleCPU() time.Duration {
+	start, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+	time.Sleep(time.Second)
+	end, _ := processCPUTime()
+	return end - start
+}
+
+// benchmarkDevices pings numDevices fake devices concurrently on each iteration, and reports
+// the number of goroutines and sockets used by the clients and a discovery client, and the
+// CPU time they use per second while idle. design is "shared" for clients sharing one transport, "per-device" for
+// clients with a private transport each, and "polling" for the clients before the shared
+// transport, see pollingDevice.
+func benchmarkDevices(b *testing.B, numDevices int, design string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrs := make([]string, numDevices)
+	for i := range addrs {
+		addrs[i] = startResponder(b, DeviceID{0, 0, 0, byte(i + 1)})
+	}
+
+	baseline := runtime.NumGoroutine()
+	// the devices and the discovery client listening next to them
+	sockets := numDevices + 1
+	var transports *TransportPool
+	if design == "shared" {
+		transports = NewTransportPool()
+	}
+	discovery := NewDiscoveryClient("255.255.255.255:45004", "", 0xfe, transports)
+	go func() {
+		_ = discovery.Run(ctx, nil)
+	}()
+
+	var pings []func() error
+	switch design {
+	case "polling":
+		for _, d := range startPollingDevices(b, ctx, addrs) {
+			pings = append(pings, func() error { return d.ping(ctx) })
+		}
+	default:
+		for _, c := range startDevices(b, ctx, addrs, transports) {
+			pings = append(pings, func() error {
+				_, err := c.SendAndWait(ctx, NewPingRequest())
+				return err
+			})
+		}
+		if transports != nil {
+			sockets = transports.Len()
+		}
+	}
+	goroutines := runtime.NumGoroutine() - baseline
+	idle := idleCPU()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, ping := range pings {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := ping(); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	b.ReportMetric(float64(goroutines), "goroutines")
+	b.ReportMetric(float64(sockets), "sockets")
+	b.ReportMetric(float64(idle.Microseconds()), "idle-cpu-us/s")
+}
+
+func BenchmarkTransports(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(level)
+
+	for _, numDevices := range []int{1, 40} {
+		for _, design := range []string{"shared", "per-device", "polling"} {
+			b.Run(fmt.Sprintf("%s/%d", design, numDevices), func(b *testing.B) {
+				benchmarkDevices(b, numDevices, design)
+			})
+		}
+	}
+}
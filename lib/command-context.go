@@ -2,11 +2,13 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"ppa-control/lib/client"
 	"ppa-control/lib/client/discovery"
+	"ppa-control/lib/protocol"
 	"strconv"
 	"strings"
 
@@ -22,12 +24,14 @@ type CommandConfig struct {
 	ComponentID uint
 	Port        uint
 	Interfaces  []string
+	// DiscoveryOptions configures the timing and broadcast addresses of the discovery
+	DiscoveryOptions discovery.Options
 }
 
-// CommandChannels holds common channels used across commands
+// CommandChannels holds common channels used across commands.
+// Messages received from devices are delivered as events, see client.MultiClient.Subscribe.
 type CommandChannels struct {
 	DiscoveryCh chan discovery.PeerInformation
-	ReceivedCh  chan client.ReceivedMessage
 }
 
 // CommandContext encapsulates all command execution context and resources
@@ -108,15 +112,54 @@ func SetupCommand(cmd *cobra.Command) *CommandContext {
 		}
 	}
 
+	cfg.DiscoveryOptions = discovery.DefaultOptions
+	if ranges, err := cmd.Flags().GetStringSlice("scan"); err == nil && len(ranges) > 0 {
+		prefixes, err := discovery.ParseScanRanges(ranges)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --scan")
+		}
+		// sweeping ranges is a discovery mode
+		cfg.Discovery = true
+		cfg.DiscoveryOptions.ScanRanges = prefixes
+	}
+
 	if cfg.Discovery {
 		if interfaces, err := cmd.Flags().GetStringArray("interfaces"); err == nil {
 			cfg.Interfaces = interfaces
 		}
 	}
 
+	if d, err := cmd.Flags().GetDuration("ping-interval"); err == nil {
+		cfg.DiscoveryOptions.PingInterval = d
+	}
+	if d, err := cmd.Flags().GetDuration("peer-timeout"); err == nil {
+		cfg.DiscoveryOptions.PeerTimeout = d
+	}
+	if d, err := cmd.Flags().GetDuration("rescan-interval"); err == nil {
+		cfg.DiscoveryOptions.InterfaceRescanInterval = d
+	}
+	if n, err := cmd.Flags().GetInt("burst-pings"); err == nil {
+		cfg.DiscoveryOptions.InitialBurstPings = n
+	}
+	if s, err := cmd.Flags().GetString("broadcast"); err == nil {
+		mode, err := discovery.ParseBroadcastMode(s)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --broadcast")
+		}
+		cfg.DiscoveryOptions.Broadcast = mode
+	}
+
+	// commands are checked against the models of the devices, see protocol.LoadModels
+	if path, err := cmd.Flags().GetString("models"); err == nil && path != "" {
+		n, err := protocol.LoadModels(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --models")
+		}
+		log.Info().Str("path", path).Int("models", n).Msg("loaded device models")
+	}
+
 	channels := &CommandChannels{
 		DiscoveryCh: make(chan discovery.PeerInformation),
-		ReceivedCh:  make(chan client.ReceivedMessage),
 	}
 
 	// Setup context with cancellation
@@ -159,32 +202,90 @@ func (cc *CommandContext) SetupMultiClient(name string) error {
 // StartMultiClient starts the MultiClient in the error group
 func (cc *CommandContext) StartMultiClient() {
 	cc.group.Go(func() error {
-		return cc.multiClient.Run(cc.ctx, cc.Channels.ReceivedCh)
+		return cc.multiClient.Run(cc.ctx, nil)
 	})
 }
 
-// SetupDiscovery starts the discovery process if enabled
+// SetupDiscovery starts the discovery process if enabled. If the MultiClient is set up,
+// the discovery shares its sockets.
 func (cc *CommandContext) SetupDiscovery() {
 	if cc.Config.Discovery {
+		opts := cc.Config.DiscoveryOptions
+		if cc.multiClient != nil {
+			opts.Transports = cc.multiClient.Transports()
+		}
 		cc.group.Go(func() error {
-			return discovery.Discover(cc.ctx, cc.Channels.DiscoveryCh, cc.Config.Interfaces, uint16(cc.Config.Port))
+			return discovery.DiscoverWithOptions(cc.ctx, cc.Channels.DiscoveryCh, cc.Config.Interfaces, uint16(cc.Config.Port), opts)
 		})
 	}
 }
 
+// SetupDiscoveryClients starts the discovery process if enabled, and adds and removes
+// clients of the MultiClient for discovered and lost peers. New clients are
+// announced as client.DeviceOnline events.
+func (cc *CommandContext) SetupDiscoveryClients() {
+	if !cc.Config.Discovery {
+		return
+	}
+
+	// the MultiClient queries the DeviceData of the clients it adds
+	cc.Config.DiscoveryOptions.SkipDeviceData = true
+	cc.SetupDiscovery()
+	cc.group.Go(func() error {
+		for {
+			select {
+			case <-cc.ctx.Done():
+				return cc.ctx.Err()
+			case msg := <-cc.Channels.DiscoveryCh:
+				log.Debug().Str("addr", msg.GetAddress()).Msg("discovery message")
+				if _, err := cc.HandleDiscoveryMessage(msg); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
 // HandleDiscoveryMessage processes discovery messages and updates the MultiClient accordingly
 func (cc *CommandContext) HandleDiscoveryMessage(msg discovery.PeerInformation) (client.Client, error) {
-	switch msg.(type) {
+	switch m := msg.(type) {
 	case discovery.PeerDiscovered:
 		log.Info().
 			Str("addr", msg.GetAddress()).
 			Str("iface", msg.GetInterface()).
+			Str("name", m.Name()).
 			Msg("peer discovered")
 		return cc.multiClient.AddClient(cc.ctx, msg.GetAddress(), msg.GetInterface(), cc.Config.ComponentID)
+	case discovery.PeerMoved:
+		log.Info().
+			Str("addr", msg.GetAddress()).
+			Str("previousAddr", m.GetPreviousAddress()).
+			Str("iface", msg.GetInterface()).
+			Str("name", m.Name()).
+			Msg("peer moved")
+		err := cc.multiClient.MoveClient(m.GetPreviousAddress(), msg.GetAddress())
+		var notFound *client.ErrClientNotFound
+		if errors.As(err, &notFound) {
+			return cc.multiClient.AddClient(cc.ctx, msg.GetAddress(), msg.GetInterface(), cc.Config.ComponentID)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to move client")
+			return nil, err
+		}
+	case discovery.PeerUpdated:
+		e := log.Info().
+			Str("addr", msg.GetAddress()).
+			Str("iface", msg.GetInterface()).
+			Str("name", m.Name())
+		if m.LocalIP.IsValid() {
+			e.Stringer("localIP", m.LocalIP)
+		}
+		e.Msg("peer updated")
 	case discovery.PeerLost:
 		log.Info().
 			Str("addr", msg.GetAddress()).
 			Str("iface", msg.GetInterface()).
+			Str("name", m.Name()).
 			Msg("peer lost")
 		err := cc.multiClient.CancelClient(msg.GetAddress())
 		if err != nil {
@@ -0,0 +1,235 @@
+package presets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"ppa-control/lib/client"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Preset is an entry of the catalog of a device
+type Preset struct {
+	// Index is the preset index used by protocol.RecallByPresetIndex, starting at 0
+	Index int `json:"index"`
+	// Position is the preset position used by protocol.RecallByPresetPosition, -1 if unknown
+	Position int    `json:"position"`
+	Name     string `json:"name"`
+	// LastRecalled is zero if the preset was never recalled through the catalog
+	LastRecalled time.Time `json:"lastRecalled,omitempty"`
+}
+
+// Catalog holds the user-assigned preset names of each device, keyed by DeviceKey,
+// and persists them as JSON. It is safe for concurrent use.
+type Catalog struct {
+	mutex   sync.RWMutex
+	path    string
+	devices map[string]map[int]Preset
+}
+
+// catalogFile is the JSON layout of the catalog file
+type catalogFile struct {
+	Devices map[string][]Preset `json:"devices"`
+}
+
+// DeviceKey identifies a device in the catalog by vendor, device type and serial number,
+// so that its presets are found again after it got a new address.
+func DeviceKey(info client.DeviceInfo) string {
+	return fmt.Sprintf("%d-%d-%d", info.VendorID, info.DeviceTypeId, info.SerialNumber)
+}
+
+// DefaultPath returns the location of the catalog in the user configuration directory
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ppa-control", "presets.json"), nil
+}
+
+// NewCatalog returns an empty catalog that is saved to path
+func NewCatalog(path string) *Catalog {
+	return &Catalog{
+		path:    path,
+		devices: make(map[string]map[int]Preset),
+	}
+}
+
+// Load reads the catalog at path. A missing file returns an empty catalog.
+func Load(path string) (*Catalog, error) {
+	c := NewCatalog(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f catalogFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not parse preset catalog %s: %w", path, err)
+	}
+	for key, presets := range f.Devices {
+		for _, p := range presets {
+			c.set(key, p)
+		}
+	}
+	return c, nil
+}
+
+// Path returns the file the catalog is saved to
+func (c *Catalog) Path() string {
+	return c.path
+}
+
+// Save writes the catalog to its file, creating the directory if needed.
+// The file is replaced atomically, so that a crash never leaves a truncated catalog.
+func (c *Catalog) Save() error {
+	c.mutex.RLock()
+	f := catalogFile{Devices: make(map[string][]Preset, len(c.devices))}
+	for key := range c.devices {
+		f.Devices[key] = c.presets(key)
+	}
+	c.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Devices returns the keys of all devices in the catalog, sorted
+func (c *Catalog) Devices() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.devices))
+	for key := range c.devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Presets returns the presets of the device, sorted by index
+func (c *Catalog) Presets(key string) []Preset {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.presets(key)
+}
+
+func (c *Catalog) presets(key string) []Preset {
+	ret := make([]Preset, 0, len(c.devices[key]))
+	for _, p := range c.devices[key] {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Index < ret[j].Index
+	})
+	return ret
+}
+
+// Preset returns the entry for the preset index of the device
+func (c *Catalog) Preset(key string, index int) (Preset, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	p, ok := c.devices[key][index]
+	return p, ok
+}
+
+// FindByName returns the preset of the device with the given name, ignoring case
+func (c *Catalog) FindByName(key string, name string) (Preset, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, p := range c.presets(key) {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// FindByPosition returns the preset of the device at the given position
+func (c *Catalog) FindByPosition(key string, position int) (Preset, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, p := range c.presets(key) {
+		if p.Position >= 0 && p.Position == position {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// LastRecalled returns the preset of the device that was recalled last
+func (c *Catalog) LastRecalled(key string) (Preset, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var last Preset
+	found := false
+	for _, p := range c.devices[key] {
+		if !p.LastRecalled.IsZero() && (!found || p.LastRecalled.After(last.LastRecalled)) {
+			last = p
+			found = true
+		}
+	}
+	return last, found
+}
+
+// SetName names the preset index of the device, adding it to the catalog if needed
+func (c *Catalog) SetName(key string, index int, name string) {
+	c.update(key, index, func(p *Preset) {
+		p.Name = name
+	})
+}
+
+// SetPosition sets the position of the preset index of the device, -1 if unknown
+func (c *Catalog) SetPosition(key string, index int, position int) {
+	c.update(key, index, func(p *Preset) {
+		p.Position = position
+	})
+}
+
+// MarkRecalled records that the preset index of the device was recalled at t
+func (c *Catalog) MarkRecalled(key string, index int, t time.Time) {
+	c.update(key, index, func(p *Preset) {
+		p.LastRecalled = t
+	})
+}
+
+func (c *Catalog) update(key string, index int, f func(p *Preset)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	p, ok := c.devices[key][index]
+	if !ok {
+		p = Preset{Index: index, Position: -1}
+	}
+	f(&p)
+	c.set(key, p)
+}
+
+func (c *Catalog) set(key string, p Preset) {
+	if c.devices[key] == nil {
+		c.devices[key] = make(map[int]Preset)
+	}
+	c.devices[key][p.Index] = p
+}
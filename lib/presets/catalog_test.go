@@ -0,0 +1,65 @@
+package presets
+
+import (
+	"path/filepath"
+	"ppa-control/lib/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCatalogPersistsPresets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ppa-control", "presets.json")
+	key := DeviceKey(client.DeviceInfo{VendorID: 1, DeviceTypeId: 2, SerialNumber: 3})
+	recalled := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load missing catalog: %v", err)
+	}
+	c.SetName(key, 3, "Soundcheck")
+	c.SetName(key, 0, "Speech")
+	c.SetPosition(key, 3, 5)
+	c.MarkRecalled(key, 0, recalled.Add(-time.Hour))
+	c.MarkRecalled(key, 3, recalled)
+	if err := c.Save(); err != nil {
+		t.Fatalf("Failed to save catalog: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Presets(key), c.Presets(key)) {
+		t.Errorf("Expected %+v, got %+v", c.Presets(key), loaded.Presets(key))
+	}
+
+	tests := []struct {
+		name     string
+		find     func() (Preset, bool)
+		expected int
+	}{
+		{"by name ignoring case", func() (Preset, bool) { return loaded.FindByName(key, "soundcheck") }, 3},
+		{"by position", func() (Preset, bool) { return loaded.FindByPosition(key, 5) }, 3},
+		{"last recalled", func() (Preset, bool) { return loaded.LastRecalled(key) }, 3},
+		{"unknown name", func() (Preset, bool) { return loaded.FindByName(key, "Concert") }, -1},
+		{"unknown position", func() (Preset, bool) { return loaded.FindByPosition(key, -1) }, -1},
+		{"other device", func() (Preset, bool) { return loaded.FindByName("0-0-0", "Speech") }, -1},
+	}
+	for _, tt := range tests {
+		p, ok := tt.find()
+		if tt.expected < 0 {
+			if ok {
+				t.Errorf("%s: expected no preset, got %+v", tt.name, p)
+			}
+			continue
+		}
+		if !ok || p.Index != tt.expected {
+			t.Errorf("%s: expected preset %d, got %+v (%v)", tt.name, tt.expected, p, ok)
+		}
+	}
+
+	if p, _ := loaded.Preset(key, 0); p.Position != -1 {
+		t.Errorf("Expected unknown position -1 for a new preset, got %d", p.Position)
+	}
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"encoding"
+	"io"
+)
+
+// HeaderSize is the size of an encoded BasicHeader
+const HeaderSize = 12
+
+// MaxBufferSize is the maximum size of a packet, header included
+const MaxBufferSize = 1024
+
+// Message is implemented by the BasicHeader, by every payload type and by a complete Packet.
+type Message interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+var _ Message = &BasicHeader{}
+var _ Message = &PresetRecall{}
+var _ Message = &DeviceDataRequest{}
+var _ Message = &DeviceDataResponse{}
+var _ Message = &LiveCmd{}
+var _ Message = &PresetSave{}
+var _ Message = &RawPayload{}
+var _ Message = &Packet{}
+
+// Packet is a complete PPA message, a header followed by an optional payload.
+type Packet struct {
+	Header *BasicHeader
+	// Payload is nil if the message has no payload
+	Payload Message
+}
+
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	buf, err := p.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if p.Payload != nil {
+		payload, err := p.Payload.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, payload...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a complete message, see Decode.
+func (p *Packet) UnmarshalBinary(data []byte) error {
+	decoded, err := Decode(data)
+	if err != nil {
+		return err
+	}
+	*p = *decoded
+	return nil
+}
+
+// RawPayload is used for payloads whose structure is not known.
+type RawPayload []byte
+
+func (r *RawPayload) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), *r...), nil
+}
+
+func (r *RawPayload) UnmarshalBinary(data []byte) error {
+	*r = append(RawPayload(nil), data...)
+	return nil
+}
+
+// Decode parses the header of buf and the payload following it.
+func Decode(buf []byte) (*Packet, error) {
+	hdr, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := DecodePayload(hdr, buf[HeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Packet{
+		Header:  hdr,
+		Payload: payload,
+	}, nil
+}
+
+// DecodePayload parses the payload data of a message with the given header,
+// dispatching on MessageType and Status. It returns nil if data is empty.
+func DecodePayload(hdr *BasicHeader, data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var payload Message
+	switch hdr.MessageType {
+	case MessageTypePing:
+		payload = &RawPayload{}
+
+	case MessageTypeLiveCmd:
+		payload = &LiveCmd{}
+
+	case MessageTypeDeviceData:
+		switch hdr.Status {
+		case StatusRequestServer, StatusRequestClient:
+			payload = &DeviceDataRequest{}
+		case StatusResponseServer, StatusResponseClient:
+			payload = &DeviceDataResponse{}
+		default:
+			payload = &RawPayload{}
+		}
+
+	case MessageTypePresetRecall:
+		payload = &PresetRecall{}
+
+	case MessageTypePresetSave:
+		payload = &PresetSave{}
+
+	default:
+		return nil, &ErrUnknownMessageType{MessageType: hdr.MessageType}
+	}
+
+	switch hdr.Status {
+	case StatusErrorServer, StatusErrorClient:
+		// error replies don't carry the payload of the original message
+		payload = &RawPayload{}
+	}
+
+	if err := payload.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// encode writes the binary encoding of m to w.
+func encode(w io.Writer, m encoding.BinaryMarshaler) error {
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
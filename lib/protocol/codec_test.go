@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRoundTrip(t *testing.T) {
+	deviceName := [32]byte{}
+	copy(deviceName[:], "PPA Amp")
+
+	namedInput, err := NewLiveCmd(WithPath(Input(0)...), WithString("Kick"))
+	if err != nil {
+		t.Fatalf("NewLiveCmd failed: %v", err)
+	}
+	soundcheck, err := NewPresetSave(3, "Soundcheck")
+	if err != nil {
+		t.Fatalf("NewPresetSave failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		packet *Packet
+	}{
+		{
+			name: "Ping without payload",
+			packet: &Packet{
+				Header: NewBasicHeader(MessageTypePing, StatusRequestServer, [4]byte{1, 2, 3, 4}, 42, 0xff),
+			},
+		},
+		{
+			name: "Preset recall",
+			packet: &Packet{
+				Header:  NewBasicHeader(MessageTypePresetRecall, StatusCommandClient, [4]byte{}, 1, 0xff),
+				Payload: NewPresetRecall(RecallByPresetIndex, 0, 7),
+			},
+		},
+		{
+			name: "Preset save",
+			packet: &Packet{
+				Header:  NewBasicHeader(MessageTypePresetSave, StatusCommandClient, [4]byte{}, 7, 0xff),
+				Payload: soundcheck,
+			},
+		},
+		{
+			name: "Device data request",
+			packet: &Packet{
+				Header:  NewBasicHeader(MessageTypeDeviceData, StatusRequestServer, [4]byte{}, 2, 0xff),
+				Payload: &DeviceDataRequest{CrtFlags: 0, OptFlags: 0},
+			},
+		},
+		{
+			name: "Device data response",
+			packet: &Packet{
+				Header: NewBasicHeader(MessageTypeDeviceData, StatusResponseServer, [4]byte{9, 8, 7, 6}, 3, 0xff),
+				Payload: &DeviceDataResponse{
+					DeviceTypeId:       0x1234,
+					SubnetPrefixLength: 24,
+					FirmwareVersion:    0x01020304,
+					SerialNumber:       4711,
+					GatewayIP:          [4]byte{192, 168, 1, 1},
+					StaticIP:           [4]byte{192, 168, 1, 10},
+					HardwareFeatures:   0x5,
+					StartPresetId:      2,
+					DeviceName:         deviceName,
+					VendorID:           1,
+				},
+			},
+		},
+		{
+			name: "Live command",
+			packet: &Packet{
+				Header: NewBasicHeader(MessageTypeLiveCmd, StatusCommandClient, [4]byte{}, 4, 0xff),
+				Payload: &LiveCmd{
+					Path:  [10]byte{0, byte(LevelTypeOutput), 1, byte(LevelTypeMute)},
+					Value: 1,
+				},
+			},
+		},
+		{
+			name: "Live command with string value",
+			packet: &Packet{
+				Header:  NewBasicHeader(MessageTypeLiveCmd, StatusCommandClient, [4]byte{}, 6, 0xff),
+				Payload: namedInput,
+			},
+		},
+		{
+			name: "Error reply",
+			packet: &Packet{
+				Header:  NewBasicHeader(MessageTypePresetRecall, StatusErrorServer, [4]byte{}, 5, 0xff),
+				Payload: &RawPayload{0xde, 0xad},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.packet.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary failed: %v", err)
+			}
+
+			decoded, err := Decode(buf)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+
+			if !reflect.DeepEqual(decoded, tt.packet) {
+				t.Errorf("Expected %+v, got %+v", tt.packet, decoded)
+			}
+		})
+	}
+}
+
+func TestLiveCmdStringTooLong(t *testing.T) {
+	lc, err := NewLiveCmd(WithString(strings.Repeat("x", MaxLiveCmdStringLength+1)))
+	if err != nil {
+		t.Fatalf("NewLiveCmd failed: %v", err)
+	}
+	_, err = lc.MarshalBinary()
+
+	var e *ErrStringTooLong
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected ErrStringTooLong, got %v", err)
+	}
+	if e.MaxLength != MaxBufferSize-HeaderSize-LiveCmdSize {
+		t.Errorf("Unexpected maximum length %d", e.MaxLength)
+	}
+}
+
+func TestPresetSaveName(t *testing.T) {
+	ps, err := NewPresetSave(1, "Soundcheck")
+	if err != nil {
+		t.Fatalf("NewPresetSave failed: %v", err)
+	}
+	if ps.Name() != "Soundcheck" {
+		t.Errorf("Expected name Soundcheck, got %q", ps.Name())
+	}
+
+	_, err = NewPresetSave(1, strings.Repeat("x", PresetNameSize+1))
+	var e *ErrStringTooLong
+	if !errors.As(err, &e) || e.MaxLength != PresetNameSize {
+		t.Errorf("Expected ErrStringTooLong, got %v", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	header := func(messageType MessageType, status StatusType) []byte {
+		buf, _ := NewBasicHeader(messageType, status, [4]byte{}, 1, 0xff).MarshalBinary()
+		return buf
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		check func(err error) bool
+	}{
+		{
+			name:  "Short header",
+			input: []byte{0, 1, 2},
+			check: func(err error) bool {
+				var e *ErrShortBuffer
+				return errors.As(err, &e) && e.Expected == HeaderSize && e.Actual == 3
+			},
+		},
+		{
+			name:  "Short preset recall",
+			input: append(header(MessageTypePresetRecall, StatusCommandClient), 0, 0),
+			check: func(err error) bool {
+				var e *ErrShortBuffer
+				return errors.As(err, &e) && e.Expected == PresetRecallSize && e.Actual == 2
+			},
+		},
+		{
+			name:  "Trailing data after device data request",
+			input: append(header(MessageTypeDeviceData, StatusRequestServer), 0, 0, 0),
+			check: func(err error) bool {
+				var e *ErrTrailingData
+				return errors.As(err, &e) && e.Expected == DeviceDataRequestSize && e.Actual == 3
+			},
+		},
+		{
+			name:  "Live command string longer than payload",
+			input: append(header(MessageTypeLiveCmd, StatusCommandClient), LiveCmdFlagString, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 'a', 'b'),
+			check: func(err error) bool {
+				var e *ErrShortBuffer
+				return errors.As(err, &e) && e.Expected == LiveCmdSize+5 && e.Actual == LiveCmdSize+2
+			},
+		},
+		{
+			name:  "Unknown message type",
+			input: append(header(MessageType(0x42), StatusCommandClient), 0),
+			check: func(err error) bool {
+				var e *ErrUnknownMessageType
+				return errors.As(err, &e) && e.MessageType == MessageType(0x42)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.input)
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if !tt.check(err) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
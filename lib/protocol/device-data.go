@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FirmwareVersion is the decoded DeviceDataResponse.FirmwareVersion, which is sent as a
+// single uint32. doc/protocol.md only calls it a version number, the layout used here (the
+// major version in the highest byte, followed by the minor version and a 16-bit build
+// number) is an assumption that hasn't been checked against a device. String shows the raw
+// value as well, and Uint32 returns it unchanged.
+type FirmwareVersion struct {
+	Major uint8
+	Minor uint8
+	Build uint16
+}
+
+func ParseFirmwareVersion(v uint32) FirmwareVersion {
+	return FirmwareVersion{
+		Major: uint8(v >> 24),
+		Minor: uint8(v >> 16),
+		Build: uint16(v),
+	}
+}
+
+// Uint32 returns the version as sent in a DeviceDataResponse
+func (f FirmwareVersion) Uint32() uint32 {
+	return uint32(f.Major)<<24 | uint32(f.Minor)<<16 | uint32(f.Build)
+}
+
+// String returns the assumed major.minor.build version followed by the raw value,
+// like "1.2.772 (0x01020304)"
+func (f FirmwareVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d (0x%08x)", f.Major, f.Minor, f.Build, f.Uint32())
+}
+
+// HardwareFeatures holds the feature flags of a device. The meaning of the individual
+// bits is not documented, so they are only reported by position.
+type HardwareFeatures uint32
+
+// Has returns true if the flag at bit (0 to 31) is set
+func (h HardwareFeatures) Has(bit int) bool {
+	return bit >= 0 && bit < 32 && h&(1<<bit) != 0
+}
+
+// Bits returns the positions of the flags that are set, in ascending order
+func (h HardwareFeatures) Bits() []int {
+	var bits []int
+	for bit := 0; bit < 32; bit++ {
+		if h.Has(bit) {
+			bits = append(bits, bit)
+		}
+	}
+	return bits
+}
+
+func (h HardwareFeatures) String() string {
+	bits := h.Bits()
+	if len(bits) == 0 {
+		return "none"
+	}
+	s := make([]string, len(bits))
+	for i, bit := range bits {
+		s[i] = strconv.Itoa(bit)
+	}
+	return fmt.Sprintf("%#x (bits %s)", uint32(h), strings.Join(s, ","))
+}
+
+// DiagnosticState is the decoded DeviceDataResponse.DiagnosticState.
+// A device without problems reports DiagnosticStateOK, any other value is a fault code.
+type DiagnosticState uint8
+
+const DiagnosticStateOK DiagnosticState = 0
+
+func (d DiagnosticState) IsOK() bool {
+	return d == DiagnosticStateOK
+}
+
+func (d DiagnosticState) String() string {
+	if d.IsOK() {
+		return "ok"
+	}
+	return fmt.Sprintf("fault %#02x", uint8(d))
+}
+
+// Name returns the device name without its NUL padding
+func (d *DeviceDataResponse) Name() string {
+	return strings.TrimRight(string(d.DeviceName[:]), "\x00 ")
+}
+
+func (d *DeviceDataResponse) Firmware() FirmwareVersion {
+	return ParseFirmwareVersion(d.FirmwareVersion)
+}
+
+func (d *DeviceDataResponse) Features() HardwareFeatures {
+	return HardwareFeatures(d.HardwareFeatures)
+}
+
+func (d *DeviceDataResponse) Diagnostic() DiagnosticState {
+	return DiagnosticState(d.DiagnosticState)
+}
+
+// IP returns the static IP address of the device
+func (d *DeviceDataResponse) IP() net.IP {
+	return net.IPv4(d.StaticIP[0], d.StaticIP[1], d.StaticIP[2], d.StaticIP[3])
+}
+
+// Gateway returns the gateway IP address of the device
+func (d *DeviceDataResponse) Gateway() net.IP {
+	return net.IPv4(d.GatewayIP[0], d.GatewayIP[1], d.GatewayIP[2], d.GatewayIP[3])
+}
+
+// Network returns the static IP address of the device with its subnet mask,
+// or nil if SubnetPrefixLength is larger than 32.
+func (d *DeviceDataResponse) Network() *net.IPNet {
+	mask := net.CIDRMask(int(d.SubnetPrefixLength), 32)
+	if mask == nil {
+		return nil
+	}
+	return &net.IPNet{IP: d.IP().To4(), Mask: mask}
+}
+
+// networkString formats the static IP address with its prefix length, even if it is invalid
+func (d *DeviceDataResponse) networkString() string {
+	if n := d.Network(); n != nil {
+		return n.String()
+	}
+	return fmt.Sprintf("%s/%d", d.IP(), d.SubnetPrefixLength)
+}
+
+// MarshalJSON encodes the decoded fields, so that logs show a readable device name,
+// firmware version and addresses instead of raw bytes.
+func (d *DeviceDataResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		CrtFlags         uint8
+		OptFlags         uint8
+		DeviceTypeId     uint16
+		VendorID         uint8
+		Name             string
+		SerialNumber     uint16
+		FirmwareVersion  string
+		DiagnosticState  string
+		HardwareFeatures []int
+		Network          string
+		Gateway          string
+		StartPresetId    uint8
+	}{
+		CrtFlags:         d.CrtFlags,
+		OptFlags:         d.OptFlags,
+		DeviceTypeId:     d.DeviceTypeId,
+		VendorID:         d.VendorID,
+		Name:             d.Name(),
+		SerialNumber:     d.SerialNumber,
+		FirmwareVersion:  d.Firmware().String(),
+		DiagnosticState:  d.Diagnostic().String(),
+		HardwareFeatures: d.Features().Bits(),
+		Network:          d.networkString(),
+		Gateway:          d.Gateway().String(),
+		StartPresetId:    d.StartPresetId,
+	})
+}
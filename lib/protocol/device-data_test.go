@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeviceDataResponseAccessors(t *testing.T) {
+	dd := &DeviceDataResponse{
+		SubnetPrefixLength: 24,
+		DiagnosticState:    3,
+		FirmwareVersion:    0x01020304,
+		GatewayIP:          [4]byte{192, 168, 1, 1},
+		StaticIP:           [4]byte{192, 168, 1, 10},
+		HardwareFeatures:   0x5,
+	}
+	copy(dd.DeviceName[:], "PPA Amp")
+
+	tests := []struct {
+		name     string
+		got      string
+		expected string
+	}{
+		{"name", dd.Name(), "PPA Amp"},
+		{"firmware", dd.Firmware().String(), "1.2.772 (0x01020304)"},
+		{"diagnostic", dd.Diagnostic().String(), "fault 0x03"},
+		{"features", dd.Features().String(), "0x5 (bits 0,2)"},
+		{"ip", dd.IP().String(), "192.168.1.10"},
+		{"gateway", dd.Gateway().String(), "192.168.1.1"},
+		{"network", dd.Network().String(), "192.168.1.10/24"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, tt.got)
+		}
+	}
+
+	if v := dd.Firmware().Uint32(); v != dd.FirmwareVersion {
+		t.Errorf("Expected firmware version to round trip, got %#x", v)
+	}
+	if bits := dd.Features().Bits(); !reflect.DeepEqual(bits, []int{0, 2}) {
+		t.Errorf("Expected feature bits [0 2], got %v", bits)
+	}
+	if !DiagnosticStateOK.IsOK() || dd.Diagnostic().IsOK() {
+		t.Error("Expected only DiagnosticStateOK to be ok")
+	}
+
+	dd.SubnetPrefixLength = 33
+	if n := dd.Network(); n != nil {
+		t.Errorf("Expected no network for an invalid prefix length, got %v", n)
+	}
+
+	data, err := json.Marshal(dd)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	for _, s := range []string{`"Name":"PPA Amp"`, `"FirmwareVersion":"1.2.772 (0x01020304)"`, `"Network":"192.168.1.10/33"`} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("Expected %s in %s", s, data)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DeviceModel describes what a type of device supports, so that commands for channels,
+// EQ bands or presets it doesn't have can be rejected before they are sent.
+// Models are looked up by the VendorID and DeviceTypeId of a DeviceDataResponse.
+type DeviceModel struct {
+	Name         string
+	VendorID     uint8
+	DeviceTypeId uint16
+
+	Inputs  int
+	Outputs int
+	// EqBands is the number of EQ bands of every input and output channel
+	EqBands int
+	// LevelTypes lists the parameters the device supports. If empty, all are supported.
+	LevelTypes []LevelType
+	// PresetSlots is the number of presets, which are recalled by index from 0 to PresetSlots-1
+	PresetSlots int
+
+	Quirks []Quirk
+}
+
+// Quirk is a known issue of the firmware of a model
+type Quirk struct {
+	Description string
+	// FixedIn is the first firmware version without the issue, zero if it is not fixed yet
+	FixedIn FirmwareVersion
+}
+
+// ModelKey identifies a DeviceModel
+type ModelKey struct {
+	VendorID     uint8
+	DeviceTypeId uint16
+}
+
+func (m *DeviceModel) Key() ModelKey {
+	return ModelKey{VendorID: m.VendorID, DeviceTypeId: m.DeviceTypeId}
+}
+
+// Supports returns true if the device has parameters of type lt
+func (m *DeviceModel) Supports(lt LevelType) bool {
+	if len(m.LevelTypes) == 0 || isContainer(lt) {
+		return true
+	}
+	for _, supported := range m.LevelTypes {
+		if supported == lt {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePath checks that the channels and EQ bands addressed by p exist on the model,
+// and that its parameter is supported. It doesn't check the LevelType hierarchy, see Path.Validate.
+func (m *DeviceModel) ValidatePath(p Path) error {
+	for i, tuple := range p {
+		var count int
+		switch tuple.LevelType {
+		case LevelTypeInput:
+			count = m.Inputs
+		case LevelTypeOutput:
+			count = m.Outputs
+		case LevelTypeEq:
+			count = m.EqBands
+		default:
+			if !m.Supports(tuple.LevelType) {
+				return &ErrInvalidPath{
+					Path:   p,
+					Index:  i,
+					Reason: fmt.Sprintf("%s does not support %s", m.Name, pathNames[tuple.LevelType]),
+				}
+			}
+			continue
+		}
+
+		if int(tuple.Position) >= count {
+			return &ErrInvalidPath{
+				Path:  p,
+				Index: i,
+				Reason: fmt.Sprintf("%s %d does not exist on %s, which has %d",
+					pathNames[tuple.LevelType], tuple.Position, m.Name, count),
+			}
+		}
+	}
+	return nil
+}
+
+// ValidatePreset checks that the preset index exists on the model
+func (m *DeviceModel) ValidatePreset(index int) error {
+	if index < 0 || index >= m.PresetSlots {
+		return &ErrInvalidPreset{Index: index, Model: m.Name, PresetSlots: m.PresetSlots}
+	}
+	return nil
+}
+
+// ValidatePresetPosition checks that the preset position exists on the model,
+// which lists as many positions as it has presets
+func (m *DeviceModel) ValidatePresetPosition(position int) error {
+	if position < 0 || position >= m.PresetSlots {
+		return &ErrInvalidPreset{Index: position, ByPosition: true, Model: m.Name, PresetSlots: m.PresetSlots}
+	}
+	return nil
+}
+
+// Validate checks that the model identifies a device type and has channels and presets,
+// as every path and preset would be rejected on a device matching a model without them
+func (m *DeviceModel) Validate() error {
+	switch {
+	case m.Key() == ModelKey{}:
+		return fmt.Errorf("VendorID and DeviceTypeId are both zero")
+	case m.Inputs <= 0:
+		return fmt.Errorf("Inputs is %d, expected at least 1", m.Inputs)
+	case m.Outputs <= 0:
+		return fmt.Errorf("Outputs is %d, expected at least 1", m.Outputs)
+	case m.PresetSlots <= 0:
+		return fmt.Errorf("PresetSlots is %d, expected at least 1", m.PresetSlots)
+	case m.EqBands < 0:
+		return fmt.Errorf("EqBands is %d, expected at least 0", m.EqBands)
+	}
+	return nil
+}
+
+// QuirksFor returns the quirks affecting the given firmware version
+func (m *DeviceModel) QuirksFor(firmware FirmwareVersion) []Quirk {
+	var ret []Quirk
+	for _, q := range m.Quirks {
+		if q.FixedIn == (FirmwareVersion{}) || firmware.Uint32() < q.FixedIn.Uint32() {
+			ret = append(ret, q)
+		}
+	}
+	return ret
+}
+
+// ValidateFor validates the path and checks that it exists on the model, see DeviceModel.ValidatePath.
+func (p Path) ValidateFor(m *DeviceModel) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return m.ValidatePath(p)
+}
+
+// SimulatedDeviceTypeId is the DeviceTypeId reported by the simulator
+const SimulatedDeviceTypeId uint16 = 0xfffe
+
+var modelsMutex sync.RWMutex
+
+// models holds the registered models. Only the simulator is built in, as the
+// DeviceTypeIds of the hardware models are not documented; register them with RegisterModel
+// or LoadModels.
+var models = map[ModelKey]*DeviceModel{
+	{DeviceTypeId: SimulatedDeviceTypeId}: {
+		Name:         "Simulated device",
+		DeviceTypeId: SimulatedDeviceTypeId,
+		Inputs:       4,
+		Outputs:      4,
+		EqBands:      8,
+		PresetSlots:  16,
+	},
+}
+
+// RegisterModel adds m to the registry, replacing any model with the same key
+func RegisterModel(m DeviceModel) {
+	modelsMutex.Lock()
+	defer modelsMutex.Unlock()
+	models[m.Key()] = &m
+}
+
+// LoadModels registers the models listed in a JSON file, an array of DeviceModel objects
+// like [{"Name": "DSP 4x4", "DeviceTypeId": 3, "Inputs": 4, "Outputs": 4, "EqBands": 8, "PresetSlots": 16}],
+// and returns how many were registered. LevelTypes are given as numbers, see LevelType.
+// Nothing is registered if a model is invalid, see DeviceModel.Validate.
+func LoadModels(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var ms []DeviceModel
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return 0, fmt.Errorf("invalid device model file %s: %w", path, err)
+	}
+	for i, m := range ms {
+		if err := m.Validate(); err != nil {
+			name := m.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return 0, fmt.Errorf("invalid device model %s in %s: %w", name, path, err)
+		}
+	}
+	for _, m := range ms {
+		RegisterModel(m)
+	}
+	return len(ms), nil
+}
+
+// LookupModel returns the model of a device, as identified in its DeviceDataResponse.
+// The returned model is shared and must not be modified.
+func LookupModel(vendorID uint8, deviceTypeId uint16) (*DeviceModel, bool) {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+	m, ok := models[ModelKey{VendorID: vendorID, DeviceTypeId: deviceTypeId}]
+	return m, ok
+}
+
+// Models returns all registered models, sorted by vendor and device type
+func Models() []DeviceModel {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+
+	ret := make([]DeviceModel, 0, len(models))
+	for _, m := range models {
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].VendorID != ret[j].VendorID {
+			return ret[i].VendorID < ret[j].VendorID
+		}
+		return ret[i].DeviceTypeId < ret[j].DeviceTypeId
+	})
+	return ret
+}
+
+// Model returns the registered model of the device that sent d
+func (d *DeviceDataResponse) Model() (*DeviceModel, bool) {
+	return LookupModel(d.VendorID, d.DeviceTypeId)
+}
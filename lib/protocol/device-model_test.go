@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceModelValidate(t *testing.T) {
+	m := &DeviceModel{
+		Name:        "Test amp",
+		Inputs:      2,
+		Outputs:     4,
+		EqBands:     3,
+		LevelTypes:  []LevelType{LevelTypeGain, LevelTypeMute},
+		PresetSlots: 8,
+	}
+
+	tests := []struct {
+		name  string
+		path  Path
+		index int
+	}{
+		{"Output mute", Output(3).Mute(), -1},
+		{"Input eq gain", Input(1).Eq(2).Gain(), -1},
+		{"Missing output", Output(7).Mute(), 0},
+		{"Missing input", Input(2).Gain(), 0},
+		{"Missing eq band", Input(0).Eq(3).Gain(), 1},
+		{"Unsupported parameter", Output(0).Delay(), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.path.ValidateFor(m)
+			if tt.index < 0 {
+				if err != nil {
+					t.Fatalf("Expected %s to be valid, got %v", tt.path, err)
+				}
+				return
+			}
+			var pathErr *ErrInvalidPath
+			if !errors.As(err, &pathErr) {
+				t.Fatalf("Expected ErrInvalidPath for %s, got %v", tt.path, err)
+			}
+			if pathErr.Index != tt.index {
+				t.Errorf("Expected error at element %d, got %d: %v", tt.index, pathErr.Index, err)
+			}
+		})
+	}
+
+	for _, index := range []int{-1, 8} {
+		var presetErr *ErrInvalidPreset
+		if err := m.ValidatePreset(index); !errors.As(err, &presetErr) {
+			t.Errorf("Expected ErrInvalidPreset for preset %d, got %v", index, err)
+		}
+	}
+	if err := m.ValidatePreset(7); err != nil {
+		t.Errorf("Expected preset 7 to be valid, got %v", err)
+	}
+}
+
+func TestDeviceModelQuirksAndRegistry(t *testing.T) {
+	m := DeviceModel{
+		Name:         "Quirky amp",
+		VendorID:     0x42,
+		DeviceTypeId: 0x1234,
+		Quirks: []Quirk{
+			{Description: "fixed", FixedIn: FirmwareVersion{Major: 1, Minor: 2}},
+			{Description: "open"},
+		},
+	}
+
+	if q := m.QuirksFor(FirmwareVersion{Major: 1, Minor: 1}); len(q) != 2 {
+		t.Errorf("Expected 2 quirks before the fix, got %v", q)
+	}
+	if q := m.QuirksFor(FirmwareVersion{Major: 1, Minor: 2}); len(q) != 1 || q[0].Description != "open" {
+		t.Errorf("Expected only the open quirk after the fix, got %v", q)
+	}
+
+	RegisterModel(m)
+	defer func() {
+		modelsMutex.Lock()
+		delete(models, m.Key())
+		modelsMutex.Unlock()
+	}()
+
+	dd := &DeviceDataResponse{VendorID: 0x42, DeviceTypeId: 0x1234}
+	if got, ok := dd.Model(); !ok || got.Name != m.Name {
+		t.Errorf("Expected to find %s, got %v", m.Name, got)
+	}
+	if _, ok := LookupModel(0x42, 0x1235); ok {
+		t.Error("Expected no model for an unknown device type")
+	}
+	if _, ok := LookupModel(0, SimulatedDeviceTypeId); !ok {
+		t.Error("Expected the simulated model to be built in")
+	}
+}
+
+func TestLoadModels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+	data := `[{"Name": "Test 4x4", "VendorID": 1, "DeviceTypeId": 42, "Inputs": 4, "Outputs": 4, "EqBands": 8, "PresetSlots": 16}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := LoadModels(path)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 model to be loaded, got %d (%v)", n, err)
+	}
+	m, ok := LookupModel(1, 42)
+	if !ok || m.Name != "Test 4x4" {
+		t.Fatalf("Expected the loaded model to be registered, got %+v (found: %v)", m, ok)
+	}
+	var pathErr *ErrInvalidPath
+	if err := Output(7).Mute().ValidateFor(m); !errors.As(err, &pathErr) {
+		t.Errorf("Expected output 7 to be rejected, got %v", err)
+	}
+
+	invalid := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"not a list", `{"Name": "not a list"}`, "invalid device model file"},
+		{"no key", `[{"Name": "No key", "Inputs": 4, "Outputs": 4, "PresetSlots": 16}]`, "No key"},
+		// "Input" instead of "Inputs" leaves the inputs at zero
+		{"misspelled field", `[{"Name": "Typo", "DeviceTypeId": 43, "Input": 4, "Outputs": 4, "PresetSlots": 16}]`, "Typo"},
+		{"no presets", `[{"DeviceTypeId": 44, "Inputs": 4, "Outputs": 4}]`, "#1"},
+		{"second entry", `[{"Name": "Fine", "DeviceTypeId": 45, "Inputs": 4, "Outputs": 4, "PresetSlots": 16}, {"DeviceTypeId": 46, "Inputs": 4, "PresetSlots": 16}]`, "#2"},
+	}
+	for _, tt := range invalid {
+		if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadModels(path); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+	if _, ok := LookupModel(0, 45); ok {
+		t.Error("Expected no model of a file with an invalid entry to be registered")
+	}
+}
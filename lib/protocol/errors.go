@@ -0,0 +1,87 @@
+package protocol
+
+import "fmt"
+
+// ErrShortBuffer is returned when a buffer is too short to contain the expected structure
+type ErrShortBuffer struct {
+	Type     string
+	Expected int
+	Actual   int
+}
+
+func (e *ErrShortBuffer) Error() string {
+	return fmt.Sprintf("buffer too short for %s: expected %d bytes, got %d", e.Type, e.Expected, e.Actual)
+}
+
+// ErrTrailingData is returned when a buffer contains more data than the expected structure
+type ErrTrailingData struct {
+	Type     string
+	Expected int
+	Actual   int
+}
+
+func (e *ErrTrailingData) Error() string {
+	return fmt.Sprintf("unexpected trailing data for %s: expected %d bytes, got %d", e.Type, e.Expected, e.Actual)
+}
+
+// ErrUnknownMessageType is returned when decoding a message type that is not defined
+type ErrUnknownMessageType struct {
+	MessageType MessageType
+}
+
+func (e *ErrUnknownMessageType) Error() string {
+	return fmt.Sprintf("unknown message type %d", byte(e.MessageType))
+}
+
+// ErrStringTooLong is returned when a string value doesn't fit into a single packet
+type ErrStringTooLong struct {
+	Length    int
+	MaxLength int
+}
+
+func (e *ErrStringTooLong) Error() string {
+	return fmt.Sprintf("string of length %d exceeds maximum length %d", e.Length, e.MaxLength)
+}
+
+// checkLength returns a typed error if data is not exactly size bytes long
+func checkLength(typ string, data []byte, size int) error {
+	if len(data) < size {
+		return &ErrShortBuffer{Type: typ, Expected: size, Actual: len(data)}
+	}
+	if len(data) > size {
+		return &ErrTrailingData{Type: typ, Expected: size, Actual: len(data)}
+	}
+	return nil
+}
+
+// ErrInvalidPath is returned when a LiveCmd path does not follow the LevelType hierarchy
+type ErrInvalidPath struct {
+	Path Path
+	// Index is the position of the offending tuple in Path, or -1 if the path as a whole is invalid
+	Index  int
+	Reason string
+}
+
+func (e *ErrInvalidPath) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("invalid path %q: %s", e.Path.String(), e.Reason)
+	}
+	return fmt.Sprintf("invalid path %q at element %d: %s", e.Path.String(), e.Index, e.Reason)
+}
+
+// ErrInvalidPreset is returned when recalling a preset that doesn't exist on a DeviceModel
+type ErrInvalidPreset struct {
+	// Index is the preset index, or its position if ByPosition is set
+	Index       int
+	ByPosition  bool
+	Model       string
+	PresetSlots int
+}
+
+func (e *ErrInvalidPreset) Error() string {
+	what := "preset"
+	if e.ByPosition {
+		what = "preset position"
+	}
+	return fmt.Sprintf("%s %d does not exist on %s, which has %d presets", what, e.Index, e.Model, e.PresetSlots)
+}
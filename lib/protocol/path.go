@@ -0,0 +1,255 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxPathDepth is the maximum number of (position, LevelType) tuples in a LiveCmd path
+const MaxPathDepth = 5
+
+// Path addresses a parameter of the device, as a list of (position, LevelType) tuples
+// going from the top level down to the parameter itself.
+//
+// Paths are usually built with the builder functions, for example:
+//
+//	Input(0).Eq(2).Gain()
+//
+// which is formatted as "input[0]/eq[2]/gain".
+type Path []LiveCmdTuple
+
+// allowedParents lists under which parent each LevelType can be used.
+// LevelType(0) stands for the top level.
+var allowedParents = map[LevelType][]LevelType{
+	LevelTypeInput:          {0},
+	LevelTypeOutput:         {0, LevelTypeInput},
+	LevelTypeEq:             {LevelTypeInput, LevelTypeOutput},
+	LevelTypeGain:           {LevelTypeInput, LevelTypeOutput, LevelTypeEq},
+	LevelTypeEqType:         {LevelTypeEq},
+	LevelTypeQuality:        {LevelTypeEq},
+	LevelTypeActive:         {LevelTypeEq},
+	LevelTypeMute:           {LevelTypeInput, LevelTypeOutput},
+	LevelTypeDelay:          {LevelTypeInput, LevelTypeOutput},
+	LevelTypePhaseInversion: {LevelTypeInput, LevelTypeOutput},
+}
+
+// pathNames are the names used in the human-readable path format
+var pathNames = map[LevelType]string{
+	LevelTypeInput:          "input",
+	LevelTypeOutput:         "output",
+	LevelTypeEq:             "eq",
+	LevelTypeGain:           "gain",
+	LevelTypeEqType:         "eqType",
+	LevelTypeQuality:        "quality",
+	LevelTypeActive:         "active",
+	LevelTypeMute:           "mute",
+	LevelTypeDelay:          "delay",
+	LevelTypePhaseInversion: "phaseInversion",
+}
+
+// isContainer returns true for LevelTypes that group other parameters and carry no value
+func isContainer(lt LevelType) bool {
+	return lt == LevelTypeInput || lt == LevelTypeOutput || lt == LevelTypeEq
+}
+
+// Input returns the path of the input channel at position
+func Input(position uint8) Path {
+	return Path{}.append(position, LevelTypeInput)
+}
+
+// Output returns the path of the output channel at position
+func Output(position uint8) Path {
+	return Path{}.append(position, LevelTypeOutput)
+}
+
+// append returns a copy of p with the tuple added, never modifying the backing array of p
+func (p Path) append(position uint8, levelType LevelType) Path {
+	ret := make(Path, len(p), len(p)+1)
+	copy(ret, p)
+	return append(ret, NewLiveCmdTuple(position, levelType))
+}
+
+func (p Path) Output(position uint8) Path {
+	return p.append(position, LevelTypeOutput)
+}
+
+func (p Path) Eq(position uint8) Path {
+	return p.append(position, LevelTypeEq)
+}
+
+func (p Path) Gain() Path {
+	return p.append(0, LevelTypeGain)
+}
+
+func (p Path) EqType() Path {
+	return p.append(0, LevelTypeEqType)
+}
+
+func (p Path) Quality() Path {
+	return p.append(0, LevelTypeQuality)
+}
+
+func (p Path) Active() Path {
+	return p.append(0, LevelTypeActive)
+}
+
+func (p Path) Mute() Path {
+	return p.append(0, LevelTypeMute)
+}
+
+func (p Path) Delay() Path {
+	return p.append(0, LevelTypeDelay)
+}
+
+func (p Path) PhaseInversion() Path {
+	return p.append(0, LevelTypePhaseInversion)
+}
+
+// Leaf returns the LevelType of the last tuple of the path, or 0 if the path is empty
+func (p Path) Leaf() LevelType {
+	if len(p) == 0 {
+		return 0
+	}
+	return p[len(p)-1].LevelType
+}
+
+// Validate checks that the path is not too long and that every LevelType
+// is used under a parent that allows it.
+func (p Path) Validate() error {
+	if len(p) == 0 {
+		return &ErrInvalidPath{Path: p, Index: -1, Reason: "path is empty"}
+	}
+	if len(p) > MaxPathDepth {
+		return &ErrInvalidPath{
+			Path:   p,
+			Index:  MaxPathDepth,
+			Reason: fmt.Sprintf("path can only have %d elements", MaxPathDepth),
+		}
+	}
+
+	parent := LevelType(0)
+	for i, tuple := range p {
+		parents, ok := allowedParents[tuple.LevelType]
+		if !ok {
+			return &ErrInvalidPath{
+				Path:   p,
+				Index:  i,
+				Reason: fmt.Sprintf("unknown level type %d", byte(tuple.LevelType)),
+			}
+		}
+
+		allowed := false
+		for _, allowedParent := range parents {
+			if allowedParent == parent {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			parentName := "top level"
+			if parent != 0 {
+				parentName = pathNames[parent]
+			}
+			return &ErrInvalidPath{
+				Path:   p,
+				Index:  i,
+				Reason: fmt.Sprintf("%s is not allowed under %s", pathNames[tuple.LevelType], parentName),
+			}
+		}
+
+		parent = tuple.LevelType
+	}
+
+	return nil
+}
+
+// Bytes validates the path and returns its wire encoding, padded with zeros
+func (p Path) Bytes() ([10]byte, error) {
+	var ret [10]byte
+	if err := p.Validate(); err != nil {
+		return ret, err
+	}
+	for i, tuple := range p {
+		ret[i*2] = tuple.Position
+		ret[i*2+1] = byte(tuple.LevelType)
+	}
+	return ret, nil
+}
+
+// String formats the path as for example "input[0]/eq[2]/gain".
+// Parameters at position 0 are printed without their position.
+func (p Path) String() string {
+	parts := make([]string, 0, len(p))
+	for _, tuple := range p {
+		name, ok := pathNames[tuple.LevelType]
+		if !ok {
+			name = fmt.Sprintf("type%d", byte(tuple.LevelType))
+		}
+		if isContainer(tuple.LevelType) || tuple.Position != 0 {
+			name = fmt.Sprintf("%s[%d]", name, tuple.Position)
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecodePath converts the wire encoding of a path back to a Path.
+// The path ends at the first tuple with a zero LevelType.
+func DecodePath(buf [10]byte) (Path, error) {
+	p := Path{}
+	for i := 0; i < MaxPathDepth; i++ {
+		levelType := LevelType(buf[i*2+1])
+		if levelType == 0 {
+			break
+		}
+		p = append(p, NewLiveCmdTuple(buf[i*2], levelType))
+	}
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// ParsePath parses a human-readable path like "input[0]/eq[2]/gain".
+// Names are case-insensitive, and a missing position means position 0.
+func ParsePath(s string) (Path, error) {
+	p := Path{}
+	for _, part := range strings.Split(strings.TrimSpace(s), "/") {
+		part = strings.TrimSpace(part)
+		name := part
+		position := uint8(0)
+
+		if idx := strings.Index(part, "["); idx >= 0 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("invalid path element %q in %q", part, s)
+			}
+			name = part[:idx]
+			v, err := strconv.ParseUint(part[idx+1:len(part)-1], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid position in path element %q in %q", part, s)
+			}
+			position = uint8(v)
+		}
+
+		levelType, ok := levelTypeFromName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown path element %q in %q", name, s)
+		}
+		p = p.append(position, levelType)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func levelTypeFromName(name string) (LevelType, bool) {
+	for levelType, n := range pathNames {
+		if strings.EqualFold(n, name) {
+			return levelType, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPathFormatAndParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     Path
+		expected string
+	}{
+		{"Input gain", Input(0).Gain(), "input[0]/gain"},
+		{"Input eq gain", Input(0).Eq(2).Gain(), "input[0]/eq[2]/gain"},
+		{"Output mute", Output(3).Mute(), "output[3]/mute"},
+		{"Output under input", Input(1).Output(2).Delay(), "input[1]/output[2]/delay"},
+		{"Eq type", Output(0).Eq(4).EqType(), "output[0]/eq[4]/eqType"},
+		{"Phase inversion", Input(2).PhaseInversion(), "input[2]/phaseInversion"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.path.Validate(); err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+			if s := tt.path.String(); s != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, s)
+			}
+
+			parsed, err := ParsePath(tt.expected)
+			if err != nil {
+				t.Fatalf("ParsePath failed: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, tt.path) {
+				t.Errorf("Expected %v, got %v", tt.path, parsed)
+			}
+
+			buf, err := tt.path.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes failed: %v", err)
+			}
+			decoded, err := DecodePath(buf)
+			if err != nil {
+				t.Fatalf("DecodePath failed: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.path) {
+				t.Errorf("Expected %v, got %v", tt.path, decoded)
+			}
+		})
+	}
+}
+
+func TestPathValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  Path
+		index int
+	}{
+		{"Empty", Path{}, -1},
+		{"Gain at top level", Path{}.Gain(), 0},
+		{"Input under output", Output(0).append(1, LevelTypeInput), 1},
+		{"Eq type under input", Input(0).EqType(), 1},
+		{"Mute under eq", Input(0).Eq(1).Mute(), 2},
+		{"Child of a leaf", Input(0).Gain().Mute(), 2},
+		{"Unknown level type", Input(0).append(0, LevelType(6)), 1},
+		{"Too long", Input(0).Output(0).Eq(0).Gain().Gain().Gain(), MaxPathDepth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.path.Validate()
+
+			var e *ErrInvalidPath
+			if !errors.As(err, &e) {
+				t.Fatalf("Expected ErrInvalidPath, got %v", err)
+			}
+			if e.Index != tt.index {
+				t.Errorf("Expected error at index %d, got %d (%v)", tt.index, e.Index, err)
+			}
+		})
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for _, s := range []string{"", "input[0", "input[x]/gain", "input[256]", "speaker[0]", "gain", "input[0]/eq[1]/mute"} {
+		if _, err := ParsePath(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
+	"ppa-control/lib/protocol/units"
+	"strings"
 )
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type=MessageType
 //go:generate go run golang.org/x/tools/cmd/stringer -type=StatusType
+//go:generate go run golang.org/x/tools/cmd/stringer -type=LevelType
 
 type MessageType byte
 
@@ -79,33 +83,11 @@ func (bh *BasicHeader) ToMap() map[string]interface{} {
 }
 
 func ParseHeader(buf []byte) (*BasicHeader, error) {
-	w := bytes.NewReader(buf)
-	h := &BasicHeader{}
-	err := binary.Read(w, binary.LittleEndian, &h.MessageType)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &h.ProtocolId)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &h.Status)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &h.DeviceUniqueId)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &h.SequenceNumber)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &h.ComponentId)
-	if err != nil {
-		return nil, err
+	if len(buf) < HeaderSize {
+		return nil, &ErrShortBuffer{Type: "BasicHeader", Expected: HeaderSize, Actual: len(buf)}
 	}
-	err = binary.Read(w, binary.LittleEndian, &h.Reserved)
+	h := &BasicHeader{}
+	err := h.UnmarshalBinary(buf[:HeaderSize])
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +95,34 @@ func ParseHeader(buf []byte) (*BasicHeader, error) {
 	return h, nil
 }
 
+// MarshalBinary encodes the header into its HeaderSize bytes wire format.
+func (bh *BasicHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, HeaderSize)
+	buf[0] = byte(bh.MessageType)
+	buf[1] = bh.ProtocolId
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(bh.Status))
+	copy(buf[4:8], bh.DeviceUniqueId[:])
+	binary.LittleEndian.PutUint16(buf[8:10], bh.SequenceNumber)
+	buf[10] = bh.ComponentId
+	buf[11] = bh.Reserved
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a header. data has to be exactly HeaderSize bytes long.
+func (bh *BasicHeader) UnmarshalBinary(data []byte) error {
+	if err := checkLength("BasicHeader", data, HeaderSize); err != nil {
+		return err
+	}
+	bh.MessageType = MessageType(data[0])
+	bh.ProtocolId = data[1]
+	bh.Status = StatusType(binary.LittleEndian.Uint16(data[2:4]))
+	copy(bh.DeviceUniqueId[:], data[4:8])
+	bh.SequenceNumber = binary.LittleEndian.Uint16(data[8:10])
+	bh.ComponentId = data[10]
+	bh.Reserved = data[11]
+	return nil
+}
+
 func NewBasicHeader(
 	messageType MessageType,
 	status StatusType,
@@ -131,37 +141,7 @@ func NewBasicHeader(
 }
 
 func EncodeHeader(w io.Writer, h *BasicHeader) error {
-	err := binary.Write(w, binary.LittleEndian, h.MessageType)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.ProtocolId)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.Status)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.DeviceUniqueId)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.SequenceNumber)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.ComponentId)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, h.Reserved)
-	if err != nil {
-		return err
-	}
-	// TODO traditional way to do it
-	// binary.LittleEndian.PutUint16(w, p.CrtFlags)
-	return nil
+	return encode(w, h)
 }
 
 const (
@@ -176,24 +156,25 @@ type PresetRecall struct {
 	Reserved      uint8 // leave 0
 }
 
+// PresetRecallSize is the size of an encoded PresetRecall payload
+const PresetRecallSize = 4
+
 func EncodePresetRecall(w io.Writer, pr *PresetRecall) error {
-	err := binary.Write(w, binary.LittleEndian, pr.CrtFlags)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, pr.OptFlags)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, pr.IndexPosition)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, pr.Reserved)
-	if err != nil {
+	return encode(w, pr)
+}
+
+func (pr *PresetRecall) MarshalBinary() ([]byte, error) {
+	return []byte{pr.CrtFlags, pr.OptFlags, pr.IndexPosition, pr.Reserved}, nil
+}
+
+func (pr *PresetRecall) UnmarshalBinary(data []byte) error {
+	if err := checkLength("PresetRecall", data, PresetRecallSize); err != nil {
 		return err
 	}
-
+	pr.CrtFlags = data[0]
+	pr.OptFlags = data[1]
+	pr.IndexPosition = data[2]
+	pr.Reserved = data[3]
 	return nil
 }
 
@@ -207,26 +188,93 @@ func NewPresetRecall(crtFlags uint8, optFlags uint8, indexPosition uint8) *Prese
 }
 
 func ParsePresetRecall(buf []byte) (*PresetRecall, error) {
-	w := bytes.NewReader(buf)
 	pr := &PresetRecall{}
-	err := binary.Read(w, binary.LittleEndian, &pr.CrtFlags)
-	if err != nil {
+	if err := pr.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
-	err = binary.Read(w, binary.LittleEndian, &pr.OptFlags)
-	if err != nil {
-		return nil, err
+	return pr, nil
+}
+
+// PresetSave stores the current settings of the device in a preset slot.
+// The payload starts like PresetRecall and is followed by the name of the preset,
+// padded with NULs like DeviceDataResponse.DeviceName.
+type PresetSave struct {
+	CrtFlags      uint8
+	OptFlags      uint8
+	IndexPosition uint8
+	Reserved      uint8 // leave 0
+	PresetName    [PresetNameSize]byte
+}
+
+// PresetNameSize is the maximum length of a preset name in bytes
+const PresetNameSize = 32
+
+// PresetSaveSize is the size of an encoded PresetSave payload
+const PresetSaveSize = 4 + PresetNameSize
+
+func EncodePresetSave(w io.Writer, ps *PresetSave) error {
+	return encode(w, ps)
+}
+
+func (ps *PresetSave) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, PresetSaveSize)
+	buf[0] = ps.CrtFlags
+	buf[1] = ps.OptFlags
+	buf[2] = ps.IndexPosition
+	buf[3] = ps.Reserved
+	copy(buf[4:], ps.PresetName[:])
+	return buf, nil
+}
+
+func (ps *PresetSave) UnmarshalBinary(data []byte) error {
+	if err := checkLength("PresetSave", data, PresetSaveSize); err != nil {
+		return err
 	}
-	err = binary.Read(w, binary.LittleEndian, &pr.IndexPosition)
-	if err != nil {
-		return nil, err
+	ps.CrtFlags = data[0]
+	ps.OptFlags = data[1]
+	ps.IndexPosition = data[2]
+	ps.Reserved = data[3]
+	copy(ps.PresetName[:], data[4:])
+	return nil
+}
+
+// Name returns the preset name without its NUL padding
+func (ps *PresetSave) Name() string {
+	return strings.TrimRight(string(ps.PresetName[:]), "\x00 ")
+}
+
+// MarshalJSON encodes the preset name as a string, for readable logs
+func (ps *PresetSave) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		CrtFlags      uint8
+		OptFlags      uint8
+		IndexPosition uint8
+		Name          string
+	}{
+		CrtFlags:      ps.CrtFlags,
+		OptFlags:      ps.OptFlags,
+		IndexPosition: ps.IndexPosition,
+		Name:          ps.Name(),
+	})
+}
+
+// NewPresetSave saves the current settings as preset index with the given name.
+// Names longer than PresetNameSize bytes return an *ErrStringTooLong.
+func NewPresetSave(index uint8, name string) (*PresetSave, error) {
+	if len(name) > PresetNameSize {
+		return nil, &ErrStringTooLong{Length: len(name), MaxLength: PresetNameSize}
 	}
-	err = binary.Read(w, binary.LittleEndian, &pr.Reserved)
-	if err != nil {
+	ps := &PresetSave{IndexPosition: index}
+	copy(ps.PresetName[:], name)
+	return ps, nil
+}
+
+func ParsePresetSave(buf []byte) (*PresetSave, error) {
+	ps := &PresetSave{}
+	if err := ps.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
-
-	return pr, nil
+	return ps, nil
 }
 
 type LevelType byte
@@ -249,21 +297,34 @@ type DeviceDataRequest struct {
 	OptFlags uint8
 }
 
+// DeviceDataRequestSize is the size of an encoded DeviceDataRequest payload
+const DeviceDataRequestSize = 2
+
 func ParseDeviceDataRequest(buf []byte) (*DeviceDataRequest, error) {
-	w := bytes.NewReader(buf)
 	d := &DeviceDataRequest{}
-	err := binary.Read(w, binary.LittleEndian, &d.CrtFlags)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.OptFlags)
-	if err != nil {
+	if err := d.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
-
 	return d, nil
 }
 
+func EncodeDeviceDataRequest(w io.Writer, d *DeviceDataRequest) error {
+	return encode(w, d)
+}
+
+func (d *DeviceDataRequest) MarshalBinary() ([]byte, error) {
+	return []byte{d.CrtFlags, d.OptFlags}, nil
+}
+
+func (d *DeviceDataRequest) UnmarshalBinary(data []byte) error {
+	if err := checkLength("DeviceDataRequest", data, DeviceDataRequestSize); err != nil {
+		return err
+	}
+	d.CrtFlags = data[0]
+	d.OptFlags = data[1]
+	return nil
+}
+
 type DeviceDataResponse struct {
 	CrtFlags           uint8
 	OptFlags           uint8
@@ -282,73 +343,63 @@ type DeviceDataResponse struct {
 	VendorID           uint8
 }
 
+// DeviceDataResponseSize is the size of an encoded DeviceDataResponse payload
+const DeviceDataResponseSize = 68
+
 func ParseDeviceDataResponse(buf []byte) (*DeviceDataResponse, error) {
-	w := bytes.NewReader(buf)
 	d := &DeviceDataResponse{}
-	err := binary.Read(w, binary.LittleEndian, &d.CrtFlags)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.OptFlags)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.DeviceTypeId)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.SubnetPrefixLength)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.DiagnosticState)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.FirmwareVersion)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.SerialNumber)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.Reserved)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.GatewayIP)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.StaticIP)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.HardwareFeatures)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.StartPresetId)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.Reserved2)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.DeviceName)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(w, binary.LittleEndian, &d.VendorID)
-	if err != nil {
+	if err := d.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
-
 	return d, nil
 }
 
+func EncodeDeviceDataResponse(w io.Writer, d *DeviceDataResponse) error {
+	return encode(w, d)
+}
+
+func (d *DeviceDataResponse) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, DeviceDataResponseSize)
+	buf[0] = d.CrtFlags
+	buf[1] = d.OptFlags
+	binary.LittleEndian.PutUint16(buf[2:4], d.DeviceTypeId)
+	buf[4] = d.SubnetPrefixLength
+	buf[5] = d.DiagnosticState
+	binary.LittleEndian.PutUint32(buf[6:10], d.FirmwareVersion)
+	binary.LittleEndian.PutUint16(buf[10:12], d.SerialNumber)
+	binary.LittleEndian.PutUint32(buf[12:16], d.Reserved)
+	copy(buf[16:20], d.GatewayIP[:])
+	copy(buf[20:24], d.StaticIP[:])
+	binary.LittleEndian.PutUint32(buf[24:28], d.HardwareFeatures)
+	buf[28] = d.StartPresetId
+	copy(buf[29:35], d.Reserved2[:])
+	copy(buf[35:67], d.DeviceName[:])
+	buf[67] = d.VendorID
+	return buf, nil
+}
+
+func (d *DeviceDataResponse) UnmarshalBinary(data []byte) error {
+	if err := checkLength("DeviceDataResponse", data, DeviceDataResponseSize); err != nil {
+		return err
+	}
+	d.CrtFlags = data[0]
+	d.OptFlags = data[1]
+	d.DeviceTypeId = binary.LittleEndian.Uint16(data[2:4])
+	d.SubnetPrefixLength = data[4]
+	d.DiagnosticState = data[5]
+	d.FirmwareVersion = binary.LittleEndian.Uint32(data[6:10])
+	d.SerialNumber = binary.LittleEndian.Uint16(data[10:12])
+	d.Reserved = binary.LittleEndian.Uint32(data[12:16])
+	copy(d.GatewayIP[:], data[16:20])
+	copy(d.StaticIP[:], data[20:24])
+	d.HardwareFeatures = binary.LittleEndian.Uint32(data[24:28])
+	d.StartPresetId = data[28]
+	copy(d.Reserved2[:], data[29:35])
+	copy(d.DeviceName[:], data[35:67])
+	d.VendorID = data[67]
+	return nil
+}
+
 type LiveCmd struct {
 	CrtFlags    uint8
 	OptFlags    uint8
@@ -357,27 +408,75 @@ type LiveCmd struct {
 	ValueString string
 }
 
+// LiveCmdSize is the size of an encoded LiveCmd payload without string value
+const LiveCmdSize = 16
+
+// LiveCmdFlagString is set in CrtFlags when the LiveCmd carries a string value.
+// Value then holds the length of the string, which follows the fixed part of the payload.
+const LiveCmdFlagString uint8 = 0x01
+
+// MaxLiveCmdStringLength is the longest string value that fits into a single packet
+const MaxLiveCmdStringLength = MaxBufferSize - HeaderSize - LiveCmdSize
+
+// HasString returns true if the LiveCmd carries a string value
+func (lc *LiveCmd) HasString() bool {
+	return lc.CrtFlags&LiveCmdFlagString != 0
+}
+
 func ParseLiveCmd(buf []byte) (*LiveCmd, error) {
-	w := bytes.NewReader(buf)
 	lc := &LiveCmd{}
-	err := binary.Read(w, binary.LittleEndian, &lc.CrtFlags)
-	if err != nil {
+	if err := lc.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
-	err = binary.Read(w, binary.LittleEndian, &lc.OptFlags)
-	if err != nil {
-		return nil, err
+	return lc, nil
+}
+
+func (lc *LiveCmd) MarshalBinary() ([]byte, error) {
+	size := LiveCmdSize
+	if lc.HasString() {
+		if len(lc.ValueString) > MaxLiveCmdStringLength {
+			return nil, &ErrStringTooLong{Length: len(lc.ValueString), MaxLength: MaxLiveCmdStringLength}
+		}
+		if int(lc.Value) != len(lc.ValueString) {
+			return nil, fmt.Errorf("LiveCmd string length %d does not match value %d", len(lc.ValueString), lc.Value)
+		}
+		size += len(lc.ValueString)
 	}
-	err = binary.Read(w, binary.LittleEndian, &lc.Path)
-	if err != nil {
-		return nil, err
+
+	buf := make([]byte, size)
+	buf[0] = lc.CrtFlags
+	buf[1] = lc.OptFlags
+	copy(buf[2:12], lc.Path[:])
+	binary.LittleEndian.PutUint32(buf[12:16], lc.Value)
+	if lc.HasString() {
+		copy(buf[LiveCmdSize:], lc.ValueString)
 	}
-	err = binary.Read(w, binary.LittleEndian, &lc.Value)
-	if err != nil {
-		return nil, err
+	return buf, nil
+}
+
+func (lc *LiveCmd) UnmarshalBinary(data []byte) error {
+	if len(data) < LiveCmdSize {
+		return &ErrShortBuffer{Type: "LiveCmd", Expected: LiveCmdSize, Actual: len(data)}
 	}
+	lc.CrtFlags = data[0]
+	lc.OptFlags = data[1]
+	copy(lc.Path[:], data[2:12])
+	lc.Value = binary.LittleEndian.Uint32(data[12:16])
+	lc.ValueString = ""
 
-	return lc, nil
+	if !lc.HasString() {
+		return checkLength("LiveCmd", data, LiveCmdSize)
+	}
+
+	if lc.Value > MaxLiveCmdStringLength {
+		return &ErrStringTooLong{Length: int(lc.Value), MaxLength: MaxLiveCmdStringLength}
+	}
+	size := LiveCmdSize + int(lc.Value)
+	if err := checkLength("LiveCmd", data, size); err != nil {
+		return err
+	}
+	lc.ValueString = string(data[LiveCmdSize:size])
+	return nil
 }
 
 // A path consists of 5 pairs of (position, LevelType).
@@ -398,35 +497,48 @@ func ParseLiveCmd(buf []byte) (*LiveCmd, error) {
 
 // Input, Output, Eq: no value
 // Gain: 10 * g(dB) + 800
+//
+// See the units package for the conversion of the other values.
 
 type LiveCmdTuple struct {
 	Position  uint8
 	LevelType LevelType
 }
 
-type LiveCmdOption func(*LiveCmd)
+// LiveCmdOption configures a LiveCmd, returning an error if the option is invalid
+type LiveCmdOption func(*LiveCmd) error
 
 func WithString(s string) LiveCmdOption {
-	return func(lc *LiveCmd) {
-		lc.CrtFlags = 0x01
+	return func(lc *LiveCmd) error {
+		lc.CrtFlags |= LiveCmdFlagString
 		lc.ValueString = s
 		// value is string length
 		lc.Value = uint32(len(s))
+		return nil
 	}
 }
 
+// WithPath sets the path of the LiveCmd. The tuples are validated against
+// the LevelType hierarchy, see Path.Validate.
+//
+// Paths are easiest to build with the path builder: WithPath(Input(0).Eq(2).Gain()...)
 func WithPath(tuples ...LiveCmdTuple) LiveCmdOption {
-	return func(lc *LiveCmd) {
-		if len(tuples) > 5 {
-			panic("Path can only have 5 tuples")
-		}
-		for i, tuple := range tuples {
-			lc.Path[i*2] = tuple.Position
-			lc.Path[i*2+1] = byte(tuple.LevelType)
+	return func(lc *LiveCmd) error {
+		buf, err := Path(tuples).Bytes()
+		if err != nil {
+			return err
 		}
+		lc.Path = buf
+		return nil
 	}
 }
 
+// ParsedPath decodes the path of the LiveCmd
+func (lc *LiveCmd) ParsedPath() (Path, error) {
+	return DecodePath(lc.Path)
+}
+
+// EQ types, see units.EqType for a typed version with names
 const (
 	EqTypeLP6  = 0
 	EqTypeLP12 = 1
@@ -442,33 +554,71 @@ const (
 )
 
 func WithBool(b bool) LiveCmdOption {
-	return func(lc *LiveCmd) {
+	return func(lc *LiveCmd) error {
 		if b {
 			lc.Value = 1
 		} else {
 			lc.Value = 0
 		}
+		return nil
 	}
 }
 
 func WithEqType(eqType uint8) LiveCmdOption {
-	return func(lc *LiveCmd) {
-		lc.Value = uint32(eqType)
+	return func(lc *LiveCmd) error {
+		v, err := units.EqTypeToValue(units.EqType(eqType))
+		if err != nil {
+			return err
+		}
+		lc.Value = v
+		return nil
 	}
 }
 
+// WithGain sets the value to a gain in dB, see units.GainToValue
 func WithGain(db float32) LiveCmdOption {
-	return func(lc *LiveCmd) {
-		lc.Value = uint32(db*10 + 800)
+	return func(lc *LiveCmd) error {
+		v, err := units.GainToValue(float64(db))
+		if err != nil {
+			return err
+		}
+		lc.Value = v
+		return nil
+	}
+}
+
+// WithDelay sets the value to a delay in ms, see units.DelayMsToValue
+func WithDelay(ms float32) LiveCmdOption {
+	return func(lc *LiveCmd) error {
+		v, err := units.DelayMsToValue(float64(ms))
+		if err != nil {
+			return err
+		}
+		lc.Value = v
+		return nil
 	}
 }
 
-func NewLiveCmd(opts ...LiveCmdOption) *LiveCmd {
+// WithQuality sets the value to an EQ Q factor, see units.QualityToValue
+func WithQuality(q float32) LiveCmdOption {
+	return func(lc *LiveCmd) error {
+		v, err := units.QualityToValue(float64(q))
+		if err != nil {
+			return err
+		}
+		lc.Value = v
+		return nil
+	}
+}
+
+func NewLiveCmd(opts ...LiveCmdOption) (*LiveCmd, error) {
 	lc := &LiveCmd{}
 	for _, opt := range opts {
-		opt(lc)
+		if err := opt(lc); err != nil {
+			return nil, err
+		}
 	}
-	return lc
+	return lc, nil
 }
 
 func NewLiveCmdTuple(position uint8, levelType LevelType) LiveCmdTuple {
@@ -479,22 +629,5 @@ func NewLiveCmdTuple(position uint8, levelType LevelType) LiveCmdTuple {
 }
 
 func EncodeLiveCmd(w io.Writer, lc *LiveCmd) error {
-	err := binary.Write(w, binary.LittleEndian, lc.CrtFlags)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, lc.OptFlags)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, lc.Path)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(w, binary.LittleEndian, lc.Value)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return encode(w, lc)
 }
@@ -0,0 +1,19 @@
+package units
+
+import "fmt"
+
+// ErrOutOfRange is returned when converting a value the device does not accept
+type ErrOutOfRange struct {
+	Quantity string
+	Unit     string
+	Value    float64
+	Range    Range
+}
+
+func (e *ErrOutOfRange) Error() string {
+	unit := ""
+	if e.Unit != "" {
+		unit = " " + e.Unit
+	}
+	return fmt.Sprintf("%s %g%s out of range [%g, %g]%s", e.Quantity, e.Value, unit, e.Range.Min, e.Range.Max, unit)
+}
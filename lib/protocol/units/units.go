@@ -0,0 +1,272 @@
+// Package units converts between the raw values carried in LiveCmd.Value and
+// DeviceData payloads and the values shown to users (dB, ms, Q, ...).
+//
+// Conversions to raw values return an *ErrOutOfRange when the input is outside
+// the range the device accepts. Use the Clamp method of the corresponding
+// Range to bring a user value into range first.
+//
+// The gain encoding is documented in doc/protocol.md (Value Encoding), and the
+// master volume maximum of 0x3e8 in doc/ppa-control-guide.md. The delay and Q
+// encodings and their ranges are not documented: they are assumptions that have
+// not been verified against a device, marked as such below. Their conversions only
+// reject values that can't be encoded at all.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Range is the inclusive range of valid user values for a parameter
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// Contains returns true if v is in the range
+func (r Range) Contains(v float64) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+// Clamp returns v limited to the range
+func (r Range) Clamp(v float64) float64 {
+	return math.Max(r.Min, math.Min(r.Max, v))
+}
+
+func (r Range) check(quantity string, unit string, v float64) error {
+	if math.IsNaN(v) || !r.Contains(v) {
+		return &ErrOutOfRange{Quantity: quantity, Unit: unit, Value: v, Range: r}
+	}
+	return nil
+}
+
+// GainRange is the range of gains in dB.
+// Gain is encoded as 10 * g(dB) + 800, so that 0 is -80 dB and 0x3e8 is +20 dB,
+// with a resolution of 0.1 dB.
+var GainRange = Range{Min: -80, Max: 20}
+
+const (
+	gainOffset = 800
+	gainScale  = 10
+)
+
+// GainToValue converts a gain in dB to its raw value
+func GainToValue(db float64) (uint32, error) {
+	if err := GainRange.check("gain", "dB", db); err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(db*gainScale + gainOffset)), nil
+}
+
+// GainFromValue converts a raw gain value to dB
+func GainFromValue(value uint32) float64 {
+	return (float64(value) - gainOffset) / gainScale
+}
+
+// MasterVolumeRange is the range of the master volume as a fraction,
+// where 0 is -80 dB and 1 is +20 dB.
+var MasterVolumeRange = Range{Min: 0, Max: 1}
+
+// MaxMasterVolumeValue is the raw master volume for a volume of 1 (+20 dB)
+const MaxMasterVolumeValue = 0x3e8
+
+// MasterVolumeToValue converts a master volume fraction to its raw value.
+//
+// The raw master volume uses the same scale as gain, so that
+// MasterVolumeToValue(v) == GainToValue(MasterVolumeToDB(v)).
+func MasterVolumeToValue(volume float64) (uint32, error) {
+	if err := MasterVolumeRange.check("master volume", "", volume); err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(volume * MaxMasterVolumeValue)), nil
+}
+
+// MasterVolumeFromValue converts a raw master volume value to a fraction
+func MasterVolumeFromValue(value uint32) float64 {
+	return float64(value) / MaxMasterVolumeValue
+}
+
+// MasterVolumeToDB converts a master volume fraction to dB
+func MasterVolumeToDB(volume float64) float64 {
+	return GainRange.Min + volume*(GainRange.Max-GainRange.Min)
+}
+
+// MasterVolumeFromDB converts dB to a master volume fraction
+func MasterVolumeFromDB(db float64) float64 {
+	return (db - GainRange.Min) / (GainRange.Max - GainRange.Min)
+}
+
+// Delay is encoded as a number of samples at DelaySampleRate.
+//
+// Unverified assumption: neither the sample rate nor the unit of the delay value are
+// documented, 48 kHz samples is a guess based on common amplifier DSPs.
+const (
+	DelaySampleRate = 48000
+	// SpeedOfSound is used to convert delays to distances, in m/s at 20°C
+	SpeedOfSound = 343.0
+)
+
+// DelayRange is a suggested range of delays in ms for user interfaces.
+//
+// Unverified assumption: the maximum delay of the devices is not documented, and
+// the range is not enforced by DelayMsToValue.
+var DelayRange = Range{Min: 0, Max: 1000}
+
+// encodableDelay is the range of delays in ms that fit the raw value
+var encodableDelay = Range{Min: 0, Max: math.MaxUint32 * 1000 / DelaySampleRate}
+
+// DelayMsToValue converts a delay in ms to its raw value in samples.
+// Only negative delays and delays that don't fit the raw value are rejected.
+func DelayMsToValue(ms float64) (uint32, error) {
+	if err := encodableDelay.check("delay", "ms", ms); err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(ms * DelaySampleRate / 1000)), nil
+}
+
+// DelayMsFromValue converts a raw delay value in samples to ms
+func DelayMsFromValue(value uint32) float64 {
+	return float64(value) * 1000 / DelaySampleRate
+}
+
+// DelayMetersToValue converts a distance in meters to the raw delay
+// it takes sound to travel it
+func DelayMetersToValue(meters float64) (uint32, error) {
+	return DelayMsToValue(MetersToMs(meters))
+}
+
+// DelayMetersFromValue converts a raw delay value to the distance sound travels in that time
+func DelayMetersFromValue(value uint32) float64 {
+	return MsToMeters(DelayMsFromValue(value))
+}
+
+// MetersToMs returns the time in ms sound takes to travel meters
+func MetersToMs(meters float64) float64 {
+	return meters / SpeedOfSound * 1000
+}
+
+// MsToMeters returns the distance in meters sound travels in ms
+func MsToMeters(ms float64) float64 {
+	return ms / 1000 * SpeedOfSound
+}
+
+// SamplesToMs converts a number of samples at DelaySampleRate to ms
+func SamplesToMs(samples uint32) float64 {
+	return DelayMsFromValue(samples)
+}
+
+// QualityRange is a suggested range of EQ Q factors for user interfaces.
+//
+// Unverified assumption: the Q range of the devices is not documented, and the range
+// is not enforced by QualityToValue.
+var QualityRange = Range{Min: 0.1, Max: 20}
+
+// Q factors are encoded as 100 * Q.
+//
+// Unverified assumption: the encoding of Q is not documented.
+const qualityScale = 100
+
+// encodableQuality is the range of Q factors that fit the raw value, 0 is not a valid Q
+var encodableQuality = Range{Min: 1.0 / qualityScale, Max: math.MaxUint32 / qualityScale}
+
+// QualityToValue converts a Q factor to its raw value.
+// Only Q factors that round to 0 or don't fit the raw value are rejected.
+func QualityToValue(q float64) (uint32, error) {
+	if err := encodableQuality.check("quality", "", q); err != nil {
+		return 0, err
+	}
+	return uint32(math.Round(q * qualityScale)), nil
+}
+
+// QualityFromValue converts a raw value to a Q factor
+func QualityFromValue(value uint32) float64 {
+	return float64(value) / qualityScale
+}
+
+// EqType is the filter type of an EQ band
+type EqType uint8
+
+const (
+	EqTypeLP6  EqType = 0
+	EqTypeLP12 EqType = 1
+	EqTypeHP6  EqType = 2
+	EqTypeHP12 EqType = 3
+	EqTypeBell EqType = 4
+	EqTypeLS6  EqType = 5
+	EqTypeLS12 EqType = 6
+	EqTypeHS6  EqType = 7
+	EqTypeHS12 EqType = 8
+	EqTypeAP6  EqType = 9
+	EqTypeAP12 EqType = 10
+)
+
+var eqTypeNames = []string{
+	EqTypeLP6:  "LP6",
+	EqTypeLP12: "LP12",
+	EqTypeHP6:  "HP6",
+	EqTypeHP12: "HP12",
+	EqTypeBell: "Bell",
+	EqTypeLS6:  "LS6",
+	EqTypeLS12: "LS12",
+	EqTypeHS6:  "HS6",
+	EqTypeHS12: "HS12",
+	EqTypeAP6:  "AP6",
+	EqTypeAP12: "AP12",
+}
+
+// EqTypes returns all known EQ types, in order
+func EqTypes() []EqType {
+	ret := make([]EqType, len(eqTypeNames))
+	for i := range eqTypeNames {
+		ret[i] = EqType(i)
+	}
+	return ret
+}
+
+// Valid returns true if t is a known EQ type
+func (t EqType) Valid() bool {
+	return int(t) < len(eqTypeNames)
+}
+
+func (t EqType) String() string {
+	if !t.Valid() {
+		return fmt.Sprintf("EqType(%d)", uint8(t))
+	}
+	return eqTypeNames[t]
+}
+
+// EqTypeToValue converts an EQ type to its raw value
+func EqTypeToValue(t EqType) (uint32, error) {
+	if !t.Valid() {
+		return 0, &ErrOutOfRange{
+			Quantity: "eq type",
+			Value:    float64(t),
+			Range:    Range{Min: 0, Max: float64(len(eqTypeNames) - 1)},
+		}
+	}
+	return uint32(t), nil
+}
+
+// EqTypeFromValue converts a raw value to an EQ type
+func EqTypeFromValue(value uint32) (EqType, error) {
+	t := EqType(value)
+	if value > math.MaxUint8 || !t.Valid() {
+		return 0, &ErrOutOfRange{
+			Quantity: "eq type",
+			Value:    float64(value),
+			Range:    Range{Min: 0, Max: float64(len(eqTypeNames) - 1)},
+		}
+	}
+	return t, nil
+}
+
+// ParseEqType parses the name of an EQ type, like "Bell" or "hp12"
+func ParseEqType(s string) (EqType, error) {
+	for i, name := range eqTypeNames {
+		if strings.EqualFold(name, strings.TrimSpace(s)) {
+			return EqType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown eq type %q, expected one of %s", s, strings.Join(eqTypeNames, ", "))
+}
@@ -0,0 +1,91 @@
+package units
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestConversions(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    float64
+		toValue  func(float64) (uint32, error)
+		from     func(uint32) float64
+		expected uint32
+	}{
+		{"Gain 0 dB", 0, GainToValue, GainFromValue, 800},
+		{"Gain -80 dB", -80, GainToValue, GainFromValue, 0},
+		{"Gain +20 dB", 20, GainToValue, GainFromValue, 0x3e8},
+		{"Gain -0.3 dB", -0.3, GainToValue, GainFromValue, 797},
+		{"Master volume 1", 1, MasterVolumeToValue, MasterVolumeFromValue, 0x3e8},
+		{"Master volume 0.5", 0.5, MasterVolumeToValue, MasterVolumeFromValue, 500},
+		{"Delay 10 ms", 10, DelayMsToValue, DelayMsFromValue, 480},
+		{"Delay 3.43 m", 3.43, DelayMetersToValue, DelayMetersFromValue, 480},
+		{"Quality 0.7", 0.7, QualityToValue, QualityFromValue, 70},
+		// the suggested ranges of delay and Q are not enforced
+		{"Delay 2 s", 2000, DelayMsToValue, DelayMsFromValue, 96000},
+		{"Quality 30", 30, QualityToValue, QualityFromValue, 3000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.toValue(tt.input)
+			if err != nil {
+				t.Fatalf("Conversion failed: %v", err)
+			}
+			if v != tt.expected {
+				t.Errorf("Expected value %d, got %d", tt.expected, v)
+			}
+			if back := tt.from(v); math.Abs(back-tt.input) > 1e-9 {
+				t.Errorf("Expected %g back, got %g", tt.input, back)
+			}
+		})
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		convert func() (uint32, error)
+	}{
+		{"Gain too low", func() (uint32, error) { return GainToValue(-80.1) }},
+		{"Gain too high", func() (uint32, error) { return GainToValue(21) }},
+		{"Gain NaN", func() (uint32, error) { return GainToValue(math.NaN()) }},
+		{"Negative master volume", func() (uint32, error) { return MasterVolumeToValue(-0.1) }},
+		{"Negative delay", func() (uint32, error) { return DelayMsToValue(-1) }},
+		{"Quality zero", func() (uint32, error) { return QualityToValue(0) }},
+		{"Delay overflow", func() (uint32, error) { return DelayMsToValue(1e12) }},
+		{"Unknown eq type", func() (uint32, error) { return EqTypeToValue(EqType(11)) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.convert()
+			var e *ErrOutOfRange
+			if !errors.As(err, &e) {
+				t.Errorf("Expected ErrOutOfRange, got %v", err)
+			}
+		})
+	}
+
+	if v := GainRange.Clamp(30); v != 20 {
+		t.Errorf("Expected gain to be clamped to 20, got %g", v)
+	}
+}
+
+func TestEqTypes(t *testing.T) {
+	for _, eqType := range EqTypes() {
+		parsed, err := ParseEqType(eqType.String())
+		if err != nil {
+			t.Fatalf("ParseEqType(%q) failed: %v", eqType.String(), err)
+		}
+		if parsed != eqType {
+			t.Errorf("Expected %v, got %v", eqType, parsed)
+		}
+	}
+
+	if _, err := EqTypeFromValue(256); err == nil {
+		t.Error("Expected an error for eq type 256")
+	}
+}
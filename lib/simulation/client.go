@@ -13,10 +13,11 @@ import (
 	"time"
 )
 
-const MaxBufferSize = 1024
+const MaxBufferSize = protocol.MaxBufferSize
 const Timeout = 10 * time.Second
 
 type Preset struct {
+	Name string
 }
 
 type Response struct {
@@ -27,6 +28,7 @@ type Response struct {
 type Request struct {
 	Buffer *bytes.Buffer
 	Addr   net.Addr
+	Packet *protocol.Packet
 }
 
 type SimulatedDeviceSettings struct {
@@ -37,6 +39,17 @@ type SimulatedDeviceSettings struct {
 	Port        uint16
 	// if not empty, bind to the given interface
 	Interface string
+
+	// reported in DeviceData responses. The model registered for VendorID and
+	// DeviceTypeId decides which channels and presets the device accepts.
+	VendorID        uint8
+	DeviceTypeId    uint16
+	FirmwareVersion uint32
+	SerialNumber    uint16
+
+	// PresetRecallDelay simulates a device that takes time to recall presets. If set,
+	// recalls are answered with StatusWaitServer first, and acknowledged after the delay.
+	PresetRecallDelay time.Duration
 }
 
 type SimulatedDevice struct {
@@ -45,6 +58,8 @@ type SimulatedDevice struct {
 	Settings              SimulatedDeviceSettings
 	currentlyActivePreset int
 	currentVolume         float32
+	// presets holds the saved presets by index
+	presets map[int]Preset
 }
 
 func NewSimulatedDevice(settings SimulatedDeviceSettings) *SimulatedDevice {
@@ -54,6 +69,7 @@ func NewSimulatedDevice(settings SimulatedDeviceSettings) *SimulatedDevice {
 		Settings:              settings,
 		currentlyActivePreset: 0,
 		currentVolume:         0.0,
+		presets:               make(map[int]Preset),
 	}
 }
 
@@ -104,57 +120,62 @@ func (sd *SimulatedDevice) Run(ctx context.Context) (err error) {
 				Msg("Received packet")
 			fmt.Printf("%s\n", hexdump.Dump(buffer[:n]))
 
+			packet, err := protocol.Decode(buffer[:n])
+			if err != nil {
+				log.Warn().Err(err).
+					Str("from", srcAddr.String()).
+					Msg("Could not decode message")
+				continue
+			}
+
 			request := &Request{
 				Buffer: bytes.NewBuffer(buffer[:n]),
 				Addr:   srcAddr,
+				Packet: packet,
 			}
 
-			if n > 0 {
-
-				messageType := protocol.MessageType(buffer[0])
-				log.Debug().
-					Str("messageType", messageType.String()).
-					Str("from", srcAddr.String()).
-					Str("local", conn.LocalAddr().String()).
-					Msg("Received message")
-
-				switch messageType {
-				case protocol.MessageTypePing:
-					{
-						err := sd.handlePing(request)
-						if err != nil {
-							log.Warn().Str("error", err.Error()).Msg("Could not handle ping")
-						}
+			messageType := packet.Header.MessageType
+			log.Debug().
+				Str("messageType", messageType.String()).
+				Str("from", srcAddr.String()).
+				Str("local", conn.LocalAddr().String()).
+				Msg("Received message")
+
+			switch messageType {
+			case protocol.MessageTypePing:
+				{
+					err := sd.handlePing(request)
+					if err != nil {
+						log.Warn().Str("error", err.Error()).Msg("Could not handle ping")
 					}
-				case protocol.MessageTypeLiveCmd:
-					{
-						err := sd.handleLiveCmd(request)
-						if err != nil {
-							log.Warn().Str("error", err.Error()).Msg("Could not handle live command")
-						}
+				}
+			case protocol.MessageTypeLiveCmd:
+				{
+					err := sd.handleLiveCmd(request)
+					if err != nil {
+						log.Warn().Str("error", err.Error()).Msg("Could not handle live command")
 					}
-				case protocol.MessageTypeDeviceData:
-					{
-						err := sd.handleDeviceData(request)
-						if err != nil {
-							log.Warn().Str("error", err.Error()).Msg("Could not handle device data")
-						}
+				}
+			case protocol.MessageTypeDeviceData:
+				{
+					err := sd.handleDeviceData(request)
+					if err != nil {
+						log.Warn().Str("error", err.Error()).Msg("Could not handle device data")
 					}
-				case protocol.MessageTypePresetRecall:
-					{
-						err := sd.handlePresetRecall(request)
-						if err != nil {
-							log.Warn().Str("error", err.Error()).Msg("Could not handle preset recall")
-						}
+				}
+			case protocol.MessageTypePresetRecall:
+				{
+					err := sd.handlePresetRecall(request)
+					if err != nil {
+						log.Warn().Str("error", err.Error()).Msg("Could not handle preset recall")
 					}
-				case protocol.MessageTypePresetSave:
-					{
-						err := sd.handlePresetSave(request)
-						if err != nil {
-							log.Warn().Str("error", err.Error()).Msg("Could not handle preset save")
-						}
+				}
+			case protocol.MessageTypePresetSave:
+				{
+					err := sd.handlePresetSave(request)
+					if err != nil {
+						log.Warn().Str("error", err.Error()).Msg("Could not handle preset save")
 					}
-				case protocol.MessageTypeUnknown:
 				}
 			}
 		}
@@ -210,152 +231,133 @@ func (sd *SimulatedDevice) Run(ctx context.Context) (err error) {
 }
 
 func (sd *SimulatedDevice) handlePing(req *Request) error {
-	hdr, err := protocol.ParseHeader(req.Buffer.Bytes())
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not parse ping header")
-		return err
-	}
+	return sd.reply(req, protocol.StatusResponseServer, nil)
+}
 
-	response := protocol.NewBasicHeader(
-		protocol.MessageTypePing,
-		protocol.StatusResponseServer,
-		sd.Settings.UniqueId,
-		hdr.SequenceNumber,
-		sd.Settings.ComponentId)
+// reply sends a response of the type of req with the given status and optional payload
+func (sd *SimulatedDevice) reply(req *Request, status protocol.StatusType, payload protocol.Message) error {
+	hdr := req.Packet.Header
+
+	response := &protocol.Packet{
+		Header: protocol.NewBasicHeader(
+			hdr.MessageType,
+			status,
+			sd.Settings.UniqueId,
+			hdr.SequenceNumber,
+			sd.Settings.ComponentId),
+		Payload: payload,
+	}
 
-	buf := new(bytes.Buffer)
-	err = protocol.EncodeHeader(buf, response)
+	data, err := response.MarshalBinary()
 	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not encode header")
+		log.Error().Str("error", err.Error()).Msg("Could not encode response")
 		return err
 	}
 
 	sd.SendChannel <- Response{
-		Buffer: buf,
+		Buffer: bytes.NewBuffer(data),
 		Addr:   req.Addr,
 	}
 
 	return nil
 }
 
-// TODO All these responses are wrong
-func (sd *SimulatedDevice) handleLiveCmd(req *Request) error {
-	hdr, err := protocol.ParseHeader(req.Buffer.Bytes())
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not parse ping header")
-		return err
-	}
-
-	response := protocol.NewBasicHeader(
-		protocol.MessageTypePing,
-		protocol.StatusResponseServer,
-		sd.Settings.UniqueId,
-		hdr.SequenceNumber,
-		sd.Settings.ComponentId)
-
-	buf := new(bytes.Buffer)
-	err = protocol.EncodeHeader(buf, response)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not encode header")
-		return err
-	}
+// model returns the registered model of the simulated device, if any
+func (sd *SimulatedDevice) model() (*protocol.DeviceModel, bool) {
+	return protocol.LookupModel(sd.Settings.VendorID, sd.Settings.DeviceTypeId)
+}
 
-	sd.SendChannel <- Response{
-		Buffer: buf,
-		Addr:   req.Addr,
+// handleLiveCmd acknowledges live commands, and rejects the ones for channels
+// or parameters the model of the device doesn't have.
+func (sd *SimulatedDevice) handleLiveCmd(req *Request) error {
+	if lc, ok := req.Packet.Payload.(*protocol.LiveCmd); ok {
+		if m, ok := sd.model(); ok {
+			path, err := lc.ParsedPath()
+			if err == nil {
+				err = m.ValidatePath(path)
+			}
+			if err != nil {
+				log.Warn().Err(err).Msg("Rejecting live command")
+				return sd.reply(req, protocol.StatusErrorServer, nil)
+			}
+		}
 	}
 
-	return nil
+	return sd.reply(req, protocol.StatusResponseServer, nil)
 }
 
-// TODO All these responses are wrong
+// handleDeviceData answers DeviceData requests with the settings of the device,
+// and acknowledges DeviceData commands like master volume.
 func (sd *SimulatedDevice) handleDeviceData(req *Request) error {
-	hdr, err := protocol.ParseHeader(req.Buffer.Bytes())
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not parse ping header")
-		return err
+	status := req.Packet.Header.Status
+	if status == protocol.StatusRequestServer || status == protocol.StatusRequestClient {
+		return sd.reply(req, protocol.StatusResponseServer, sd.deviceData())
 	}
+	return sd.reply(req, protocol.StatusResponseServer, nil)
+}
 
-	response := protocol.NewBasicHeader(
-		protocol.MessageTypePing,
-		protocol.StatusResponseServer,
-		sd.Settings.UniqueId,
-		hdr.SequenceNumber,
-		sd.Settings.ComponentId)
-
-	buf := new(bytes.Buffer)
-	err = protocol.EncodeHeader(buf, response)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not encode header")
-		return err
+func (sd *SimulatedDevice) deviceData() *protocol.DeviceDataResponse {
+	dd := &protocol.DeviceDataResponse{
+		VendorID:           sd.Settings.VendorID,
+		DeviceTypeId:       sd.Settings.DeviceTypeId,
+		FirmwareVersion:    sd.Settings.FirmwareVersion,
+		SerialNumber:       sd.Settings.SerialNumber,
+		SubnetPrefixLength: 24,
 	}
-
-	sd.SendChannel <- Response{
-		Buffer: buf,
-		Addr:   req.Addr,
+	if ip := net.ParseIP(sd.Settings.Address).To4(); ip != nil {
+		copy(dd.StaticIP[:], ip)
 	}
-
-	return nil
-
+	copy(dd.DeviceName[:], sd.Settings.Name)
+	return dd
 }
 
-// TODO All these responses are wrong
+// handlePresetRecall acknowledges preset recalls, and rejects the ones for presets
+// the model of the device doesn't have. The simulated device lists its presets in
+// index order, so recalling by position recalls the preset with the same index.
 func (sd *SimulatedDevice) handlePresetRecall(req *Request) error {
-	hdr, err := protocol.ParseHeader(req.Buffer.Bytes())
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not parse recall header")
-		return err
-	}
-
-	response := protocol.NewBasicHeader(
-		protocol.MessageTypePresetRecall,
-		protocol.StatusResponseServer,
-		sd.Settings.UniqueId,
-		hdr.SequenceNumber,
-		sd.Settings.ComponentId)
-
-	buf := new(bytes.Buffer)
-	err = protocol.EncodeHeader(buf, response)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not encode header")
-		return err
+	pr, ok := req.Packet.Payload.(*protocol.PresetRecall)
+	if ok && (pr.CrtFlags == protocol.RecallByPresetIndex || pr.CrtFlags == protocol.RecallByPresetPosition) {
+		if m, ok := sd.model(); ok {
+			if err := m.ValidatePreset(int(pr.IndexPosition)); err != nil {
+				log.Warn().Err(err).Msg("Rejecting preset recall")
+				return sd.reply(req, protocol.StatusErrorServer, nil)
+			}
+		}
+		sd.currentlyActivePreset = int(pr.IndexPosition)
 	}
 
-	sd.SendChannel <- Response{
-		Buffer: buf,
-		Addr:   req.Addr,
+	if delay := sd.Settings.PresetRecallDelay; delay > 0 {
+		if err := sd.reply(req, protocol.StatusWaitServer, nil); err != nil {
+			return err
+		}
+		time.AfterFunc(delay, func() {
+			_ = sd.reply(req, protocol.StatusResponseServer, nil)
+		})
+		return nil
 	}
 
-	return nil
+	return sd.reply(req, protocol.StatusResponseServer, nil)
 }
 
-// TODO All these responses are wrong
+// handlePresetSave stores the name of the saved preset and echoes the request,
+// rejecting presets the model of the device doesn't have.
 func (sd *SimulatedDevice) handlePresetSave(req *Request) error {
-	hdr, err := protocol.ParseHeader(req.Buffer.Bytes())
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not parse ping header")
-		return err
+	ps, ok := req.Packet.Payload.(*protocol.PresetSave)
+	if !ok {
+		return sd.reply(req, protocol.StatusErrorServer, nil)
 	}
-
-	response := protocol.NewBasicHeader(
-		protocol.MessageTypePing,
-		protocol.StatusResponseServer,
-		sd.Settings.UniqueId,
-		hdr.SequenceNumber,
-		sd.Settings.ComponentId)
-
-	buf := new(bytes.Buffer)
-	err = protocol.EncodeHeader(buf, response)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not encode header")
-		return err
-	}
-
-	sd.SendChannel <- Response{
-		Buffer: buf,
-		Addr:   req.Addr,
+	if m, ok := sd.model(); ok {
+		if err := m.ValidatePreset(int(ps.IndexPosition)); err != nil {
+			log.Warn().Err(err).Msg("Rejecting preset save")
+			return sd.reply(req, protocol.StatusErrorServer, nil)
+		}
 	}
 
-	return nil
+	sd.presets[int(ps.IndexPosition)] = Preset{Name: ps.Name()}
+	log.Info().
+		Int("preset", int(ps.IndexPosition)).
+		Str("name", ps.Name()).
+		Msg("Saved preset")
 
+	return sd.reply(req, protocol.StatusResponseServer, ps)
 }